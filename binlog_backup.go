@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// work types to run on the same stream with --wtype=backup
+var Opts_Valid_Backup_With []string = []string{"stats", "2sql", "rollback"}
+
+// write the raw events from master to local binlog files with the same names, like
+// mysqlbinlog --read-from-remote-server --raw. positions in the local files are the same as the master's
+type BinlogBackupWriter struct {
+	dir        string
+	nextBinlog string   // binlog of the following events, from rotate events
+	binlog     string   // the binlog being written or written last
+	pos        uint32   // end position of the last event written
+	fh         *os.File // nil if no binlog is being written
+}
+
+func NewBinlogBackupWriter(dir string) *BinlogBackupWriter {
+	return &BinlogBackupWriter{dir: dir}
+}
+
+// feed every event read from master, before the raw data is dropped. events already written before reconnecting are skipped,
+// the first event after starting is written at its position, so the local binlog is truncated to the checkpoint with --resume
+func (this *BinlogBackupWriter) WriteEvent(ev *replication.BinlogEvent) error {
+	h := ev.Header
+	binlog := this.nextBinlog
+	rotateEv, isRotate := ev.Event.(*replication.RotateEvent)
+	if isRotate {
+		this.nextBinlog = string(rotateEv.NextLogName)
+	}
+	if h.LogPos == 0 || h.Flags&replication.LOG_EVENT_ARTIFICIAL_F > 0 {
+		// fake rotate event at the beginning of replication, and the format description event when starting after position 4
+		return nil
+	}
+	if (mysql.Position{Name: binlog, Pos: h.LogPos}).Compare(mysql.Position{Name: this.binlog, Pos: this.pos}) <= 0 {
+		return nil
+	}
+	startPos := h.LogPos - h.EventSize
+	if this.fh == nil || this.binlog != binlog {
+		if err := this.open(binlog, startPos); err != nil {
+			return err
+		}
+	} else if startPos != this.pos {
+		return errors.Errorf("events between position %d and %d of %s are missing", this.pos, startPos, this.binlog)
+	}
+	if n, err := this.fh.Write(ev.RawData); err != nil {
+		return errors.Annotatef(err, "fail to write binlog %s", this.fh.Name())
+	} else if n != len(ev.RawData) {
+		return errors.Annotatef(io.ErrShortWrite, "fail to write binlog %s", this.fh.Name())
+	}
+	this.pos = h.LogPos
+	if isRotate {
+		// the last event of the binlog
+		return this.Close()
+	}
+	return nil
+}
+
+// open the binlog to write at pos, a new one at position 4, otherwise the existing one is truncated to pos
+func (this *BinlogBackupWriter) open(binlog string, pos uint32) error {
+	if err := this.Close(); err != nil {
+		return err
+	}
+	if binlog == "" {
+		return errors.Errorf("no binlog name from rotate event before the event at position %d", pos)
+	}
+	name := filepath.Join(this.dir, binlog)
+	headLen := uint32(len(replication.BinLogFileHeader))
+	var fh *os.File
+	var err error
+	if pos <= headLen {
+		fh, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err == nil {
+			_, err = fh.Write(replication.BinLogFileHeader)
+		}
+	} else {
+		fi, statErr := os.Stat(name)
+		if statErr != nil || fi.Size() < int64(pos) {
+			return errors.Errorf("backup of %s starts at position %d, but the local binlog %s does not exist or is shorter than it, backup it from position %d",
+				binlog, pos, name, headLen)
+		}
+		// events after pos are written again
+		fh, err = os.OpenFile(name, os.O_WRONLY, 0644)
+		if err == nil {
+			err = fh.Truncate(int64(pos))
+		}
+		if err == nil {
+			_, err = fh.Seek(int64(pos), io.SeekStart)
+		}
+	}
+	if err != nil {
+		if fh != nil {
+			fh.Close()
+		}
+		return errors.Annotatef(err, "fail to open %s to backup binlog", name)
+	}
+	this.fh, this.binlog, this.pos = fh, binlog, pos
+	return nil
+}
+
+func (this *BinlogBackupWriter) Close() error {
+	if this.fh == nil {
+		return nil
+	}
+	err := this.fh.Close()
+	this.fh = nil
+	return errors.Trace(err)
+}
+
+// only backup binlogs, no stats nor sql
+func (this ConfCmd) IfBackupOnly() bool {
+	return this.Backup && this.BackupWith == ""
+}
+
+// --wtype=backup --backup-with, the work type becomes the one of --backup-with
+func (this *ConfCmd) CheckBackupOptions() {
+	if this.WorkType != "backup" {
+		if this.BackupWith != "" {
+			fmt.Println("--backup-with works with --wtype=backup")
+			os.Exit(ERR_OPTION_MISMATCH)
+		}
+		return
+	}
+	if this.Mode != "repl" {
+		fmt.Println("--wtype=backup works with --mode=repl only")
+		os.Exit(ERR_OPTION_MISMATCH)
+	}
+	this.Backup = true
+	if this.BackupWith == "" {
+		// events are still parsed for transaction boundaries, but no result
+		this.WorkType = "stats"
+		return
+	}
+	CheckElementOfSliceStr(Opts_Valid_Backup_With, this.BackupWith, "invalid arg for --backup-with", true)
+	this.WorkType = this.BackupWith
+}
@@ -10,13 +10,49 @@ import (
 	sliceKits "github.com/toolkits/slice"
 )
 
-type BinEventHandlingIndx struct {
-	EventIdx uint64
-	lock     sync.RWMutex
-	finished bool
+// threads generate sqls of rows events out of order, the reorder buffer emits them to sqlChan in order of EventIdx.
+// at most window events are buffered, the thread with EventIdx beyond the window waits
+type SqlReorderBuffer struct {
+	nextIdx uint64
+	window  uint64
+	pending map[uint64]ForwardRollbackSqlOfPrint
+	sqlChan chan ForwardRollbackSqlOfPrint
+	lock    sync.Mutex
+	cond    *sync.Cond
 }
 
-var G_HandlingBinEventIndex *BinEventHandlingIndx
+var G_SqlReorderBuffer *SqlReorderBuffer
+
+func NewSqlReorderBuffer(window uint64, sqlChan chan ForwardRollbackSqlOfPrint) *SqlReorderBuffer {
+	// EventIdx starts from 1
+	buf := &SqlReorderBuffer{nextIdx: 1, window: window, pending: map[uint64]ForwardRollbackSqlOfPrint{}, sqlChan: sqlChan}
+	buf.cond = sync.NewCond(&buf.lock)
+	return buf
+}
+
+// every EventIdx must be put once, even no sql generated, otherwise the following ones are never emitted
+func (this *SqlReorderBuffer) Put(idx uint64, sqls ForwardRollbackSqlOfPrint) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for idx >= this.nextIdx+this.window {
+		this.cond.Wait()
+	}
+	this.pending[idx] = sqls
+	if idx != this.nextIdx {
+		return
+	}
+	for {
+		next, ok := this.pending[this.nextIdx]
+		if !ok {
+			break
+		}
+		delete(this.pending, this.nextIdx)
+		// blocks when writing sql files is slow
+		this.sqlChan <- next
+		this.nextIdx++
+	}
+	this.cond.Broadcast()
+}
 
 type MaxBinEventIdx struct {
 	MaxEventIdx uint64
@@ -46,13 +82,32 @@ type MyBinEvent struct {
 	SqlType     string // insert, update, delete
 	Timestamp   uint32
 	TrxIndex    uint64
-	TrxStatus   int // 0:begin, 1: commit, 2: rollback, -1: in_progress
+	TrxStatus   int              // 0:begin, 1: commit, 2: rollback, 3: implicit(ddl), 4: xa prepare, -1: in_progress
+	TbMapMeta   *TableMapOptMeta // optional metadata of table map event, nil if not any
+	Gtid        string           // gtid of the transaction, empty if gtid is not enabled
+	Xid         string           // xid of xa transaction
+	OriginalSql string           // original sql of the rows event with --original-sql
+	RelayPos    mysql.Position   // end position in the relay log with --relay-log
+}
+
+// table definition is from optional metadata of table map event, or from mysql or json file
+func (this *MyBinEvent) IfHasTableDef(cfg ConfCmd) bool {
+	if this.TbMapMeta.HasColumnNames() {
+		return true
+	}
+	if cfg.OnlyBinlogMeta {
+		return false
+	}
+	tbKey := GetAbsTableName(string(this.BinEvent.Table.Schema), string(this.BinEvent.Table.Table))
+	_, ok := G_TablesColumnsInfo.tableInfos[tbKey]
+	return ok
 }
 
-func CheckBinHeaderCondition(cfg ConfCmd, header *replication.EventHeader, currentBinlog *string) int {
+// gtidFilter is nil if no gtid option is set, e is the parsed event of the header.
+// myPos is the position of the event to compare with --start-binlog --start-pos --stop-binlog --stop-pos
+func CheckBinHeaderCondition(cfg ConfCmd, header *replication.EventHeader, e replication.Event, myPos mysql.Position, gtidFilter *GtidFilter) int {
 	// process: 0, continue: 1, break: 2
 
-	myPos := mysql.Position{Name: *currentBinlog, Pos: header.LogPos}
 	//fmt.Println(cfg.StartFilePos, cfg.IfSetStopFilePos, myPos)
 	if cfg.IfSetStartFilePos {
 		cmpRe := myPos.Compare(cfg.StartFilePos)
@@ -80,6 +135,12 @@ func CheckBinHeaderCondition(cfg ConfCmd, header *replication.EventHeader, curre
 			return RE_BREAK
 		}
 	}
+
+	if gtidFilter != nil {
+		if chRe := gtidFilter.CheckEvent(header, e); chRe != RE_PROCESS {
+			return chRe
+		}
+	}
 	if cfg.FilterSqlLen == 0 {
 		return RE_PROCESS
 	}
@@ -92,7 +153,8 @@ func CheckBinHeaderCondition(cfg ConfCmd, header *replication.EventHeader, curre
 		}
 	}
 
-	if header.EventType == replication.UPDATE_ROWS_EVENTv1 || header.EventType == replication.UPDATE_ROWS_EVENTv2 {
+	if header.EventType == replication.UPDATE_ROWS_EVENTv1 || header.EventType == replication.UPDATE_ROWS_EVENTv2 ||
+		header.EventType == replication.PARTIAL_UPDATE_ROWS_EVENT {
 		if sliceKits.ContainsString(cfg.FilterSql, "update") {
 			return RE_PROCESS
 		} else {
@@ -143,7 +205,8 @@ func (this *MyBinEvent) CheckBinEvent(cfg ConfCmd, ev *replication.BinlogEvent,
 		replication.DELETE_ROWS_EVENTv1,
 		replication.WRITE_ROWS_EVENTv2,
 		replication.UPDATE_ROWS_EVENTv2,
-		replication.DELETE_ROWS_EVENTv2:
+		replication.DELETE_ROWS_EVENTv2,
+		replication.PARTIAL_UPDATE_ROWS_EVENT:
 
 		//replication.XID_EVENT,
 		//replication.TABLE_MAP_EVENT:
@@ -174,7 +237,7 @@ func (this *MyBinEvent) CheckBinEvent(cfg ConfCmd, ev *replication.BinlogEvent,
 	case replication.XID_EVENT:
 		this.IfRowsEvent = false
 
-	case replication.MARIADB_GTID_EVENT:
+	case replication.MARIADB_GTID_EVENT, replication.XA_PREPARE_LOG_EVENT:
 		this.IfRowsEvent = false
 
 	default:
@@ -188,8 +251,11 @@ func (this *MyBinEvent) CheckBinEvent(cfg ConfCmd, ev *replication.BinlogEvent,
 func GetFirstBinlogPosToParse(cfg ConfCmd) (string, int64) {
 	var binlog string
 	var pos int64
-	if cfg.StartFile != "" {
-		binlog = filepath.Join(cfg.BinlogDir, cfg.StartFile)
+	if cfg.StartFile != "" && !cfg.IfRelayLogByMasterPos() {
+		// the binlog may be compressed
+		if binlog = FindBinlogFile(cfg.BinlogDir, cfg.StartFile); binlog == "" {
+			binlog = filepath.Join(cfg.BinlogDir, cfg.StartFile)
+		}
 	} else {
 		binlog = cfg.GivenBinlogFile
 	}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/toolkits/file"
+	"github.com/ulikunitz/xz"
+)
+
+// extensions of compressed or archived binlog files, like mysql-bin.000123.gz, longer first
+var G_Binlog_Compress_Exts []string = []string{".tar.gz", ".tar.zst", ".tar.xz", ".tgz", ".gz", ".zst", ".zstd", ".xz", ".tar"}
+
+var (
+	MAGIC_GZIP []byte = []byte{0x1f, 0x8b}
+	MAGIC_ZSTD []byte = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	MAGIC_XZ   []byte = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	MAGIC_TAR  []byte = []byte("ustar") // at offset 257 of tar header
+)
+
+const (
+	BINLOG_FILE_READ_BUFFER = 1024 * 1024
+	TAR_MAGIC_OFFSET        = 257
+)
+
+// the binlog name of the file without the compression extension, /bak/mysql-bin.000123.gz: mysql-bin.000123
+func GetBinlogNameOfFile(name string) string {
+	binlog := filepath.Base(name)
+	for _, ext := range G_Binlog_Compress_Exts {
+		if strings.HasSuffix(binlog, ext) {
+			return strings.TrimSuffix(binlog, ext)
+		}
+	}
+	return binlog
+}
+
+// the file of the binlog in dir, the binlog itself or a compressed one. empty if not found
+func FindBinlogFile(dir string, binlog string) string {
+	name := filepath.Join(dir, binlog)
+	if file.IsFile(name) {
+		return name
+	}
+	for _, ext := range G_Binlog_Compress_Exts {
+		if file.IsFile(name + ext) {
+			return name + ext
+		}
+	}
+	return ""
+}
+
+// content of binlog file, decompressed if it is compressed by gzip, zstd or xz, and the first regular file if it is a tar archive
+type BinlogFileReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (this *BinlogFileReader) Close() error {
+	var err error
+	for i := len(this.closers) - 1; i >= 0; i-- {
+		if cerr := this.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// compression is detected by magic bytes, not the extension
+func OpenBinlogFile(name string) (*BinlogFileReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	reader := &BinlogFileReader{closers: []io.Closer{f}}
+	br := bufio.NewReaderSize(f, BINLOG_FILE_READ_BUFFER)
+	var r io.Reader // the decompressed content, nil if not compressed
+
+	magic, _ := br.Peek(len(MAGIC_XZ))
+	switch {
+	case bytes.HasPrefix(magic, MAGIC_GZIP):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			reader.Close()
+			return nil, errors.Annotatef(err, "fail to decompress %s as gzip", name)
+		}
+		reader.closers = append(reader.closers, gr)
+		r = gr
+	case bytes.HasPrefix(magic, MAGIC_ZSTD):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			reader.Close()
+			return nil, errors.Annotatef(err, "fail to decompress %s as zstd", name)
+		}
+		reader.closers = append(reader.closers, zr.IOReadCloser())
+		r = zr
+	case bytes.HasPrefix(magic, MAGIC_XZ):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			reader.Close()
+			return nil, errors.Annotatef(err, "fail to decompress %s as xz", name)
+		}
+		r = xr
+	}
+
+	if r != nil {
+		br = bufio.NewReaderSize(r, BINLOG_FILE_READ_BUFFER)
+	}
+	r = br
+	// tar archive, compressed or not
+	if head, _ := br.Peek(TAR_MAGIC_OFFSET + len(MAGIC_TAR)); len(head) == TAR_MAGIC_OFFSET+len(MAGIC_TAR) &&
+		bytes.Equal(head[TAR_MAGIC_OFFSET:], MAGIC_TAR) {
+		tr := tar.NewReader(br)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				reader.Close()
+				return nil, errors.Errorf("no binlog file in tar archive %s", name)
+			} else if err != nil {
+				reader.Close()
+				return nil, errors.Annotatef(err, "fail to read tar archive %s", name)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				break
+			}
+		}
+		r = tr
+	}
+	reader.Reader = r
+	return reader, nil
+}
+
+// open the binlog file and read the binlog magic header
+func OpenBinlogFileAndCheckHeader(name string) (*BinlogFileReader, error) {
+	r, err := OpenBinlogFile(name)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, len(replication.BinLogFileHeader))
+	if _, err = io.ReadFull(r, b); err != nil {
+		r.Close()
+		return nil, errors.Annotatef(err, "fail to read %s", name)
+	} else if !bytes.Equal(b, replication.BinLogFileHeader) {
+		r.Close()
+		return nil, errors.Errorf("%s is not a valid binlog file, head 4 bytes must fe'bin' ", name)
+	}
+	return r, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/klauspost/compress/zstd"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// BinEventDecoder wraps replication.BinlogParser, shared by mode file and repl.
+// the old go-mysql fails to parse table map event with optional metadata(mysql 8.0),
+// so we cut the optional metadata off before parsing and decode it ourselves
+type BinEventDecoder struct {
+	parser      *replication.BinlogParser
+	format      *replication.FormatDescriptionEvent
+	tbMapMetas  map[uint64]*TableMapOptMeta // table id: optional metadata
+	stmtEnd     bool
+	zstdDecoder *zstd.Decoder // for transaction payload event, created when needed
+}
+
+func NewBinEventDecoder() *BinEventDecoder {
+	decoder := &BinEventDecoder{parser: replication.NewBinlogParser(), tbMapMetas: map[uint64]*TableMapOptMeta{}}
+	decoder.parser.SetParseTime(true)        // go time type for mysql datetime/time column
+	decoder.parser.SetUseDecimalString(true) // keep the precision of decimal
+	return decoder
+}
+
+func (this *BinEventDecoder) ParseHeader(data []byte) (*replication.EventHeader, error) {
+	return this.parser.ParseHeader(data)
+}
+
+// data is the event body, checksum included
+func (this *BinEventDecoder) ParseEvent(h *replication.EventHeader, data []byte) (replication.Event, error) {
+	if h.EventType == replication.FORMAT_DESCRIPTION_EVENT {
+		e, err := this.parser.ParseEvent(h, data)
+		if err == nil {
+			this.format = e.(*replication.FormatDescriptionEvent)
+		}
+		return e, err
+	}
+	if h.EventType == replication.XA_PREPARE_LOG_EVENT && this.format != nil {
+		e := &XaPrepareEvent{}
+		if this.format.ChecksumAlgorithm == replication.BINLOG_CHECKSUM_ALG_CRC32 && len(data) >= 4 {
+			data = data[0 : len(data)-4]
+		}
+		if err := e.Decode(data); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	if h.EventType == replication.TRANSACTION_PAYLOAD_EVENT && this.format != nil {
+		if this.format.ChecksumAlgorithm == replication.BINLOG_CHECKSUM_ALG_CRC32 && len(data) >= 4 {
+			data = data[0 : len(data)-4]
+		}
+		return this.parsePayloadEvent(h, data)
+	}
+	if eventType, ok := G_Mariadb_Compressed_Event_Types[h.EventType]; ok && this.format != nil {
+		return this.parseMariadbCompressedEvent(h, data, eventType)
+	}
+	if h.EventType != replication.TABLE_MAP_EVENT || this.format == nil {
+		e, err := this.parser.ParseEvent(h, data)
+		if re, ok := e.(*replication.RowsEvent); ok && err == nil {
+			if re.Flags&replication.RowsEventStmtEndFlag > 0 {
+				// same as the parser, table ids are not valid after the end of statement
+				this.stmtEnd = true
+			}
+		}
+		return e, err
+	}
+
+	body := data
+	var checksum []byte
+	if this.format.ChecksumAlgorithm == replication.BINLOG_CHECKSUM_ALG_CRC32 && len(data) >= 4 {
+		body = data[0 : len(data)-4]
+		checksum = data[len(data)-4:]
+	}
+	tableIDSize := 6
+	if len(this.format.EventTypeHeaderLengths) >= int(replication.TABLE_MAP_EVENT) &&
+		this.format.EventTypeHeaderLengths[replication.TABLE_MAP_EVENT-1] == 6 {
+		tableIDSize = 4
+	}
+	metaPos, err := GetTableMapOptMetaPos(body, tableIDSize)
+	if err != nil {
+		return nil, err
+	}
+	var optMeta []byte
+	if metaPos < len(body) {
+		optMeta = body[metaPos:]
+		data = append(append([]byte{}, body[0:metaPos]...), checksum...)
+	}
+
+	e, err := this.parser.ParseEvent(h, data)
+	if err != nil {
+		return nil, err
+	}
+	if this.stmtEnd {
+		this.tbMapMetas = map[uint64]*TableMapOptMeta{}
+		this.stmtEnd = false
+	}
+	tbMap := e.(*replication.TableMapEvent)
+	if len(optMeta) == 0 {
+		delete(this.tbMapMetas, tbMap.TableID)
+		return e, nil
+	}
+	meta, err := DecodeTableMapOptMeta(optMeta, tbMap)
+	if err != nil {
+		return nil, err
+	}
+	this.tbMapMetas[tbMap.TableID] = meta
+	return e, nil
+}
+
+// optional metadata of the last table map event of the table id, nil if not any
+func (this *BinEventDecoder) GetTableMapOptMeta(tableID uint64) *TableMapOptMeta {
+	return this.tbMapMetas[tableID]
+}
@@ -4,100 +4,150 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
-	"strings"
 
 	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
-	"github.com/toolkits/file"
-)
-
-var (
-	fileBinEventHandlingIndex uint64 = 0
-	fileTrxIndex              uint64 = 0
 )
 
 type BinFileParser struct {
-	parser *replication.BinlogParser
+	parser     *BinEventDecoder
+	gtidFilter *GtidFilter
+	abort      chan struct{} // closed when no more events are needed
+}
+
+// one binlog file parsed by its own goroutine and decoder, each binlog file starts with its own format description event
+type BinFileParseJob struct {
+	binlog   string
+	evChan   chan MyBinEvent
+	statChan chan BinEventStats
+	result   int // set before evChan and statChan are closed
+	err      error
+}
+
+func (this BinFileParser) ParseBinlogFileJob(cfg ConfCmd, job *BinFileParseJob) {
+	defer close(job.evChan)
+	defer close(job.statChan)
+	job.result, job.err = this.MyParseOneBinlogFile(cfg, job.binlog, job.evChan, job.statChan)
 }
 
+// binlog files are parsed concurrently(--parse-threads), and merged in order of binlog files
 func (this BinFileParser) MyParseAllBinlogFiles(cfg ConfCmd, evChan chan MyBinEvent, statChan chan BinEventStats) {
 
 	defer close(evChan)
 	defer close(statChan)
 
+	abort := make(chan struct{})
+	threadsSem := make(chan struct{}, cfg.ParseThreads)
+	jobs := make(chan *BinFileParseJob, cfg.ParseThreads)
+
 	binlog, binpos := GetFirstBinlogPosToParse(cfg)
-	binBaseName, binBaseIndx := GetBinlogBasenameAndIndex(binlog)
-	for {
-		if cfg.IfSetStopFilePos {
-			if cfg.StopFilePos.Compare(mysql.Position{Name: filepath.Base(binlog), Pos: 4}) < 1 {
-				break
+	go func() {
+		defer close(jobs)
+		for {
+			if cfg.IfSetStopFilePos && !cfg.IfRelayLogByMasterPos() {
+				if cfg.StopFilePos.Compare(mysql.Position{Name: GetBinlogNameOfFile(binlog), Pos: 4}) < 1 {
+					return
+				}
 			}
-		}
-		fmt.Printf("start to parse %s %d\n", binlog, binpos)
-		result, err := this.MyParseOneBinlogFile(cfg, binlog, evChan, statChan)
-		if err != nil {
-			fmt.Println(err)
-			break
-		}
-		if result == RE_BREAK {
-			break
-		} else if result == RE_FILE_END {
+			select {
+			case threadsSem <- struct{}{}:
+			case <-abort:
+				return
+			}
+			job := &BinFileParseJob{binlog: binlog, evChan: make(chan MyBinEvent, BINLOG_FILE_PARSE_BUFFER),
+				statChan: make(chan BinEventStats, BINLOG_FILE_PARSE_BUFFER)}
+			go BinFileParser{parser: NewBinEventDecoder(), gtidFilter: NewGtidFilter(cfg), abort: abort}.ParseBinlogFileJob(cfg, job)
+			jobs <- job
+
 			if !cfg.IfSetStopParsPoint {
 				//just parse one binlog
-				break
+				return
 			}
-			binlog = filepath.Join(cfg.BinlogDir, GetNextBinlog(binBaseName, binBaseIndx))
-			if !file.IsFile(binlog) {
-				fmt.Printf("%s not exists nor a file\n", binlog)
-				break
+			nextBinlog, err := GetNextBinlogFile(cfg, binlog)
+			if err != nil {
+				fmt.Println(err)
+				return
+			} else if nextBinlog == "" {
+				fmt.Printf("%s is the last binlog in %s\n", GetBinlogNameOfFile(binlog), cfg.BinlogIndex)
+				return
 			}
-			binBaseIndx++
-			binpos = 4
-		} else {
-			fmt.Printf("this should not happen: return value of MyParseOneBinlog is %d\n", result)
-			break
+			binlog = nextBinlog
 		}
+	}()
 
-	}
-	//g_MaxBin_Event_Idx.SetMaxBinEventIdx(fileBinEventHandlingIndex)
+	var (
+		fileEventIdx     uint64 = 0
+		fileTrxIndexBase uint64 = 0
+		lastTrxIndex     uint64 = 0
+	)
+	for job := range jobs {
+		fmt.Printf("start to parse %s %d\n", job.binlog, binpos)
+		binpos = 4
+		jobEvChan, jobStatChan := job.evChan, job.statChan
+		for jobEvChan != nil || jobStatChan != nil {
+			select {
+			case ev, ok := <-jobEvChan:
+				if !ok {
+					jobEvChan = nil
+					continue
+				}
+				fileEventIdx++
+				ev.EventIdx = fileEventIdx
+				// trx index starts from 0 in each binlog file
+				ev.TrxIndex += fileTrxIndexBase
+				if ev.TrxIndex > lastTrxIndex {
+					lastTrxIndex = ev.TrxIndex
+				}
+				evChan <- ev
+			case st, ok := <-jobStatChan:
+				if !ok {
+					jobStatChan = nil
+					continue
+				}
+				st.TrxIndex += fileTrxIndexBase
+				if st.TrxIndex > lastTrxIndex {
+					lastTrxIndex = st.TrxIndex
+				}
+				statChan <- st
+			}
+		}
+		fileTrxIndexBase = lastTrxIndex
+		<-threadsSem
 
+		if job.err != nil {
+			fmt.Println(job.err)
+			break
+		}
+		if job.result == RE_BREAK {
+			break
+		} else if job.result != RE_FILE_END {
+			fmt.Printf("this should not happen: return value of MyParseOneBinlog is %d\n", job.result)
+			break
+		}
+	}
+	// stop parsing the files ahead
+	close(abort)
 }
 
 func (this BinFileParser) MyParseOneBinlogFile(cfg ConfCmd, name string, evChan chan MyBinEvent, statChan chan BinEventStats) (int, error) {
 	// process: 0, continue: 1, break: 2
-	f, err := os.Open(name)
+	// compressed or archived binlog is decompressed when reading
+	r, err := OpenBinlogFileAndCheckHeader(name)
 	if err != nil {
-		CheckErr(err, "fail to open "+name, ERR_FILE_OPEN, false)
-		return RE_BREAK, errors.Trace(err)
-	}
-	defer f.Close()
-	fileTypeBytes := int64(4)
-
-	b := make([]byte, fileTypeBytes)
-	if _, err = f.Read(b); err != nil {
-		CheckErr(err, "fail to read "+name, ERR_FILE_READ, false)
-		return RE_BREAK, errors.Trace(err)
-	} else if !bytes.Equal(b, replication.BinLogFileHeader) {
-		CheckErr(err, name+" is not a valid binlog file, head 4 bytes must fe'bin' ", ERR_NOT_BINLOG, false)
+		CheckErr(err, "fail to open "+name, ERR_NOT_BINLOG, false)
 		return RE_BREAK, errors.Trace(err)
 	}
+	defer r.Close()
 
-	// must not seek to other position, otherwise the program may panic because formatevent, table map event is skipped
-	if _, err = f.Seek(fileTypeBytes, os.SEEK_SET); err != nil {
-		CheckErr(err, fmt.Sprintf("seek %s to %d error %v", name, fileTypeBytes, err), ERR_FILE_SEEK, false)
-		return RE_BREAK, errors.Trace(err)
-	}
-	var binlog string = filepath.Base(name)
-	return this.MyParseReader(cfg, f, evChan, &binlog, statChan)
+	// must not skip any event, otherwise the program may panic because formatevent, table map event is skipped
+	var binlog string = GetBinlogNameOfFile(name)
+	return this.MyParseReader(cfg, r, evChan, &binlog, statChan)
 }
 
 func (this BinFileParser) MyParseReader(cfg ConfCmd, r io.Reader, evChan chan MyBinEvent, binlog *string, statChan chan BinEventStats) (int, error) {
 	// process: 0, continue: 1, break: 2, EOF: 3
 	var err error
-	var n int64
 
 	var (
 		db        string = ""
@@ -106,66 +156,68 @@ func (this BinFileParser) MyParseReader(cfg ConfCmd, r io.Reader, evChan chan My
 		sqlType   string = ""
 		rowCnt    uint32 = 0
 		trxStatus int    = 0
-		sqlLower  string = ""
 		tbMapPos  uint32 = 0
+		trxGtid   string = ""
 	)
+	trxState := &TrxStateMachine{}
+	var payloadEvents []*replication.BinlogEvent // events of the last transaction payload event, not processed yet
+	// original sql of the current statement, from rows query event or annotate rows event
+	originalSql := ""
+	// relay log positions and binlog name of the master with --relay-log, *binlog is the binlog of the master then
+	fileName := *binlog
+	var relayLog *RelayLogTracker
+	if cfg.RelayLog {
+		relayLog = NewRelayLogTracker(fileName)
+	}
 
 	for {
-		headBuf := make([]byte, replication.EventHeaderSize)
-
-		if _, err = io.ReadFull(r, headBuf); err == io.EOF {
-			return RE_FILE_END, nil
-		} else if err != nil {
-			CheckErr(err, "fail to read binlog event header of "+*binlog, ERR_FILE_READ, false)
-			return RE_BREAK, errors.Trace(err)
+		select {
+		case <-this.abort:
+			return RE_BREAK, nil
+		default:
 		}
-
 		var h *replication.EventHeader
-		h, err = this.parser.ParseHeader(headBuf)
-		if err != nil {
-			CheckErr(err, "fail to parse binlog event header of "+*binlog, ERR_BINEVENT_HEADER, false)
-			return RE_BREAK, errors.Trace(err)
-		}
-		//fmt.Printf("parsing %s %d %s\n", *binlog, h.LogPos, GetDatetimeStr(int64(h.Timestamp), int64(0), DATETIME_FORMAT))
-
-		if h.EventSize <= uint32(replication.EventHeaderSize) {
-			err = errors.Errorf("invalid event header, event size is %d, too small", h.EventSize)
-			CheckErr(err, "", ERR_BINEVENT_HEADER, false)
-
-			return RE_BREAK, err
-
-		}
-
-		var buf bytes.Buffer
-		if n, err = io.CopyN(&buf, r, int64(h.EventSize)-int64(replication.EventHeaderSize)); err != nil {
-			err = errors.Errorf("get event body err %v, need %d - %d, but got %d", err, h.EventSize, replication.EventHeaderSize, n)
-			CheckErr(err, "", ERR_BINEVENT_BODY, false)
-			return RE_BREAK, err
-		}
-
-		data := buf.Bytes()
-		//rawData := data
-
-		eventLen := int(h.EventSize) - replication.EventHeaderSize
-
-		if len(data) != eventLen {
-			err = errors.Errorf("invalid data size %d in event %s, less event length %d", len(data), h.EventType, eventLen)
-			CheckErr(err, "", ERR_BINEVENT_BODY, false)
-			return RE_BREAK, err
-		}
-
 		var e replication.Event
-		e, err = this.parser.ParseEvent(h, data)
-		if err != nil {
-			CheckErr(err, "fail to parse binlog event body of "+*binlog, ERR_BINEVENT_BODY, false)
-			return RE_BREAK, errors.Trace(err)
+		if len(payloadEvents) > 0 {
+			h, e = payloadEvents[0].Header, payloadEvents[0].Event
+			payloadEvents = payloadEvents[1:]
+		} else {
+			var data []byte
+			var readRe int
+			h, data, readRe, err = this.ReadBinEvent(r, fileName)
+			if readRe != RE_PROCESS {
+				return readRe, err
+			}
+
+			e, err = this.parser.ParseEvent(h, data)
+			if err != nil {
+				CheckErr(err, "fail to parse binlog event body of "+fileName, ERR_BINEVENT_BODY, false)
+				return RE_BREAK, errors.Trace(err)
+			}
+			if relayLog != nil {
+				if relayLog.NextEvent(h, e) != RE_PROCESS {
+					continue
+				}
+				*binlog = relayLog.MasterLog()
+			}
+			if payloadEv, ok := e.(*TransactionPayloadEvent); ok {
+				// process the events in the payload one by one, as if they are not compressed
+				payloadEvents = payloadEv.Events
+				continue
+			}
 		}
 		if h.EventType == replication.TABLE_MAP_EVENT {
 			tbMapPos = h.LogPos - h.EventSize // avoid mysqlbing mask the row event as unknown table row event
 		}
+		UpdateTrxGtid(h, e, &trxGtid)
+		evOriginalSql := GetOriginalSqlOfEvent(cfg, e, &originalSql)
 
 		//can not advance this check, because we need to parse table map event or table may not found. Also we must seek ahead the read file position
-		chRe := CheckBinHeaderCondition(cfg, h, binlog)
+		filterPos := mysql.Position{Name: *binlog, Pos: h.LogPos}
+		if relayLog != nil && !cfg.IfRelayLogByMasterPos() {
+			filterPos = relayLog.RelayPos()
+		}
+		chRe := CheckBinHeaderCondition(cfg, h, e, filterPos, this.gtidFilter)
 		if chRe == RE_BREAK {
 			return RE_BREAK, nil
 		} else if chRe == RE_CONTINUE {
@@ -173,6 +225,7 @@ func (this BinFileParser) MyParseReader(cfg ConfCmd, r io.Reader, evChan chan My
 		} else if chRe == RE_FILE_END {
 			return RE_FILE_END, nil
 		}
+		trxStatus = trxState.NextEvent(h, e)
 
 		//binEvent := &replication.BinlogEvent{RawData: rawData, Header: h, Event: e}
 		binEvent := &replication.BinlogEvent{Header: h, Event: e} // we donnot need raw data
@@ -189,46 +242,54 @@ func (this BinFileParser) MyParseReader(cfg ConfCmd, r io.Reader, evChan chan My
 		} else if chRe == RE_PROCESS {
 			// output analysis result whatever the WorkType is
 			db, tb, sqlType, sql, rowCnt = GetDbTbAndQueryAndRowCntFromBinevent(binEvent)
-			if sqlType == "query" {
-				sqlLower = strings.ToLower(sql)
-
-				if sqlLower == "begin" {
-					trxStatus = TRX_STATUS_BEGIN
-					fileTrxIndex++
-				} else if sqlLower == "commit" {
-					trxStatus = TRX_STATUS_COMMIT
-				} else if sqlLower == "rollback" {
-					trxStatus = TRX_STATUS_ROLLBACK
-				}
-			} else {
-				trxStatus = TRX_STATUS_PROGRESS
-			}
 
 			if cfg.WorkType != "stats" && oneMyEvent.IfRowsEvent {
-
-				tbKey := GetAbsTableName(string(oneMyEvent.BinEvent.Table.Schema),
-					string(oneMyEvent.BinEvent.Table.Table))
-				if _, ok := G_TablesColumnsInfo.tableInfos[tbKey]; ok {
-					fileBinEventHandlingIndex++
-					oneMyEvent.EventIdx = fileBinEventHandlingIndex
+				oneMyEvent.TbMapMeta = this.parser.GetTableMapOptMeta(oneMyEvent.BinEvent.TableID)
+				if oneMyEvent.IfHasTableDef(cfg) {
+					// EventIdx is set when merging binlog files
 					oneMyEvent.SqlType = sqlType
 					oneMyEvent.Timestamp = h.Timestamp
-					oneMyEvent.TrxIndex = fileTrxIndex
+					oneMyEvent.TrxIndex = trxState.TrxIndex
 					oneMyEvent.TrxStatus = trxStatus
-					evChan <- *oneMyEvent
+					oneMyEvent.Gtid = trxGtid
+					oneMyEvent.Xid = trxState.Xid
+					oneMyEvent.OriginalSql = evOriginalSql
+					if relayLog != nil {
+						oneMyEvent.RelayPos = relayLog.RelayPos()
+					}
+					select {
+					case evChan <- *oneMyEvent:
+					case <-this.abort:
+						return RE_BREAK, nil
+					}
 				} /*else {
 					fmt.Printf("no table struct found for %s, it maybe dropped, skip it. RowsEvent position:%s", tbKey, oneMyEvent.MyPos.String())
 				}*/
 
+			} else if IfSendXaEndEvent(cfg, trxState, trxStatus) {
+				oneMyEvent.SetXaEnd(h.Timestamp, trxState, trxStatus, trxGtid)
+				select {
+				case evChan <- *oneMyEvent:
+				case <-this.abort:
+					return RE_BREAK, nil
+				}
 			}
 
 			if sqlType != "" {
+				var st BinEventStats
 				if sqlType == "query" {
-					statChan <- BinEventStats{Timestamp: h.Timestamp, Binlog: *binlog, StartPos: h.LogPos - h.EventSize, StopPos: h.LogPos - h.EventSize,
-						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType}
+					st = BinEventStats{Timestamp: h.Timestamp, Binlog: *binlog, StartPos: h.LogPos - h.EventSize, StopPos: h.LogPos - h.EventSize,
+						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType, Gtid: trxGtid,
+						TrxIndex: trxState.TrxIndex, TrxStatus: trxStatus, Xid: trxState.Xid}
 				} else {
-					statChan <- BinEventStats{Timestamp: h.Timestamp, Binlog: *binlog, StartPos: tbMapPos, StopPos: h.LogPos,
-						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType}
+					st = BinEventStats{Timestamp: h.Timestamp, Binlog: *binlog, StartPos: tbMapPos, StopPos: h.LogPos,
+						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType, Gtid: trxGtid,
+						TrxIndex: trxState.TrxIndex, TrxStatus: trxStatus, Xid: trxState.Xid, OriginalSql: evOriginalSql}
+				}
+				select {
+				case statChan <- st:
+				case <-this.abort:
+					return RE_BREAK, nil
 				}
 
 			}
@@ -239,3 +300,52 @@ func (this BinFileParser) MyParseReader(cfg ConfCmd, r io.Reader, evChan chan My
 
 	return RE_FILE_END, nil
 }
+
+func (this BinFileParser) ReadBinEvent(r io.Reader, binlog string) (*replication.EventHeader, []byte, int, error) {
+	// process: 0, break: 2, EOF: 3
+	var err error
+	var n int64
+	headBuf := make([]byte, replication.EventHeaderSize)
+
+	if _, err = io.ReadFull(r, headBuf); err == io.EOF {
+		return nil, nil, RE_FILE_END, nil
+	} else if err != nil {
+		CheckErr(err, "fail to read binlog event header of "+binlog, ERR_FILE_READ, false)
+		return nil, nil, RE_BREAK, errors.Trace(err)
+	}
+
+	var h *replication.EventHeader
+	h, err = this.parser.ParseHeader(headBuf)
+	if err != nil {
+		CheckErr(err, "fail to parse binlog event header of "+binlog, ERR_BINEVENT_HEADER, false)
+		return nil, nil, RE_BREAK, errors.Trace(err)
+	}
+	//fmt.Printf("parsing %s %d %s\n", binlog, h.LogPos, GetDatetimeStr(int64(h.Timestamp), int64(0), DATETIME_FORMAT))
+
+	if h.EventSize <= uint32(replication.EventHeaderSize) {
+		err = errors.Errorf("invalid event header, event size is %d, too small", h.EventSize)
+		CheckErr(err, "", ERR_BINEVENT_HEADER, false)
+
+		return nil, nil, RE_BREAK, err
+
+	}
+
+	var buf bytes.Buffer
+	if n, err = io.CopyN(&buf, r, int64(h.EventSize)-int64(replication.EventHeaderSize)); err != nil {
+		err = errors.Errorf("get event body err %v, need %d - %d, but got %d", err, h.EventSize, replication.EventHeaderSize, n)
+		CheckErr(err, "", ERR_BINEVENT_BODY, false)
+		return nil, nil, RE_BREAK, err
+	}
+
+	data := buf.Bytes()
+	//rawData := data
+
+	eventLen := int(h.EventSize) - replication.EventHeaderSize
+
+	if len(data) != eventLen {
+		err = errors.Errorf("invalid data size %d in event %s, less event length %d", len(data), h.EventType, eventLen)
+		CheckErr(err, "", ERR_BINEVENT_BODY, false)
+		return nil, nil, RE_BREAK, err
+	}
+	return h, data, RE_PROCESS, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/toolkits/file"
+)
+
+// binlog files in order of the binlog index file(mysql-bin.index), purged binlogs are not in it
+type BinlogIndex struct {
+	IndexFile string
+	dir       string   // dir of binlog files, where the given binlog file is
+	entries   []string // lines of the index file, ./mysql-bin.000123 or /data/log/mysql-bin.000123
+	binlogs   []string // binlog names of entries, mysql-bin.000123
+}
+
+func ReadBinlogIndex(indexFile string, dir string) (*BinlogIndex, error) {
+	content, err := file.ToString(indexFile)
+	if err != nil {
+		return nil, errors.Annotatef(err, "fail to read binlog index file %s", indexFile)
+	}
+	idx := &BinlogIndex{IndexFile: indexFile, dir: dir}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		idx.entries = append(idx.entries, line)
+		idx.binlogs = append(idx.binlogs, GetBinlogNameOfFile(line))
+	}
+	if len(idx.binlogs) == 0 {
+		return nil, errors.Errorf("no binlog in binlog index file %s", indexFile)
+	}
+	return idx, nil
+}
+
+// the position of the binlog in the index, -1 if not in it
+func (this *BinlogIndex) Position(binlog string) int {
+	binlog = GetBinlogNameOfFile(binlog)
+	for i, one := range this.binlogs {
+		if one == binlog {
+			return i
+		}
+	}
+	return -1
+}
+
+// the file of the i-th binlog, in the binlog dir or the dir of the index entry. empty if not found
+func (this *BinlogIndex) FindFile(i int) string {
+	if name := FindBinlogFile(this.dir, this.binlogs[i]); name != "" {
+		return name
+	}
+	if filepath.IsAbs(this.entries[i]) {
+		return FindBinlogFile(filepath.Dir(this.entries[i]), this.binlogs[i])
+	}
+	return ""
+}
+
+// the file of the binlog after binlog, empty if binlog is the last one
+func (this *BinlogIndex) NextBinlogFile(binlog string) (string, error) {
+	i := this.Position(binlog)
+	if i < 0 {
+		return "", errors.Errorf("%s is not in binlog index file %s", GetBinlogNameOfFile(binlog), this.IndexFile)
+	}
+	if i == len(this.binlogs)-1 {
+		return "", nil
+	}
+	if name := this.FindFile(i + 1); name != "" {
+		return name, nil
+	}
+	return "", errors.Errorf("%s in binlog index file %s is missing in %s", this.binlogs[i+1], this.IndexFile, this.dir)
+}
+
+// start and stop binlog must be in the index, and all binlogs between them must exist. stop is empty if not set
+func (this *BinlogIndex) CheckRange(start string, stop string) error {
+	startIdx := this.Position(start)
+	if startIdx < 0 {
+		return errors.Errorf("start binlog %s is not in binlog index file %s", start, this.IndexFile)
+	}
+	stopIdx := startIdx
+	if stop != "" {
+		if stopIdx = this.Position(stop); stopIdx < 0 {
+			return errors.Errorf("stop binlog %s is not in binlog index file %s", stop, this.IndexFile)
+		}
+		if stopIdx < startIdx {
+			return errors.Errorf("stop binlog %s is before start binlog %s in binlog index file %s", stop, start, this.IndexFile)
+		}
+	}
+	var missing []string
+	for i := startIdx; i <= stopIdx; i++ {
+		if this.FindFile(i) == "" {
+			missing = append(missing, this.binlogs[i])
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("binlogs %s in binlog index file %s are missing in %s", strings.Join(missing, ","), this.IndexFile, this.dir)
+	}
+	return nil
+}
+
+// the file of the binlog after binlog, in order of the binlog index file if any, otherwise by the next number.
+// empty if binlog is the last one in the binlog index file
+func GetNextBinlogFile(cfg ConfCmd, binlog string) (string, error) {
+	if cfg.BinlogIndexFiles != nil {
+		return cfg.BinlogIndexFiles.NextBinlogFile(binlog)
+	}
+	binBaseName, binBaseIndx := GetBinlogBasenameAndIndex(binlog)
+	nextBinlog := GetNextBinlog(binBaseName, binBaseIndx)
+	if name := FindBinlogFile(cfg.BinlogDir, nextBinlog); name != "" {
+		return name, nil
+	}
+	return "", errors.Errorf("%s not exists nor a file", filepath.Join(cfg.BinlogDir, nextBinlog))
+}
+
+// --binlog-index, or mysql-bin.index next to the given binlog file
+func (this *ConfCmd) CheckBinlogIndex() {
+	if this.BinlogIndex == "" {
+		binBaseName, _ := GetBinlogBasenameAndIndex(this.GivenBinlogFile)
+		if indexFile := filepath.Join(this.BinlogDir, binBaseName+".index"); file.IsFile(indexFile) {
+			this.BinlogIndex = indexFile
+		} else {
+			return
+		}
+	} else if !file.IsFile(this.BinlogIndex) {
+		fmt.Printf("binlog index file %s doesnot exists nor a file\n", this.BinlogIndex)
+		os.Exit(ERR_FILE_NOT_EXISTS)
+	}
+	var err error
+	this.BinlogIndexFiles, err = ReadBinlogIndex(this.BinlogIndex, this.BinlogDir)
+	CheckErr(err, "invalid --binlog-index", ERR_FILE_READ, true)
+
+	// --start-binlog --stop-binlog are binlogs of the master with --relay-log --relay-coordinate=master
+	start := this.StartFile
+	if start == "" || this.IfRelayLogByMasterPos() {
+		start = GetBinlogNameOfFile(this.GivenBinlogFile)
+	}
+	stop := ""
+	if this.IfSetStopFilePos && !this.IfRelayLogByMasterPos() {
+		stop = this.StopFile
+	}
+	err = this.BinlogIndexFiles.CheckRange(start, stop)
+	CheckErr(err, "invalid --start-binlog or --stop-binlog", ERR_OPTION_MISMATCH, true)
+}
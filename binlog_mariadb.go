@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// compressed events of mariadb 10.2+(log_bin_compress=ON), not parsed by go-mysql
+const (
+	MARIADB_QUERY_COMPRESSED_EVENT          replication.EventType = 165
+	MARIADB_WRITE_ROWS_COMPRESSED_EVENT_V1  replication.EventType = 166
+	MARIADB_UPDATE_ROWS_COMPRESSED_EVENT_V1 replication.EventType = 167
+	MARIADB_DELETE_ROWS_COMPRESSED_EVENT_V1 replication.EventType = 168
+	MARIADB_WRITE_ROWS_COMPRESSED_EVENT     replication.EventType = 169
+	MARIADB_UPDATE_ROWS_COMPRESSED_EVENT    replication.EventType = 170
+	MARIADB_DELETE_ROWS_COMPRESSED_EVENT    replication.EventType = 171
+
+	MARIADB_COMPRESS_ALG_ZLIB = 0
+)
+
+// compressed event type: the uncompressed one
+var G_Mariadb_Compressed_Event_Types map[replication.EventType]replication.EventType = map[replication.EventType]replication.EventType{
+	MARIADB_QUERY_COMPRESSED_EVENT:          replication.QUERY_EVENT,
+	MARIADB_WRITE_ROWS_COMPRESSED_EVENT_V1:  replication.WRITE_ROWS_EVENTv1,
+	MARIADB_UPDATE_ROWS_COMPRESSED_EVENT_V1: replication.UPDATE_ROWS_EVENTv1,
+	MARIADB_DELETE_ROWS_COMPRESSED_EVENT_V1: replication.DELETE_ROWS_EVENTv1,
+	MARIADB_WRITE_ROWS_COMPRESSED_EVENT:     replication.WRITE_ROWS_EVENTv2,
+	MARIADB_UPDATE_ROWS_COMPRESSED_EVENT:    replication.UPDATE_ROWS_EVENTv2,
+	MARIADB_DELETE_ROWS_COMPRESSED_EVENT:    replication.DELETE_ROWS_EVENTv2,
+}
+
+// refer binlog_buf_uncompress() of mariadb sql/log_event.cc.
+// the first byte: 0x80 | algorithm << 4 | bytes of the uncompressed length, then the uncompressed length in big endian
+func MariadbUncompress(data []byte) ([]byte, error) {
+	if len(data) < 1 || data[0]&0x80 == 0 {
+		return nil, errors.Errorf("invalid mariadb compressed data")
+	}
+	alg := (data[0] & 0x70) >> 4
+	lenBytes := int(data[0] & 0x07)
+	if alg != MARIADB_COMPRESS_ALG_ZLIB {
+		return nil, errors.Errorf("unsupported mariadb compression algorithm %d", alg)
+	}
+	if lenBytes < 1 || lenBytes > 4 || len(data) < 1+lenBytes {
+		return nil, errors.Errorf("invalid mariadb compressed data, %d bytes of length", lenBytes)
+	}
+	var unLen uint32 = 0
+	for i := 1; i <= lenBytes; i++ {
+		unLen = unLen<<8 | uint32(data[i])
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data[1+lenBytes:]))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.Close()
+	buf := make([]byte, unLen)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, errors.Annotatef(err, "fail to uncompress mariadb compressed data of length %d", unLen)
+	}
+	return buf, nil
+}
+
+// the event is parsed as the uncompressed one, with the header event type changed to the uncompressed one too.
+// only the query of query event, and the rows of rows event are compressed
+func (this *BinEventDecoder) parseMariadbCompressedEvent(h *replication.EventHeader, data []byte, eventType replication.EventType) (replication.Event, error) {
+	if eventType == replication.QUERY_EVENT {
+		h.EventType = eventType
+		e, err := this.ParseEvent(h, data)
+		if err != nil {
+			return nil, err
+		}
+		queryEv := e.(*replication.QueryEvent)
+		if queryEv.Query, err = MariadbUncompress(queryEv.Query); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+
+	body := data
+	var checksum []byte
+	if this.format.ChecksumAlgorithm == replication.BINLOG_CHECKSUM_ALG_CRC32 && len(data) >= 4 {
+		body = data[0 : len(data)-4]
+		checksum = data[len(data)-4:]
+	}
+	headLen := 8
+	if eventType == replication.WRITE_ROWS_EVENTv2 || eventType == replication.UPDATE_ROWS_EVENTv2 || eventType == replication.DELETE_ROWS_EVENTv2 {
+		headLen = 10
+	}
+	if len(this.format.EventTypeHeaderLengths) >= int(h.EventType) && this.format.EventTypeHeaderLengths[h.EventType-1] > 0 {
+		headLen = int(this.format.EventTypeHeaderLengths[h.EventType-1])
+	}
+	if headLen == 10 && len(body) >= headLen {
+		// length of extra data, including the 2 bytes of itself
+		headLen += int(binary.LittleEndian.Uint16(body[8:])) - 2
+	}
+	if headLen >= len(body) || (body[headLen] >= 0xfc && headLen+9 > len(body)) {
+		// at least 9 bytes for the packed integer of more than 250 columns
+		return nil, errors.Errorf("invalid %s, post header length %d, but body length %d", h.EventType, headLen, len(body))
+	}
+	// column count and column bitmaps(two for update) are not compressed, refer Rows_log_event::write_data_body()
+	colCnt, _, n := mysql.LengthEncodedInt(body[headLen:])
+	headLen += n
+	bitmaps := 1
+	if eventType == replication.UPDATE_ROWS_EVENTv1 || eventType == replication.UPDATE_ROWS_EVENTv2 {
+		bitmaps = 2
+	}
+	headLen += bitmaps * int((colCnt+7)/8)
+	if headLen > len(body) {
+		return nil, errors.Errorf("invalid %s, %d columns, but body length %d", h.EventType, colCnt, len(body))
+	}
+	rows, err := MariadbUncompress(body[headLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.EventType = eventType
+	return this.ParseEvent(h, append(append(append([]byte{}, body[0:headLen]...), rows...), checksum...))
+}
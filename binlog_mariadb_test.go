@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// events of a mariadb 10.3 binlog with log_bin_compress=ON and binlog_checksum=CRC32, laid out as
+// Rows_log_event::write_data_body() and binlog_buf_compress() of mariadb write them.
+// table t1(id int, name varchar(64)), table id 70
+type mariadbBinlogBuilder struct {
+	buf bytes.Buffer
+}
+
+func (this *mariadbBinlogBuilder) addEvent(t *testing.T, eventType replication.EventType, body []byte) {
+	size := replication.EventHeaderSize + len(body) + 4
+	head := make([]byte, replication.EventHeaderSize)
+	binary.LittleEndian.PutUint32(head[0:], 1700000000)
+	head[4] = byte(eventType)
+	binary.LittleEndian.PutUint32(head[5:], 1)
+	binary.LittleEndian.PutUint32(head[9:], uint32(size))
+	binary.LittleEndian.PutUint32(head[13:], uint32(4+this.buf.Len()+size))
+	event := append(head, body...)
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, crc32.ChecksumIEEE(event))
+	this.buf.Write(event)
+	this.buf.Write(checksum)
+}
+
+func mariadbCompress(t *testing.T, data []byte) []byte {
+	var zbuf bytes.Buffer
+	w := zlib.NewWriter(&zbuf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if len(data) > 0xff {
+		t.Fatalf("only 1 byte of uncompressed length in the test, but %d", len(data))
+	}
+	return append([]byte{0x80 | 1, byte(len(data))}, zbuf.Bytes()...)
+}
+
+func mariadbFormatDescBody() []byte {
+	body := make([]byte, 2+50+4+1)
+	binary.LittleEndian.PutUint16(body, 4)
+	copy(body[2:], "10.3.39-MariaDB-log")
+	body[56] = byte(replication.EventHeaderSize)
+	headerLens := make([]byte, int(MARIADB_DELETE_ROWS_COMPRESSED_EVENT))
+	headerLens[replication.QUERY_EVENT-1] = 13
+	headerLens[replication.TABLE_MAP_EVENT-1] = 8
+	for _, tp := range []replication.EventType{replication.WRITE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv1,
+		MARIADB_WRITE_ROWS_COMPRESSED_EVENT_V1, MARIADB_UPDATE_ROWS_COMPRESSED_EVENT_V1, MARIADB_DELETE_ROWS_COMPRESSED_EVENT_V1} {
+		headerLens[tp-1] = 8
+	}
+	for _, tp := range []replication.EventType{replication.WRITE_ROWS_EVENTv2, replication.UPDATE_ROWS_EVENTv2, replication.DELETE_ROWS_EVENTv2,
+		MARIADB_WRITE_ROWS_COMPRESSED_EVENT, MARIADB_UPDATE_ROWS_COMPRESSED_EVENT, MARIADB_DELETE_ROWS_COMPRESSED_EVENT} {
+		headerLens[tp-1] = 10
+	}
+	headerLens[MARIADB_QUERY_COMPRESSED_EVENT-1] = 13
+	body = append(body, headerLens...)
+	return append(body, replication.BINLOG_CHECKSUM_ALG_CRC32)
+}
+
+func mariadbQueryBody(db string, query []byte) []byte {
+	body := make([]byte, 13)
+	body[8] = byte(len(db))
+	body = append(append(body, db...), 0)
+	return append(body, query...)
+}
+
+func mariadbTableMapBody() []byte {
+	body := []byte{70, 0, 0, 0, 0, 0, 1, 0}
+	body = append(append(append(body, 4), "test"...), 0)
+	body = append(append(append(body, 2), "t1"...), 0)
+	body = append(body, 2, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR)
+	body = append(body, 2, 64, 0) // metadata: max length of varchar
+	return append(body, 0x02)     // null bitmap: name is nullable
+}
+
+func mariadbRow(id uint32, name string) []byte {
+	row := []byte{0x00}
+	row = append(row, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(row[1:], id)
+	return append(append(row, byte(len(name))), name...)
+}
+
+// table id, flags, extra data of v2, then column count and bitmaps uncompressed, and the compressed rows.
+// all in one statement, table map is kept till the last one
+func mariadbRowsBody(t *testing.T, v2 bool, update bool, rows []byte) []byte {
+	body := []byte{70, 0, 0, 0, 0, 0, 0, 0}
+	if v2 {
+		body = append(body, 2, 0)
+	}
+	body = append(body, 2, 0x03)
+	if update {
+		body = append(body, 0x03)
+	}
+	return append(body, mariadbCompress(t, rows)...)
+}
+
+func TestParseMariadbCompressedEvents(t *testing.T) {
+	b := &mariadbBinlogBuilder{}
+	b.addEvent(t, replication.FORMAT_DESCRIPTION_EVENT, mariadbFormatDescBody())
+	b.addEvent(t, MARIADB_QUERY_COMPRESSED_EVENT, mariadbQueryBody("test", mariadbCompress(t, []byte("create table t1(id int, name varchar(64))"))))
+	b.addEvent(t, replication.TABLE_MAP_EVENT, mariadbTableMapBody())
+	b.addEvent(t, MARIADB_WRITE_ROWS_COMPRESSED_EVENT_V1, mariadbRowsBody(t, false, false, append(mariadbRow(1, "a"), mariadbRow(2, "bb")...)))
+	b.addEvent(t, MARIADB_UPDATE_ROWS_COMPRESSED_EVENT_V1, mariadbRowsBody(t, false, true, append(mariadbRow(1, "a"), mariadbRow(1, "c")...)))
+	b.addEvent(t, MARIADB_DELETE_ROWS_COMPRESSED_EVENT_V1, mariadbRowsBody(t, false, false, mariadbRow(2, "bb")))
+	b.addEvent(t, MARIADB_UPDATE_ROWS_COMPRESSED_EVENT, mariadbRowsBody(t, true, true, append(mariadbRow(1, "c"), mariadbRow(3, "c")...)))
+
+	expected := []struct {
+		eventType replication.EventType
+		rows      [][]interface{}
+	}{
+		{replication.FORMAT_DESCRIPTION_EVENT, nil},
+		{replication.QUERY_EVENT, nil},
+		{replication.TABLE_MAP_EVENT, nil},
+		{replication.WRITE_ROWS_EVENTv1, [][]interface{}{{int32(1), "a"}, {int32(2), "bb"}}},
+		{replication.UPDATE_ROWS_EVENTv1, [][]interface{}{{int32(1), "a"}, {int32(1), "c"}}},
+		{replication.DELETE_ROWS_EVENTv1, [][]interface{}{{int32(2), "bb"}}},
+		{replication.UPDATE_ROWS_EVENTv2, [][]interface{}{{int32(1), "c"}, {int32(3), "c"}}},
+	}
+
+	decoder := NewBinEventDecoder()
+	data := b.buf.Bytes()
+	for i, exp := range expected {
+		h, err := decoder.ParseHeader(data)
+		if err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		e, err := decoder.ParseEvent(h, data[replication.EventHeaderSize:h.EventSize])
+		if err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		data = data[h.EventSize:]
+		if h.EventType != exp.eventType {
+			t.Fatalf("event %d: expect %s, got %s", i, exp.eventType, h.EventType)
+		}
+		if qe, ok := e.(*replication.QueryEvent); ok && string(qe.Query) != "create table t1(id int, name varchar(64))" {
+			t.Errorf("event %d: wrong query %q", i, qe.Query)
+		}
+		re, ok := e.(*replication.RowsEvent)
+		if exp.rows == nil {
+			continue
+		}
+		if !ok {
+			t.Fatalf("event %d: expect rows event, got %T", i, e)
+		}
+		if len(re.Rows) != len(exp.rows) {
+			t.Fatalf("event %d: expect %d rows, got %d", i, len(exp.rows), len(re.Rows))
+		}
+		for j, row := range exp.rows {
+			for k, v := range row {
+				if re.Rows[j][k] != v {
+					t.Errorf("event %d row %d column %d: expect %v, got %v", i, j, k, v, re.Rows[j][k])
+				}
+			}
+		}
+	}
+	if len(data) != 0 {
+		t.Errorf("%d bytes left", len(data))
+	}
+}
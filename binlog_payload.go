@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// fields of TRANSACTION_PAYLOAD_EVENT, refer mysql-server/libbinlogevents/include/compression/base.h
+const (
+	TRX_PAYLOAD_HEADER_END_MARK         = 0
+	TRX_PAYLOAD_SIZE_FIELD              = 1
+	TRX_PAYLOAD_COMPRESSION_TYPE_FIELD  = 2
+	TRX_PAYLOAD_UNCOMPRESSED_SIZE_FIELD = 3
+
+	TRX_PAYLOAD_COMPRESSION_ZSTD = 0
+	TRX_PAYLOAD_COMPRESSION_NONE = 255
+)
+
+// TRANSACTION_PAYLOAD_EVENT of mysql 8.0.20+(binlog_transaction_compression=ON), not parsed by go-mysql.
+// the payload is all events of the transaction except the gtid event, compressed.
+type TransactionPayloadEvent struct {
+	CompressionType  uint64
+	PayloadSize      uint64
+	UncompressedSize uint64
+	Payload          []byte
+	Events           []*replication.BinlogEvent // events in the payload
+}
+
+func (this *TransactionPayloadEvent) Decode(data []byte) error {
+	pos := 0
+	for {
+		if pos >= len(data) {
+			return errors.Errorf("invalid transaction payload event, no end mark of header")
+		}
+		fieldType, _, n := mysql.LengthEncodedInt(data[pos:])
+		pos += n
+		if fieldType == TRX_PAYLOAD_HEADER_END_MARK {
+			break
+		}
+		if pos >= len(data) {
+			return errors.Errorf("invalid transaction payload event, no length of field %d", fieldType)
+		}
+		fieldLen, _, n := mysql.LengthEncodedInt(data[pos:])
+		pos += n
+		if pos+int(fieldLen) > len(data) {
+			return errors.Errorf("invalid transaction payload event, field %d length %d exceeds event", fieldType, fieldLen)
+		}
+		value, _, _ := mysql.LengthEncodedInt(data[pos : pos+int(fieldLen)])
+		switch fieldType {
+		case TRX_PAYLOAD_SIZE_FIELD:
+			this.PayloadSize = value
+		case TRX_PAYLOAD_COMPRESSION_TYPE_FIELD:
+			this.CompressionType = value
+		case TRX_PAYLOAD_UNCOMPRESSED_SIZE_FIELD:
+			this.UncompressedSize = value
+		}
+		pos += int(fieldLen)
+	}
+	this.Payload = data[pos:]
+	if this.PayloadSize > 0 && uint64(len(this.Payload)) != this.PayloadSize {
+		return errors.Errorf("invalid transaction payload event, payload size is %d, but got %d", this.PayloadSize, len(this.Payload))
+	}
+	return nil
+}
+
+func (this *TransactionPayloadEvent) Dump(w io.Writer) {
+	fmt.Fprintf(w, "Compression type: %d\n", this.CompressionType)
+	fmt.Fprintf(w, "Payload size: %d\n", this.PayloadSize)
+	fmt.Fprintf(w, "Uncompressed size: %d\n", this.UncompressedSize)
+	fmt.Fprintf(w, "Events: %d\n", len(this.Events))
+	fmt.Fprintln(w)
+}
+
+func (this *TransactionPayloadEvent) Uncompress(zstdDecoder *zstd.Decoder) ([]byte, error) {
+	switch this.CompressionType {
+	case TRX_PAYLOAD_COMPRESSION_NONE:
+		return this.Payload, nil
+	case TRX_PAYLOAD_COMPRESSION_ZSTD:
+		return zstdDecoder.DecodeAll(this.Payload, make([]byte, 0, this.UncompressedSize))
+	}
+	return nil, errors.Errorf("unsupported compression type %d of transaction payload event", this.CompressionType)
+}
+
+// data is the event body without checksum. events in the payload are parsed with the positions of the payload event,
+// because they have no positions of their own
+func (this *BinEventDecoder) parsePayloadEvent(h *replication.EventHeader, data []byte) (*TransactionPayloadEvent, error) {
+	e := &TransactionPayloadEvent{}
+	if err := e.Decode(data); err != nil {
+		return nil, err
+	}
+	if this.zstdDecoder == nil {
+		var err error
+		if this.zstdDecoder, err = zstd.NewReader(nil); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	raw, err := e.Uncompress(this.zstdDecoder)
+	if err != nil {
+		return nil, errors.Annotatef(err, "fail to uncompress transaction payload event")
+	}
+
+	// events in the payload have no checksum
+	checksumAlg := this.format.ChecksumAlgorithm
+	this.format.ChecksumAlgorithm = replication.BINLOG_CHECKSUM_ALG_OFF
+	defer func() { this.format.ChecksumAlgorithm = checksumAlg }()
+
+	for pos := 0; pos < len(raw); {
+		if pos+replication.EventHeaderSize > len(raw) {
+			return nil, errors.Errorf("invalid event header in transaction payload event, only %d bytes left", len(raw)-pos)
+		}
+		ih, err := this.ParseHeader(raw[pos:])
+		if err != nil {
+			return nil, err
+		}
+		end := pos + int(ih.EventSize)
+		if ih.EventSize < uint32(replication.EventHeaderSize) || end > len(raw) {
+			return nil, errors.Errorf("invalid event size %d in transaction payload event, only %d bytes left", ih.EventSize, len(raw)-pos)
+		}
+		ie, err := this.ParseEvent(ih, raw[pos+replication.EventHeaderSize:end])
+		if err != nil {
+			return nil, err
+		}
+		ih.LogPos = h.LogPos
+		ih.EventSize = h.EventSize
+		e.Events = append(e.Events, &replication.BinlogEvent{Header: ih, Event: ie})
+		pos = end
+	}
+	return e, nil
+}
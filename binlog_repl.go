@@ -3,47 +3,39 @@ package main
 import (
 	"context"
 	"fmt"
-	"strings"
+	"time"
 
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/client"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
 )
 
-/*
+// replicate from master as a slave, reconnect from the checkpoint when replication breaks
 type ReplBinlogStreamer struct {
-	cfg ConfCmd
-	binSyncCfg replication.BinlogSyncerConfig
-	replBinSyncer *replication.BinlogSyncer
+	cfg             ConfCmd
+	replBinSyncer   *replication.BinlogSyncer
 	replBinStreamer *replication.BinlogStreamer
+	checkpoint      *ReplCheckpoint
+	backup          *BinlogBackupWriter // nil if not --wtype=backup
 }
-*/
 
 func ParserAllBinEventsFromRepl(cfg ConfCmd, eventChan chan MyBinEvent, statChan chan BinEventStats) {
 
 	defer close(eventChan)
 	defer close(statChan)
 	replStreamer := NewReplBinlogStreamer(cfg)
+	defer replStreamer.Close()
 	SendBinlogEventRepl(cfg, replStreamer, eventChan, statChan)
 
 }
 
-func NewReplBinlogStreamer(cfg ConfCmd) *replication.BinlogStreamer {
-	replCfg := replication.BinlogSyncerConfig{
-		ServerID:        uint32(cfg.ServerId),
-		Flavor:          cfg.MysqlType,
-		Host:            cfg.Host,
-		Port:            uint16(cfg.Port),
-		User:            cfg.User,
-		Password:        cfg.Passwd,
-		Charset:         "utf8",
-		SemiSyncEnabled: false,
-		ParseTime:       true,
+func NewReplBinlogStreamer(cfg ConfCmd) *ReplBinlogStreamer {
+	replStreamer := &ReplBinlogStreamer{cfg: cfg, checkpoint: NewReplCheckpoint(cfg)}
+	if cfg.Backup {
+		replStreamer.backup = NewBinlogBackupWriter(cfg.OutputDir)
 	}
-
-	replSyncer := replication.NewBinlogSyncer(replCfg)
-
-	syncPosition := mysql.Position{Name: cfg.StartFile, Pos: uint32(cfg.StartPos)}
-	replStreamer, err := replSyncer.StartSync(syncPosition)
+	err := replStreamer.Connect()
 	if err != nil {
 		errMsg := fmt.Sprintf("error replication from master %s:%d ", cfg.Host, cfg.Port)
 		CheckErr(err, errMsg, ERR_MYSQL_REPL, true)
@@ -51,7 +43,83 @@ func NewReplBinlogStreamer(cfg ConfCmd) *replication.BinlogStreamer {
 	return replStreamer
 }
 
-func SendBinlogEventRepl(cfg ConfCmd, streamer *replication.BinlogStreamer, eventChan chan MyBinEvent, statChan chan BinEventStats) {
+// start replication from the checkpoint
+func (this *ReplBinlogStreamer) Connect() error {
+	replCfg := replication.BinlogSyncerConfig{
+		ServerID:         uint32(this.cfg.ServerId),
+		Flavor:           this.cfg.MysqlType,
+		Host:             this.cfg.Host,
+		Port:             uint16(this.cfg.Port),
+		User:             this.cfg.User,
+		Password:         this.cfg.Passwd,
+		Charset:          "utf8",
+		SemiSyncEnabled:  false,
+		ParseTime:        true,
+		RawModeEnabled:   true, // parse events by ourselves, the same as mode file
+		HeartbeatPeriod:  REPL_HEARTBEAT_PERIOD * time.Second,
+		ReadTimeout:      REPL_READ_TIMEOUT * time.Second,
+		DisableRetrySync: true, // reconnect by ourselves from the end of the last transaction
+		TLSConfig:        this.cfg.TlsConfig,
+	}
+
+	err := this.StartSync(replCfg)
+	if err != nil && this.cfg.SslMode == SSL_MODE_PREFERRED && errors.Cause(err) == client.ErrServerNoTLS {
+		// plain connection if the server does not support TLS
+		replCfg.TLSConfig = nil
+		err = this.StartSync(replCfg)
+	}
+	return err
+}
+
+func (this *ReplBinlogStreamer) StartSync(replCfg replication.BinlogSyncerConfig) error {
+	this.replBinSyncer = replication.NewBinlogSyncer(replCfg)
+
+	var err error
+	if gtidSet := this.checkpoint.GtidSet(); gtidSet != nil {
+		this.replBinStreamer, err = this.replBinSyncer.StartSyncGTID(gtidSet)
+	} else {
+		this.replBinStreamer, err = this.replBinSyncer.StartSync(this.checkpoint.Position())
+	}
+	if err != nil {
+		this.replBinSyncer.Close()
+	}
+	return err
+}
+
+// reconnect from the checkpoint with backoff, false if it still fails after --max-reconnect times
+func (this *ReplBinlogStreamer) Reconnect() bool {
+	this.replBinSyncer.Close()
+	this.checkpoint.Save()
+	wait := REPL_RECONNECT_MIN_WAIT
+	for i := 1; this.cfg.MaxReconnect == 0 || i <= this.cfg.MaxReconnect; i++ {
+		fmt.Printf("reconnect to master %s:%d from %s in %d seconds, retry %d\n", this.cfg.Host, this.cfg.Port, this.checkpoint.String(), wait, i)
+		time.Sleep(time.Duration(wait) * time.Second)
+		err := this.Connect()
+		if err == nil {
+			return true
+		}
+		CheckErr(err, "fail to reconnect to master", ERR_MYSQL_REPL, false)
+		if wait *= 2; wait > REPL_RECONNECT_MAX_WAIT {
+			wait = REPL_RECONNECT_MAX_WAIT
+		}
+	}
+	fmt.Printf("fail to reconnect to master %s:%d after %d retries, stop replication\n", this.cfg.Host, this.cfg.Port, this.cfg.MaxReconnect)
+	return false
+}
+
+func (this *ReplBinlogStreamer) GetEvent() (*replication.BinlogEvent, error) {
+	return this.replBinStreamer.GetEvent(context.Background())
+}
+
+func (this *ReplBinlogStreamer) Close() {
+	this.replBinSyncer.Close()
+	if this.backup != nil {
+		CheckErr(this.backup.Close(), "fail to close backup binlog", ERR_FILE_WRITE, false)
+	}
+	this.checkpoint.Save()
+}
+
+func SendBinlogEventRepl(cfg ConfCmd, streamer *ReplBinlogStreamer, eventChan chan MyBinEvent, statChan chan BinEventStats) {
 	//defer close(statChan)
 	//defer close(eventChan)
 
@@ -59,9 +127,8 @@ func SendBinlogEventRepl(cfg ConfCmd, streamer *replication.BinlogStreamer, even
 		chkRe         int
 		currentBinlog *string = &cfg.StartFile
 		binEventIdx   uint64  = 0
-		trxIndex      uint64  = 0
 		trxStatus     int     = 0
-		sqlLower      string  = ""
+		trxGtid       string  = ""
 
 		db      string = ""
 		tb      string = ""
@@ -71,14 +138,66 @@ func SendBinlogEventRepl(cfg ConfCmd, streamer *replication.BinlogStreamer, even
 
 		tbMapPos uint32 = 0
 
-		justStart bool = true
+		justStart  bool = true
+		decoder         = NewBinEventDecoder()
+		gtidFilter      = NewGtidFilter(cfg)
+		trxState        = &TrxStateMachine{}
+
+		payloadEvents []*replication.BinlogEvent // events of the last transaction payload event, not processed yet
+		originalSql   string                     // original sql of the current statement, from rows query event or annotate rows event
+
+		lastPos   mysql.Position  // position of the last event read from master
+		skipToPos *mysql.Position // after reconnecting, events till the last one read before are processed already
 	)
 	//defer g_MaxBin_Event_Idx.SetMaxBinEventIdx()
 	for {
-		ev, err := streamer.GetEvent(context.Background())
-		if err != nil {
-			fmt.Println("error to get binlog event: %s\n", err)
-			break
+		var ev *replication.BinlogEvent
+		if len(payloadEvents) > 0 {
+			ev = payloadEvents[0]
+			payloadEvents = payloadEvents[1:]
+		} else {
+			var err error
+			ev, err = streamer.GetEvent()
+			if err != nil {
+				fmt.Printf("error to get binlog event: %s\n", err)
+				if !streamer.Reconnect() {
+					break
+				}
+				// resume from the end of the last transaction, the first event is the fake rotate event
+				skipToPos = &mysql.Position{Name: lastPos.Name, Pos: lastPos.Pos}
+				justStart = true
+				continue
+			}
+			if ev.Header.EventType == replication.HEARTBEAT_EVENT {
+				continue
+			}
+			ev.Event, err = decoder.ParseEvent(ev.Header, ev.RawData[replication.EventHeaderSize:])
+			if err != nil {
+				CheckErr(err, "fail to parse binlog event body of "+*currentBinlog, ERR_BINEVENT_BODY, false)
+				break
+			}
+			if skipToPos != nil {
+				if rotateEv, ok := ev.Event.(*replication.RotateEvent); ok {
+					*currentBinlog = string(rotateEv.NextLogName)
+				} else if ev.Header.LogPos > 0 && ev.Header.EventType != replication.FORMAT_DESCRIPTION_EVENT {
+					if (mysql.Position{Name: *currentBinlog, Pos: ev.Header.LogPos}).Compare(*skipToPos) <= 0 {
+						continue
+					}
+					skipToPos = nil
+				}
+			}
+			if ev.Header.LogPos > 0 {
+				lastPos = mysql.Position{Name: *currentBinlog, Pos: ev.Header.LogPos}
+			}
+			if streamer.backup != nil {
+				err = streamer.backup.WriteEvent(ev)
+				CheckErr(err, "fail to backup binlog event", ERR_FILE_WRITE, true)
+			}
+			if payloadEv, ok := ev.Event.(*TransactionPayloadEvent); ok {
+				// process the events in the payload one by one, as if they are not compressed
+				payloadEvents = payloadEv.Events
+				continue
+			}
 		}
 
 		if !cfg.IfSetStopParsPoint && !justStart {
@@ -93,9 +212,11 @@ func SendBinlogEventRepl(cfg ConfCmd, streamer *replication.BinlogStreamer, even
 		if ev.Header.EventType == replication.TABLE_MAP_EVENT {
 			tbMapPos = ev.Header.LogPos - ev.Header.EventSize // avoid mysqlbing mask the row event as unknown table row event
 		}
+		UpdateTrxGtid(ev.Header, ev.Event, &trxGtid)
+		evOriginalSql := GetOriginalSqlOfEvent(cfg, ev.Event, &originalSql)
 		ev.RawData = []byte{} // we donnot need raw data
 
-		chkRe = CheckBinHeaderCondition(cfg, ev.Header, currentBinlog)
+		chkRe = CheckBinHeaderCondition(cfg, ev.Header, ev.Event, mysql.Position{Name: *currentBinlog, Pos: ev.Header.LogPos}, gtidFilter)
 		if chkRe == RE_BREAK {
 			break
 		} else if chkRe == RE_CONTINUE {
@@ -103,6 +224,7 @@ func SendBinlogEventRepl(cfg ConfCmd, streamer *replication.BinlogStreamer, even
 		} else if chkRe == RE_FILE_END {
 			continue
 		}
+		trxStatus = trxState.NextEvent(ev.Header, ev.Event)
 
 		oneMyEvent := &MyBinEvent{MyPos: mysql.Position{Name: *currentBinlog, Pos: ev.Header.LogPos},
 			StartPos: tbMapPos}
@@ -116,51 +238,48 @@ func SendBinlogEventRepl(cfg ConfCmd, streamer *replication.BinlogStreamer, even
 		} else if chkRe == RE_PROCESS {
 			db, tb, sqlType, sql, rowCnt = GetDbTbAndQueryAndRowCntFromBinevent(ev)
 
-			if sqlType == "query" {
-				sqlLower = strings.ToLower(sql)
-
-				if sqlLower == "begin" {
-					trxStatus = TRX_STATUS_BEGIN
-					trxIndex++
-				} else if sqlLower == "commit" {
-					trxStatus = TRX_STATUS_COMMIT
-				} else if sqlLower == "rollback" {
-					trxStatus = TRX_STATUS_ROLLBACK
-				}
-
-			} else {
-				trxStatus = TRX_STATUS_PROGRESS
-			}
-
 			if cfg.WorkType != "stats" && oneMyEvent.IfRowsEvent {
-				tbKey := GetAbsTableName(string(oneMyEvent.BinEvent.Table.Schema),
-					string(oneMyEvent.BinEvent.Table.Table))
-				if _, ok := G_TablesColumnsInfo.tableInfos[tbKey]; ok {
+				oneMyEvent.TbMapMeta = decoder.GetTableMapOptMeta(oneMyEvent.BinEvent.TableID)
+				if oneMyEvent.IfHasTableDef(cfg) {
 					binEventIdx++
 					oneMyEvent.EventIdx = binEventIdx
 					oneMyEvent.SqlType = sqlType
 					oneMyEvent.Timestamp = ev.Header.Timestamp
-					oneMyEvent.TrxIndex = trxIndex
+					oneMyEvent.TrxIndex = trxState.TrxIndex
 					oneMyEvent.TrxStatus = trxStatus
+					oneMyEvent.Gtid = trxGtid
+					oneMyEvent.Xid = trxState.Xid
+					oneMyEvent.OriginalSql = evOriginalSql
 					eventChan <- *oneMyEvent
 				} /* else {
 					fmt.Printf("no table struct found for %s, it maybe dropped, skip it. RowsEvent position:%s", tbKey, oneMyEvent.MyPos.String())
 				}*/
 
+			} else if IfSendXaEndEvent(cfg, trxState, trxStatus) {
+				binEventIdx++
+				oneMyEvent.EventIdx = binEventIdx
+				oneMyEvent.SetXaEnd(ev.Header.Timestamp, trxState, trxStatus, trxGtid)
+				eventChan <- *oneMyEvent
 			}
 
-			// output analysis result whatever the WorkType is
-			if sqlType != "" {
+			// output analysis result whatever the WorkType is, except only backup
+			if sqlType != "" && !cfg.IfBackupOnly() {
 				if sqlType == "query" {
 					statChan <- BinEventStats{Timestamp: ev.Header.Timestamp, Binlog: *currentBinlog, StartPos: ev.Header.LogPos - ev.Header.EventSize, StopPos: ev.Header.LogPos,
-						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType}
+						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType, Gtid: trxGtid,
+						TrxIndex: trxState.TrxIndex, TrxStatus: trxStatus, Xid: trxState.Xid}
 				} else {
 					statChan <- BinEventStats{Timestamp: ev.Header.Timestamp, Binlog: *currentBinlog, StartPos: tbMapPos, StopPos: ev.Header.LogPos,
-						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType}
+						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType, Gtid: trxGtid,
+						TrxIndex: trxState.TrxIndex, TrxStatus: trxStatus, Xid: trxState.Xid, OriginalSql: evOriginalSql}
 				}
 
 			}
 
+			if IfTrxEndStatus(trxStatus) {
+				streamer.checkpoint.TrxEnd(mysql.Position{Name: *currentBinlog, Pos: ev.Header.LogPos}, trxGtid, ev.Header.Timestamp)
+			}
+
 		} else if chkRe == RE_FILE_END {
 			continue
 		} else {
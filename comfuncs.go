@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -88,7 +87,7 @@ func CheckIsDir(fd string) (bool, string) {
 }
 
 func GetBinlogBasenameAndIndex(binlog string) (string, int) {
-	binlogFile := filepath.Base(binlog)
+	binlogFile := GetBinlogNameOfFile(binlog)
 	arr := strings.Split(binlogFile, ".")
 	cnt := len(arr)
 	n, err := strconv.ParseUint(arr[cnt-1], 10, 32)
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sync"
 
 	"time"
@@ -15,7 +17,7 @@ import (
 )
 
 const (
-	G_Version        = "binlog_inspector V1.04 \t--By danny.lai@vipshop.com | laijunshou@gmail.com\n"
+	G_Version        = "binlog_inspector V1.05 \t--By danny.lai@vipshop.com | laijunshou@gmail.com\n"
 	VALID_OPTS_MSG   = "valid options are: "
 	SLICE_TO_STR_SEP = ","
 
@@ -32,10 +34,17 @@ const (
 
 	TABLE_COLUMNS_DEF_JSON_FILE = "table_columns.json"
 
+	// rows events buffered for ordering sqls, per thread
+	SQL_REORDER_WINDOW_PER_THREAD = 64
+	// events buffered for each binlog file parsed concurrently
+	BINLOG_FILE_PARSE_BUFFER = 1000
+
 	TRX_STATUS_BEGIN    = 0
 	TRX_STATUS_COMMIT   = 1
 	TRX_STATUS_ROLLBACK = 2
 	TRX_STATUS_PROGRESS = -1
+	TRX_STATUS_IMPLICIT = 3 // ddl, begins and ends the transaction
+	TRX_STATUS_PREPARE  = 4 // xa prepare
 
 	//OUTPUT_STATS_FILE_PREFIX = "binlog_stats"
 
@@ -90,7 +99,7 @@ var (
 	//Opts_Required []string = []string{""}
 
 	Opts_Valid_Mode      []string = []string{"repl", "file"}
-	Opts_Valid_WortType  []string = []string{"tbldef", "stats", "2sql", "rollback"}
+	Opts_Valid_WortType  []string = []string{"tbldef", "stats", "2sql", "rollback", "backup"}
 	Opts_Valid_MysqlType []string = []string{"mysql", "mariadb"}
 	Opts_Valid_FilterSql []string = []string{"insert", "update", "delete"}
 
@@ -100,7 +109,8 @@ var (
 		"BigTrxRowLimit": []int{10, 3000, 500},
 		"LongTrxSeconds": []int{1, 1200, 300},
 		"InsertRows":     []int{1, 100, 30},
-		"Threads":        []int{1, 8, 2},
+		"Threads":        []int{1, GetMaxValue(8, runtime.NumCPU()), 2},
+		"ParseThreads":   []int{1, GetMaxValue(8, runtime.NumCPU()), 2},
 	}
 	Stats_Columns []string = []string{
 		"StartTime", "StopTime", "Binlog", "PosRange",
@@ -144,6 +154,15 @@ type ConfCmd struct {
 	StopFilePos      mysql.Position
 	IfSetStopFilePos bool
 
+	StartGtid      string
+	StopGtid       string
+	IncludeGtids   string
+	ExcludeGtids   string
+	StartGtidSet   mysql.GTIDSet
+	StopGtidSet    mysql.GTIDSet
+	IncludeGtidSet mysql.GTIDSet
+	ExcludeGtidSet mysql.GTIDSet
+
 	StartDatetime uint32
 	StopDatetime  uint32
 
@@ -166,16 +185,47 @@ type ConfCmd struct {
 	FilePerTable   bool
 
 	PrintExtraInfo bool
+	OriginalSql    bool
 
-	Threads uint
+	Threads      uint
+	ParseThreads uint
 
 	TableDefJsonFile string
 	OnlyColFromFile  bool
+	DdlHistory       bool
+	OnlyBinlogMeta   bool
 	//OnlyDumpTblDef   bool
 
 	BinlogDir string
 
 	GivenBinlogFile string
+
+	BinlogIndex      string
+	BinlogIndexFiles *BinlogIndex // binlog files of --binlog-index, nil if no binlog index file
+
+	RelayLog        bool
+	RelayCoordinate string
+	RelayLogInfo    string
+
+	Resume       bool
+	Resumed      bool // --resume and the checkpoint file is loaded, result files of the last run are appended to
+	MaxReconnect int
+
+	Backup     bool // --wtype=backup, WorkType is the one of --backup-with
+	BackupWith string
+
+	SslMode   string
+	SslCa     string
+	SslCert   string
+	SslKey    string
+	TlsConfig *tls.Config // of --ssl-xxx, nil if --ssl-mode=DISABLED
+
+	DefaultsFile string
+	LoginPath    string
+	AskPass      bool
+
+	ConfigFile string
+	Profile    string
 }
 
 func (this *ConfCmd) ParseCmdOptions() {
@@ -184,8 +234,11 @@ func (this *ConfCmd) ParseCmdOptions() {
 	}
 	var version bool
 	flag.BoolVar(&version, "version", false, "print version")
+	flag.StringVar(&this.ConfigFile, "config", "", "yaml(.yaml .yml) or toml(.toml) file of options, keys are the same as the options, like start-binlog, and binlog-file for the binlog file of --mode=file. options on command line override the ones in it")
+	flag.StringVar(&this.Profile, "profile", "", "Works with --config. use the options of this profile under profiles of --config, they override the top level ones")
 	flag.StringVar(&this.Mode, "mode", "file", StrSliceToString(Opts_Valid_Mode, SLICE_TO_STR_SEP, VALID_OPTS_MSG)+". repl: as a slave to get binlogs from master. file: get binlogs from local filesystem. default file")
-	flag.StringVar(&this.WorkType, "wtype", "stats", StrSliceToString(Opts_Valid_WortType, SLICE_TO_STR_SEP, VALID_OPTS_MSG)+". 2sql: convert binlog to sqls, rollback: generate rollback sqls, stats: analyze transactions. default: stats")
+	flag.StringVar(&this.WorkType, "wtype", "stats", StrSliceToString(Opts_Valid_WortType, SLICE_TO_STR_SEP, VALID_OPTS_MSG)+". 2sql: convert binlog to sqls, rollback: generate rollback sqls, stats: analyze transactions, backup: write binlogs from master to --output-dir(--mode=repl). default: stats")
+	flag.StringVar(&this.BackupWith, "backup-with", "", StrSliceToString(Opts_Valid_Backup_With, SLICE_TO_STR_SEP, VALID_OPTS_MSG)+". Works with --wtype=backup. also analyze transactions or generate sqls of the binlogs while backing up. default empty, only backup")
 	flag.StringVar(&this.MysqlType, "mtype", "mysql", StrSliceToString(Opts_Valid_MysqlType, SLICE_TO_STR_SEP, VALID_OPTS_MSG)+". server of binlog, mysql or mariadb, default mysql")
 
 	flag.StringVar(&this.Host, "host", "127.0.0.1", "master host, DONOT need to specify when --wtype=stats. if mode is file, it can be slave or other mysql contains same schema and table struct, not only master. default 127.0.0.1")
@@ -193,7 +246,16 @@ func (this *ConfCmd) ParseCmdOptions() {
 	flag.StringVar(&this.User, "user", "", "mysql user. DONOT need to specify when --wtype=stats")
 	flag.StringVar(&this.Passwd, "password", "", "mysql user password. DONOT need to specify when --wtype=stats")
 	flag.StringVar(&this.Socket, "socket", "", "mysql socket file")
+	flag.StringVar(&this.DefaultsFile, "defaults-file", "", "option file of mysql like my.cnf, read --host --port --user --password --socket --ssl-xxx from [client] and [binlog_inspector] groups. options on command line take priority. --password defaults to env MYSQL_PWD if not set anywhere")
+	flag.StringVar(&this.LoginPath, "login-path", "", "read options from this login path of ~/.mylogin.cnf(or env MYSQL_TEST_LOGIN_FILE) created by mysql_config_editor, and from this group of --defaults-file")
+	flag.BoolVar(&this.AskPass, "ask-pass", false, "prompt for the password without echo, instead of --password. default false")
+	flag.StringVar(&this.SslMode, "ssl-mode", "", StrSliceToString(Opts_Valid_Ssl_Mode, SLICE_TO_STR_SEP, VALID_OPTS_MSG)+". security state of the connections to mysql, for both replication and getting table definition, the same as mysql client. default VERIFY_CA if --ssl-ca is set, REQUIRED if --ssl-cert is set, otherwise DISABLED")
+	flag.StringVar(&this.SslCa, "ssl-ca", "", "file of the CA certificates in PEM format to verify the server certificate")
+	flag.StringVar(&this.SslCert, "ssl-cert", "", "file of the client certificate in PEM format, works with --ssl-key")
+	flag.StringVar(&this.SslKey, "ssl-key", "", "file of the client private key in PEM format, works with --ssl-cert")
 	flag.UintVar(&this.ServerId, "serverid", 3320, "works with --mode=repl, this program replicates from master as slave to read binlogs. Must set this server id unique from other slaves, default 3320")
+	flag.BoolVar(&this.Resume, "resume", false, "Works with --mode=repl. start from the position or gtid set in "+REPL_CHECKPOINT_FILE+" of --output-dir, which is updated at the end of transactions when replicating. --start-binlog --start-pos --start-gtid are used if it does not exist. default false")
+	flag.IntVar(&this.MaxReconnect, "max-reconnect", 0, "Works with --mode=repl. when replication breaks, reconnect to master from the end of the last transaction, with 1s, 2s, 4s ... at most 60s wait between retries. max times to retry one after another, 0 is unlimited. default 0")
 
 	var dbs, tbs, sqlTypes string
 	flag.StringVar(&dbs, "databases", "", "only parse these databases, comma seperated, default all. Useless when --wtype=stats")
@@ -201,15 +263,24 @@ func (this *ConfCmd) ParseCmdOptions() {
 	flag.StringVar(&sqlTypes, "sqltypes", "", StrSliceToString(Opts_Valid_FilterSql, SLICE_TO_STR_SEP, VALID_OPTS_MSG)+". only parse these types of sql, comma seperated, valid types are: insert, update, delete; default is all(insert,update,delete)")
 
 	flag.StringVar(&this.StartFile, "start-binlog", "", "binlog file to start reading")
+	flag.StringVar(&this.BinlogIndex, "binlog-index", "", "Works with --mode=file. binlog index file(like mysql-bin.index) defines the binlog files to parse and their order, default the .index file with the same basename next to the given binlog file if exists. --start-binlog --stop-binlog must be in it")
+	flag.BoolVar(&this.RelayLog, "relay-log", false, "Works with --mode=file. the binlog files are relay logs of a slave, positions in the output are of the master binlog, and positions of the relay log are added to --extra-info. default false")
+	flag.StringVar(&this.RelayCoordinate, "relay-coordinate", RELAY_COORDINATE_MASTER, "Works with --relay-log. valid values: master, relay. --start-binlog --start-pos --stop-binlog --stop-pos are positions of the master binlog(master), or of the relay logs(relay). default master")
+	flag.StringVar(&this.RelayLogInfo, "relay-log-info", "", "Works with --relay-log. relay-log.info file, or output of 'select * from mysql.slave_relay_log_info'. parse from the position the slave sql thread has executed when --start-binlog --start-pos are not set")
 	flag.UintVar(&this.StartPos, "start-pos", 0, "start reading the binlog at position")
 	flag.StringVar(&this.StopFile, "stop-binlog", "", "binlog file to stop reading")
 	flag.UintVar(&this.StopPos, "stop-pos", 0, "Stop reading the binlog at position")
 
+	flag.StringVar(&this.StartGtid, "start-gtid", "", "gtid set already executed, like gtid_executed of mysql(uuid:1-100,uuid:1-5) or gtid_slave_pos of mariadb(domain-server-seq,domain-server-seq). transactions in it are skipped, and --mode=repl starts replication from it instead of --start-binlog --start-pos")
+	flag.StringVar(&this.StopGtid, "stop-gtid", "", "Stop reading the binlog at the first transaction after this gtid(set) of the same server uuid(mysql) or domain(mariadb), the transaction of this gtid is included")
+	flag.StringVar(&this.IncludeGtids, "include-gtids", "", "only parse transactions in this gtid set, transactions without gtid are skipped too")
+	flag.StringVar(&this.ExcludeGtids, "exclude-gtids", "", "skip transactions in this gtid set")
+
 	var startTime, stopTime string
 	flag.StringVar(&startTime, "start-datetime", "", "Start reading the binlog at first event having a datetime equal or posterior to the argument, it should be like this: \"2004-12-25 11:25:56\"")
 	flag.StringVar(&stopTime, "stop-datetime", "", "Stop reading the binlog at first event having a datetime equal or posterior to the argument, it should be like this: \"2004-12-25 11:25:56\"")
 
-	flag.BoolVar(&this.ToLastLog, "to-last-log", false, "works with WorkType='stats', keep analyzing transations to last binlog for mode=file, and keep analyzing for mode=replication")
+	flag.BoolVar(&this.ToLastLog, "to-last-log", false, "works with WorkType='stats' or 'backup', keep analyzing transations to last binlog for mode=file, and keep analyzing or backing up for mode=replication")
 	flag.IntVar(&this.PrintInterval, "interval", this.GetDefaultValueOfRange("PrintInterval"), "works with WorkType='stats', print stats info each PrintInterval. "+this.GetDefaultAndRangeValueMsg("PrintInterval"))
 	flag.IntVar(&this.BigTrxRowLimit, "big-trx-rows", this.GetDefaultValueOfRange("BigTrxRowLimit"), "transaction with affected rows greater or equal to this value is considerated as big transaction. "+this.GetDefaultAndRangeValueMsg("BigTrxRowLimit"))
 	flag.IntVar(&this.LongTrxSeconds, "long-trx-seconds", this.GetDefaultValueOfRange("LongTrxSeconds"), "transaction with duration greater or equal to this value is considerated as long transaction. "+this.GetDefaultAndRangeValueMsg("LongTrxSeconds"))
@@ -222,13 +293,17 @@ func (this *ConfCmd) ParseCmdOptions() {
 	flag.StringVar(&this.OutputDir, "output-dir", "", "result output dir, default current work dir. Attension, result files could be large, set it to a dir with large free space")
 
 	flag.BoolVar(&this.PrintExtraInfo, "extra-info", false, "Works with WorkType=2sql|rollback. Print database/table/datetime/binlogposition...info on the line before sql, default false")
+	flag.BoolVar(&this.OriginalSql, "original-sql", false, "Print the original sql of rows events, from ROWS_QUERY_EVENT of mysql(binlog_rows_query_log_events=ON) or ANNOTATE_ROWS_EVENT of mariadb(binlog_annotate_row_events=ON), as a comment before sql with --extra-info when WorkType=2sql|rollback, and in big_long_trx.log and trx_summary.log. default false")
 
 	flag.BoolVar(&this.FilePerTable, "file-each-table", false, "Works with WorkType=2sql|rollback. one file for one table if true, else one file for all tables. default false. Attention, always one file for one binlog")
 
 	flag.UintVar(&this.Threads, "threads", 2, "Works with WorkType=2sql|rollback. threads to run, default 2")
+	flag.UintVar(&this.ParseThreads, "parse-threads", 2, "Works with --mode=file. binlog files to parse concurrently, events are still output in order of binlog position, default 2")
 
 	flag.StringVar(&this.TableDefJsonFile, "table-columns", "", "Works with WorkType=2sql|rollback. json file defines table struct")
 	flag.BoolVar(&this.OnlyColFromFile, "only-table-columns", false, "Only use table struct from --table-columns=file, do not find table struct from mysql")
+	flag.BoolVar(&this.DdlHistory, "ddl-history", true, "Works with WorkType=2sql|rollback and --mode=file. replay DDLs(alter/create/rename/drop table) in binlogs backwards from the current table struct, to get the right table struct for each rows event before DDL. table struct from --table-columns=file with the same binlog/startpos/stoppos key takes priority. default true")
+	flag.BoolVar(&this.OnlyBinlogMeta, "only-binlog-meta", false, "Works with WorkType=2sql|rollback. Only use column names and primary key from optional metadata of table map event(mysql 8.0 binlog_row_metadata=FULL), do not find table struct from mysql nor --table-columns=file, rows events without these metadata are skipped. Without this option, these metadata are also preferred when present")
 	//flag.BoolVar(&this.OnlyDumpTblDef, "only-dump-table-columns", false, "Only dump table definition to json file and exits, not parsing binlog to get forward/rollback sql nor statistical analysis")
 
 	flag.Parse()
@@ -237,6 +312,9 @@ func (this *ConfCmd) ParseCmdOptions() {
 		fmt.Printf("\n%s\n", G_Version)
 		os.Exit(0)
 	}
+	// --config --profile, options not set on command line are set from it
+	this.ApplyConfigFile()
+
 	if this.Mode != "repl" && this.Mode != "file" {
 
 		fmt.Printf("unsupported mode=%s, valid modes: file, repl\n", this.Mode)
@@ -244,13 +322,14 @@ func (this *ConfCmd) ParseCmdOptions() {
 	}
 
 	if this.Mode == "file" && this.WorkType != "tbldef" {
-		// the last arg should be binlog file
-		if flag.NArg() != 1 {
+		// the last arg should be binlog file, or binlog-file of --config
+		if flag.NArg() == 1 {
+			this.GivenBinlogFile = flag.Args()[0]
+		} else if flag.NArg() != 0 || this.GivenBinlogFile == "" {
 			fmt.Println("missing binlog file. binlog file as last arg must be specify when --mode=file")
 			this.PrintUsageMsg()
 			os.Exit(ERR_MISSING_OPTION)
 		}
-		this.GivenBinlogFile = flag.Args()[0]
 		if !file.IsFile(this.GivenBinlogFile) {
 			fmt.Println("%s doesnot exists nor a binlog file", this.GivenBinlogFile)
 			os.Exit(ERR_FILE_NOT_EXISTS)
@@ -332,9 +411,15 @@ func (this *ConfCmd) CheckCmdOptions() {
 	//check --wtype
 	CheckElementOfSliceStr(Opts_Valid_WortType, this.WorkType, "invalid arg for --wtype", true)
 
+	// check --wtype=backup --backup-with
+	this.CheckBackupOptions()
+
 	//check --mtype
 	CheckElementOfSliceStr(Opts_Valid_MysqlType, this.MysqlType, "invalid arg for --mtype", true)
 
+	// check --defaults-file --login-path --ask-pass, it may set --user --password --host --port --socket --ssl-xxx
+	this.CheckCredentialOptions()
+
 	if this.Mode != "file" && this.WorkType != "stats" {
 		//check --user
 		this.CheckRequiredOption(this.User, "--user must be set", true)
@@ -343,6 +428,15 @@ func (this *ConfCmd) CheckCmdOptions() {
 
 	}
 
+	// check --ssl-mode --ssl-ca --ssl-cert --ssl-key
+	this.CheckSslOptions()
+
+	// check --relay-log, it may set --start-binlog --start-pos
+	this.CheckRelayLogOptions()
+
+	// check --resume, it may set --start-binlog --start-pos --start-gtid
+	this.CheckResumeOptions()
+
 	//check --start-binlog --start-pos --stop-binlog --stop-pos
 	if this.StartFile != "" && this.StartPos != 0 && this.StopFile != "" && this.StopPos != 0 {
 		cmpRes := CompareBinlogPos(this.StartFile, this.StartPos, this.StopFile, this.StopPos)
@@ -382,9 +476,28 @@ func (this *ConfCmd) CheckCmdOptions() {
 
 	}
 
+	// check --binlog-index
+	if this.Mode == "file" && this.WorkType != "tbldef" {
+		this.CheckBinlogIndex()
+	}
+
+	// check --start-gtid --stop-gtid --include-gtids --exclude-gtids, the same format as --mtype
+	this.StartGtidSet = ParseGtidOption(this.MysqlType, this.StartGtid, "--start-gtid")
+	this.StopGtidSet = ParseGtidOption(this.MysqlType, this.StopGtid, "--stop-gtid")
+	this.IncludeGtidSet = ParseGtidOption(this.MysqlType, this.IncludeGtids, "--include-gtids")
+	this.ExcludeGtidSet = ParseGtidOption(this.MysqlType, this.ExcludeGtids, "--exclude-gtids")
+	if this.StopGtidSet != nil {
+		this.IfSetStopParsPoint = true
+	}
+
 	if this.Mode == "repl" && this.WorkType != "tbldef" {
-		if this.StartFile == "" || this.StartPos == 0 {
-			fmt.Println("when --mode=repl, --start-binlog and --start-pos must be specified")
+		if (this.StartFile == "" || this.StartPos == 0) && this.StartGtidSet == nil {
+			fmt.Println("when --mode=repl, --start-binlog and --start-pos, or --start-gtid must be specified")
+			os.Exit(ERR_OPTION_MISMATCH)
+		}
+		if this.Backup && this.StartGtidSet != nil {
+			// the backup must have all events of the binlogs, but the executed transactions are skipped by gtid
+			fmt.Println("--wtype=backup replicates by --start-binlog --start-pos, not --start-gtid")
 			os.Exit(ERR_OPTION_MISMATCH)
 		}
 	}
@@ -414,6 +527,17 @@ func (this *ConfCmd) CheckCmdOptions() {
 		this.CheckValueInRange("Threads", int(this.Threads), "value of --threads out of range", true)
 	}
 
+	// check --parse-threads
+	if this.ParseThreads != uint(this.GetDefaultValueOfRange("ParseThreads")) {
+		this.CheckValueInRange("ParseThreads", int(this.ParseThreads), "value of --parse-threads out of range", true)
+	}
+
+	// check --only-binlog-meta
+	if this.OnlyBinlogMeta && this.OnlyColFromFile {
+		fmt.Println("--only-binlog-meta and --only-table-columns cannot be set together")
+		os.Exit(ERR_OPTION_MISMATCH)
+	}
+
 	// check --output-dir
 	if this.OutputDir != "" {
 		ifExist, errMsg := CheckIsDir(this.OutputDir)
@@ -427,8 +551,8 @@ func (this *ConfCmd) CheckCmdOptions() {
 
 	// check --to-last-log
 	if this.ToLastLog {
-		if this.Mode != "repl" || this.WorkType != "stats" {
-			fmt.Println("--to-last-log only works with --mode=repl and --wtype=stats")
+		if this.Mode != "repl" || (this.WorkType != "stats" && !this.Backup) {
+			fmt.Println("--to-last-log only works with --mode=repl and --wtype=stats|backup")
 			os.Exit(ERR_OPTION_MISMATCH)
 		}
 		this.IfSetStopParsPoint = true
@@ -483,6 +607,7 @@ func (this *ConfCmd) PrintUsageMsg() {
 	fmt.Println("\tread binlog from local filesystem: ./binlog_inspector --mode=file opts... mysql-bin.000010")
 	exp := "\n\nusage example:\ngenerate forward sql and analysis report:\n\t" + os.Args[0] + " --mode=repl --wtype=2sql --mtype=mysql --threads=4 --serverid=3331 --host=127.0.0.1 --port=3306 --user=xxx --password=xxx --databases=db1,db2 --tables=tb1,tb2 --start-binlog=mysql-bin.000556 --start-pos=107 --stop-binlog=mysql-bin.000559 --stop-pos=4 --min-columns --file-each-table --insert-rows=20 --keep-trx --big-trx-rows=100 --long-trx-seconds=10 --output-dir=/home/apps/tmp --table-columns tbs_all_def.json"
 	exp += "\n\ngenerate rollback sql and analysis report:\n\t" + os.Args[0] + " --mode=file --wtype=rollback --mtype=mysql --threads=4 --host=127.0.0.1 --port=3306 --user=xxx --password=xxx --databases=db1,db2 --tables=tb1,tb2 --start-datetime='2017-09-28 13:00:00' --stop-datetime='2017-09-28 16:00:00' --min-columns --file-each-table --insert-rows=20 --keep-trx --big-trx-rows=100 --long-trx-seconds=10 --output-dir=/home/apps/tmp --table-columns tbs_all_def.json /apps/dbdata/mysqldata_3306/log/mysql-bin.000556"
+	exp += "\n\noptions in config file, and options on command line override them:\n\t" + os.Args[0] + " --config=/home/apps/binlog_inspector.yaml --profile=cluster1 --start-binlog=mysql-bin.000556 --start-pos=4"
 	exp += "\n\nonly generate analysis report:\n\t" + os.Args[0] + " --mode=repl --wtype=stats --mtype=mysql --host=127.0.0.1 --port=3306 --user=xxx --password=xxx --databases=db1,db2 --tables=tb1,tb2 --start-binlog=mysql-bin.000556 --start-pos=107 --to-last-log --interval=20 --big-trx-rows=100 --long-trx-seconds=10 --output-dir=/home/apps/tmp"
 	fmt.Println(exp)
 	fmt.Println("\nsuported options:\n")
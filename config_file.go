@@ -0,0 +1,418 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/toolkits/file"
+)
+
+const (
+	// key of the named profiles in --config
+	CONFIG_PROFILES_KEY = "profiles"
+	// key of the binlog file in --config, the last arg of command line with --mode=file
+	CONFIG_BINLOG_FILE_KEY = "binlog-file"
+)
+
+// options that cannot be set in --config
+var Config_Keys_Not_Allowed []string = []string{"config", "profile", "version"}
+
+// --config file. keys are the same as the command line options, like start-binlog or start_binlog.
+// options of the profile of --profile override the top level ones, and options on command line override both
+type ConfigFile struct {
+	fileName string
+	options  map[string]string
+	profiles map[string]map[string]string
+}
+
+// yaml or toml by the file extension, only the subset for options: scalars, lists of scalars, and
+// the profiles map(profiles: name: options in yaml, [profiles.name] in toml)
+func ReadConfigFile(fileName string) (*ConfigFile, error) {
+	content, err := file.ToBytes(fileName)
+	if err != nil {
+		return nil, errors.Annotatef(err, "fail to read config file %s", fileName)
+	}
+	var root map[string]interface{}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		root, err = ParseYamlConfig(string(content))
+	case ".toml":
+		root, err = ParseTomlConfig(string(content))
+	default:
+		return nil, errors.Errorf("unsupported config file %s, it must be .yaml, .yml or .toml", fileName)
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "fail to parse config file %s", fileName)
+	}
+
+	cfgFile := &ConfigFile{fileName: fileName, profiles: map[string]map[string]string{}}
+	for key, val := range root {
+		if key != CONFIG_PROFILES_KEY {
+			continue
+		}
+		profiles, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("%s of config file %s must be a map of profile name to options", key, fileName)
+		}
+		for name, profVal := range profiles {
+			profOpts, ok := profVal.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("profile %s of config file %s must be a map of options", name, fileName)
+			}
+			if cfgFile.profiles[name], err = ConfigOptionsToFlagValues(profOpts); err != nil {
+				return nil, errors.Annotatef(err, "invalid profile %s of config file %s", name, fileName)
+			}
+		}
+		delete(root, key)
+	}
+	if cfgFile.options, err = ConfigOptionsToFlagValues(root); err != nil {
+		return nil, errors.Annotatef(err, "invalid config file %s", fileName)
+	}
+	return cfgFile, nil
+}
+
+// option name => value of command line, lists are joined by comma, like --databases=db1,db2
+func ConfigOptionsToFlagValues(opts map[string]interface{}) (map[string]string, error) {
+	values := map[string]string{}
+	for key, val := range opts {
+		name := strings.Replace(strings.ToLower(key), "_", "-", -1)
+		if CheckElementOfSliceStr(Config_Keys_Not_Allowed, name, "", false) {
+			return nil, errors.Errorf("%s cannot be set in config file", key)
+		}
+		if name != CONFIG_BINLOG_FILE_KEY && flag.Lookup(name) == nil {
+			return nil, errors.Errorf("unknown option %s", key)
+		}
+		switch v := val.(type) {
+		case string:
+			values[name] = v
+		case []string:
+			values[name] = strings.Join(v, ",")
+		default:
+			return nil, errors.Errorf("value of %s must be a scalar or a list of scalars", key)
+		}
+	}
+	return values, nil
+}
+
+// options of the profile, or the top level ones only if profile is empty
+func (this *ConfigFile) GetOptions(profile string) (map[string]string, error) {
+	opts := map[string]string{}
+	for name, val := range this.options {
+		opts[name] = val
+	}
+	if profile == "" {
+		return opts, nil
+	}
+	profOpts, ok := this.profiles[profile]
+	if !ok {
+		names := make([]string, 0, len(this.profiles))
+		for name := range this.profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("profile %s not found in config file %s, profiles in it: %s", profile, this.fileName, strings.Join(names, ","))
+	}
+	for name, val := range profOpts {
+		opts[name] = val
+	}
+	return opts, nil
+}
+
+// --config --profile, right after parsing command line. options not set on command line are set from the config file
+// as if they were, so they are checked and processed the same way
+func (this *ConfCmd) ApplyConfigFile() {
+	if this.ConfigFile == "" {
+		if this.Profile != "" {
+			fmt.Println("--profile works with --config")
+			os.Exit(ERR_OPTION_MISMATCH)
+		}
+		return
+	}
+	if !file.IsFile(this.ConfigFile) {
+		fmt.Printf("%s doesnot exists nor a file\n", this.ConfigFile)
+		os.Exit(ERR_FILE_NOT_EXISTS)
+	}
+	cfgFile, err := ReadConfigFile(this.ConfigFile)
+	CheckErr(err, "invalid --config", ERR_INVALID_OPTION, true)
+	opts, err := cfgFile.GetOptions(this.Profile)
+	CheckErr(err, "invalid --profile", ERR_INVALID_OPTION, true)
+
+	cmdSet := GetCmdOptionsSet()
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == CONFIG_BINLOG_FILE_KEY {
+			if flag.NArg() == 0 {
+				this.GivenBinlogFile = opts[name]
+			}
+			continue
+		}
+		if cmdSet[name] {
+			continue
+		}
+		if err = flag.Set(name, opts[name]); err != nil {
+			fmt.Printf("invalid value %s of %s in %s: %s\n", opts[name], name, this.ConfigFile, err)
+			os.Exit(ERR_INVALID_OPTION)
+		}
+	}
+}
+
+// yaml subset: "key: value" maps nested by indentation, "- value" lists, [a, b] flow lists, quoted scalars and # comments
+func ParseYamlConfig(content string) (map[string]interface{}, error) {
+	var lines []configLine
+	for i, line := range strings.Split(content, "\n") {
+		text := strings.TrimRight(StripConfigComment(line), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, errors.Errorf("tab is not allowed for indentation at line %d", i+1)
+		}
+		lines = append(lines, configLine{num: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	val, next, err := parseYamlBlock(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if next < len(lines) {
+		return nil, errors.Errorf("unexpected indentation at line %d", lines[next].num)
+	}
+	root, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("top level must be a map of options")
+	}
+	return root, nil
+}
+
+type configLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// a map or a list of lines[i:] with the same indentation, returns the index of the line after it
+func parseYamlBlock(lines []configLine, i int, indent int) (interface{}, int, error) {
+	if lines[i].text == "-" || strings.HasPrefix(lines[i].text, "- ") {
+		var list []string
+		for ; i < len(lines) && lines[i].indent == indent; i++ {
+			line := lines[i]
+			if line.text != "-" && !strings.HasPrefix(line.text, "- ") {
+				// the next key of the map, when the list has the same indentation as its key
+				break
+			}
+			item, err := UnquoteConfigScalar(strings.TrimSpace(line.text[1:]))
+			if err != nil {
+				return nil, i, errors.Annotatef(err, "line %d", line.num)
+			}
+			list = append(list, item)
+		}
+		return list, i, nil
+	}
+
+	m := map[string]interface{}{}
+	for i < len(lines) && lines[i].indent == indent {
+		line := lines[i]
+		colon := strings.Index(line.text, ":")
+		for colon >= 0 && colon+1 < len(line.text) && line.text[colon+1] != ' ' {
+			// colon in the key, like a time
+			next := strings.Index(line.text[colon+1:], ":")
+			if next < 0 {
+				colon = -1
+			} else {
+				colon += 1 + next
+			}
+		}
+		if colon <= 0 {
+			return nil, i, errors.Errorf("expect \"key: value\" at line %d", line.num)
+		}
+		key, err := UnquoteConfigScalar(strings.TrimSpace(line.text[:colon]))
+		if err != nil {
+			return nil, i, errors.Annotatef(err, "line %d", line.num)
+		}
+		if _, ok := m[key]; ok {
+			return nil, i, errors.Errorf("duplicate key %s at line %d", key, line.num)
+		}
+		rest := strings.TrimSpace(line.text[colon+1:])
+		i++
+		if rest != "" {
+			if m[key], err = ParseConfigValue(rest); err != nil {
+				return nil, i, errors.Annotatef(err, "line %d", line.num)
+			}
+			continue
+		}
+		if i < len(lines) && (lines[i].indent > indent || (lines[i].indent == indent && strings.HasPrefix(lines[i].text, "- "))) {
+			// nested map or list, a list may have the same indentation as its key
+			if m[key], i, err = parseYamlBlock(lines, i, lines[i].indent); err != nil {
+				return nil, i, err
+			}
+			continue
+		}
+		m[key] = ""
+	}
+	if i < len(lines) && lines[i].indent > indent {
+		return nil, i, errors.Errorf("unexpected indentation at line %d", lines[i].num)
+	}
+	return m, i, nil
+}
+
+// toml subset: "key = value" with quoted strings, numbers, booleans and arrays, [table] and [table.sub] headers, # comments
+func ParseTomlConfig(content string) (map[string]interface{}, error) {
+	root := map[string]interface{}{}
+	table := root
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		num := i + 1
+		line := strings.TrimSpace(StripConfigComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		if line[0] == '[' {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, errors.Errorf("invalid table header at line %d", num)
+			}
+			table = root
+			for _, part := range SplitConfigList(line[1:len(line)-1], '.') {
+				name, err := UnquoteConfigScalar(strings.TrimSpace(part))
+				if err != nil || name == "" {
+					return nil, errors.Errorf("invalid table header at line %d", num)
+				}
+				sub, ok := table[name]
+				if !ok {
+					sub = map[string]interface{}{}
+					table[name] = sub
+				}
+				if table, ok = sub.(map[string]interface{}); !ok {
+					return nil, errors.Errorf("%s is not a table at line %d", name, num)
+				}
+			}
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return nil, errors.Errorf("expect \"key = value\" at line %d", num)
+		}
+		key, err := UnquoteConfigScalar(strings.TrimSpace(line[:eq]))
+		if err != nil {
+			return nil, errors.Annotatef(err, "line %d", num)
+		}
+		value := strings.TrimSpace(line[eq+1:])
+		// multi-line array
+		for strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") && i+1 < len(lines) {
+			i++
+			value += " " + strings.TrimSpace(StripConfigComment(lines[i]))
+		}
+		if _, ok := table[key]; ok {
+			return nil, errors.Errorf("duplicate key %s at line %d", key, num)
+		}
+		if table[key], err = ParseConfigValue(value); err != nil {
+			return nil, errors.Annotatef(err, "line %d", num)
+		}
+	}
+	return root, nil
+}
+
+// a scalar, or a list like [a, "b"]
+func ParseConfigValue(value string) (interface{}, error) {
+	if !strings.HasPrefix(value, "[") {
+		return UnquoteConfigScalar(value)
+	}
+	if !strings.HasSuffix(value, "]") {
+		return nil, errors.Errorf("unterminated list %s", value)
+	}
+	list := []string{}
+	for _, item := range SplitConfigList(value[1:len(value)-1], ',') {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			// trailing comma
+			continue
+		}
+		v, err := UnquoteConfigScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// "double quoted" with escapes, 'single quoted', or plain
+func UnquoteConfigScalar(value string) (string, error) {
+	if len(value) == 0 {
+		return value, nil
+	}
+	switch value[0] {
+	case '"':
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return "", errors.Errorf("invalid quoted string %s", value)
+		}
+		return s, nil
+	case '\'':
+		if len(value) < 2 || value[len(value)-1] != '\'' {
+			return "", errors.Errorf("invalid quoted string %s", value)
+		}
+		return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+	}
+	return value, nil
+}
+
+// split by sep out of quotes, a quote only begins a quoted part at its beginning
+func SplitConfigList(value string, sep byte) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quote != 0:
+			if (c == '\\' && quote == '"') || (c == '\'' && quote == '\'' && i+1 < len(value) && value[i+1] == '\'') {
+				// escaped char, or '' in single quotes
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && strings.TrimSpace(value[start:i]) == "":
+			quote = c
+		case c == sep:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// remove # comment out of quotes, the # must be at the beginning or after a space
+func StripConfigComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if (c == '\\' && quote == '"') || (c == '\'' && quote == '\'' && i+1 < len(line) && line[i+1] == '\'') {
+				// escaped char, or '' in single quotes
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t:=[,", line[i-1]) >= 0):
+			// quote at the beginning of a value
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseYamlConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		content  string
+		expected map[string]interface{}
+	}{
+		{"quotes and comments", `# options
+host: "h # 1"   # comment
+user: 'it''s'
+password: "p\"w\t#"
+socket: /tmp/my#sql.sock
+start-datetime: 2024-01-02 10:11:12
+empty:
+`, map[string]interface{}{"host": "h # 1", "user": "it's", "password": "p\"w\t#", "socket": "/tmp/my#sql.sock",
+			"start-datetime": "2024-01-02 10:11:12", "empty": ""}},
+		{"lists", `---
+databases:
+- db1
+- "db 2" # comment
+tables:
+    - t1
+sqltypes: [insert, 'up,date', "de]lete",]
+port: 3306
+`, map[string]interface{}{"databases": []string{"db1", "db 2"}, "tables": []string{"t1"},
+			"sqltypes": []string{"insert", "up,date", "de]lete"}, "port": "3306"}},
+		{"profiles", `host: h0
+profiles:
+  prod:
+    host: h1
+    databases:
+    - a
+  dev:
+    port: 3307
+user: root
+`, map[string]interface{}{"host": "h0", "user": "root", "profiles": map[string]interface{}{
+			"prod": map[string]interface{}{"host": "h1", "databases": []string{"a"}},
+			"dev":  map[string]interface{}{"port": "3307"}}}},
+	}
+	for _, c := range cases {
+		got, err := ParseYamlConfig(c.content)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s:\nexpect %#v\ngot    %#v", c.name, c.expected, got)
+		}
+	}
+
+	for _, content := range []string{
+		"host: h0\n\tport: 3306\n",
+		"host: h0\nhost: h1\n",
+		"host: h0\n  port: 3306\n",
+		"host: \"h0\n",
+		"- a\n- b\n",
+		"host\n",
+	} {
+		if got, err := ParseYamlConfig(content); err == nil {
+			t.Errorf("%q: expect error, got %#v", content, got)
+		}
+	}
+}
+
+func TestParseTomlConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		content  string
+		expected map[string]interface{}
+	}{
+		{"quotes and comments", `# options
+host = "h # 1"   # comment
+user = 'root'
+password = "p\"w#"
+socket = /tmp/my#sql.sock
+port = 3306
+to-last-log = true
+`, map[string]interface{}{"host": "h # 1", "user": "root", "password": "p\"w#", "socket": "/tmp/my#sql.sock",
+			"port": "3306", "to-last-log": "true"}},
+		{"multi-line arrays", `databases = [
+  "db1", # first
+  'db2',
+]
+tables = ["t1",
+  "t,2"]
+`, map[string]interface{}{"databases": []string{"db1", "db2"}, "tables": []string{"t1", "t,2"}}},
+		{"profiles", `host = "h0"
+[profiles.prod]
+host = "h1"
+databases = ["a"]
+
+[profiles."dev"]
+port = 3307
+`, map[string]interface{}{"host": "h0", "profiles": map[string]interface{}{
+			"prod": map[string]interface{}{"host": "h1", "databases": []string{"a"}},
+			"dev":  map[string]interface{}{"port": "3307"}}}},
+	}
+	for _, c := range cases {
+		got, err := ParseTomlConfig(c.content)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s:\nexpect %#v\ngot    %#v", c.name, c.expected, got)
+		}
+	}
+
+	for _, content := range []string{
+		"host = 'h0'\nhost = 'h1'\n",
+		"[[profiles]]\n",
+		"[profiles.\n",
+		"host = \"h0\n",
+		"databases = [\"a\", \"b\"\n",
+		"host\n",
+		"host = 'h0'\n[host]\n",
+	} {
+		if got, err := ParseTomlConfig(content); err == nil {
+			t.Errorf("%q: expect error, got %#v", content, got)
+		}
+	}
+}
+
+// options on the test command line, the same names as ParseCmdOptions
+func setConfigTestFlags(t *testing.T, cfg *ConfCmd, args []string) {
+	flag.CommandLine = flag.NewFlagSet("binlog_inspector", flag.ContinueOnError)
+	flag.StringVar(&cfg.ConfigFile, "config", "", "")
+	flag.StringVar(&cfg.Profile, "profile", "", "")
+	flag.StringVar(&cfg.Host, "host", "127.0.0.1", "")
+	flag.UintVar(&cfg.Port, "port", 3306, "")
+	flag.StringVar(&cfg.User, "user", "", "")
+	flag.StringVar(&cfg.StartFile, "start-binlog", "", "")
+	flag.BoolVar(&cfg.ToLastLog, "to-last-log", false, "")
+	flag.String("databases", "", "")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeConfigTestFile(t *testing.T, dir string, name string, content string) string {
+	fileName := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	oldCommandLine := flag.CommandLine
+	defer func() { flag.CommandLine = oldCommandLine }()
+	dir, err := ioutil.TempDir("", "config_file_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yamlFile := writeConfigTestFile(t, dir, "bi.yaml", `host: h0
+port: 3307
+user: root
+start_binlog: mysql-bin.000001
+databases: [db1, db2]
+binlog-file: /data/mysql-bin.000001
+profiles:
+  prod:
+    host: h1
+    port: 3308
+    to_last_log: true
+`)
+	tomlFile := writeConfigTestFile(t, dir, "bi.toml", `host = "h0"
+port = 3307
+user = "root"
+start_binlog = "mysql-bin.000001"
+databases = [
+  "db1",
+  "db2",
+]
+binlog-file = "/data/mysql-bin.000001"
+
+[profiles.prod]
+host = "h1"
+port = 3308
+to_last_log = true
+`)
+	type result struct {
+		Host, User, StartFile, Databases, GivenBinlogFile string
+		Port                                              uint
+		ToLastLog                                         bool
+	}
+	for _, fileName := range []string{yamlFile, tomlFile} {
+		for _, c := range []struct {
+			args     []string
+			expected result
+		}{
+			{[]string{"--config", fileName},
+				result{"h0", "root", "mysql-bin.000001", "db1,db2", "/data/mysql-bin.000001", 3307, false}},
+			// profile over top level
+			{[]string{"--config", fileName, "--profile", "prod"},
+				result{"h1", "root", "mysql-bin.000001", "db1,db2", "/data/mysql-bin.000001", 3308, true}},
+			// command line over profile and top level
+			{[]string{"--config", fileName, "--profile", "prod", "--port", "3309", "--user", "u1", "--databases", "db3", "/tmp/mysql-bin.000009"},
+				result{"h1", "u1", "mysql-bin.000001", "db3", "", 3309, true}},
+		} {
+			cfg := &ConfCmd{}
+			setConfigTestFlags(t, cfg, c.args)
+			cfg.ApplyConfigFile()
+			got := result{cfg.Host, cfg.User, cfg.StartFile, flag.Lookup("databases").Value.String(), cfg.GivenBinlogFile, cfg.Port, cfg.ToLastLog}
+			if got != c.expected {
+				t.Errorf("%v:\nexpect %+v\ngot    %+v", c.args, c.expected, got)
+			}
+		}
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	oldCommandLine := flag.CommandLine
+	defer func() { flag.CommandLine = oldCommandLine }()
+	setConfigTestFlags(t, &ConfCmd{}, nil)
+	dir, err := ioutil.TempDir("", "config_file_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		name    string
+		content string
+	}{
+		{"bi.ini", "host = h0\n"},
+		{"unknown.yaml", "no-such-option: 1\n"},
+		{"not_allowed.yaml", "profile: prod\n"},
+		{"profile_not_allowed.toml", "[profiles.prod]\nconfig = \"a.toml\"\n"},
+		{"profiles_not_map.yaml", "profiles: prod\n"},
+		{"nested.yaml", "host:\n  name: h0\n"},
+	} {
+		if _, err := ReadConfigFile(writeConfigTestFile(t, dir, c.name, c.content)); err == nil {
+			t.Errorf("%s: expect error", c.name)
+		}
+	}
+
+	cfgFile, err := ReadConfigFile(writeConfigTestFile(t, dir, "bi.yml", "host: h0\nprofiles:\n  prod:\n    host: h1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cfgFile.GetOptions("dev"); err == nil {
+		t.Error("profile dev does not exist, expect error")
+	}
+}
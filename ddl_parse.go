@@ -0,0 +1,652 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+/*
+a small parser for the DDL statements that change the column layout of a table. It only understands
+create table, alter table, rename table and drop table, and only the parts of them that matter to the
+column names/types and the primary/unique keys. Anything else is skipped.
+*/
+
+const (
+	DDL_TYPE_CREATE = iota + 1
+	DDL_TYPE_ALTER
+	DDL_TYPE_RENAME
+	DDL_TYPE_DROP
+)
+
+const (
+	DDL_ALTER_ADD_COLUMN = iota + 1
+	DDL_ALTER_DROP_COLUMN
+	DDL_ALTER_CHANGE_COLUMN
+	DDL_ALTER_MODIFY_COLUMN
+	DDL_ALTER_RENAME_COLUMN
+	DDL_ALTER_ADD_PRIMARY
+	DDL_ALTER_DROP_PRIMARY
+	DDL_ALTER_ADD_UNIQUE
+	DDL_ALTER_DROP_INDEX
+	DDL_ALTER_RENAME_TABLE
+)
+
+const (
+	ddlTokIdent = iota
+	ddlTokString
+	ddlTokPunct
+)
+
+type ddlToken struct {
+	val    string
+	kind   int
+	quoted bool // `identifier`
+}
+
+type DdlColumnDef struct {
+	Name      string
+	DataType  string   // lower case data type name, as DATA_TYPE of information_schema.columns
+	First     bool     // FIRST
+	After     string   // AFTER col
+	IsPrimary bool     // col_name int primary key
+	IsUnique  bool     // col_name int unique key
+	Unsigned  bool     // UNSIGNED, ZEROFILL or SERIAL
+	EnumSet   []string // members of enum/set
+}
+
+type DdlAlterSpec struct {
+	Action    int
+	Column    DdlColumnDef // add, change, modify
+	OldName   string       // change, drop, rename column
+	NewName   string       // rename column
+	KeyCols   KeyInfo      // add primary key, add unique key
+	NewSchema string       // rename table
+	NewTable  string       // rename table
+}
+
+type DdlStatement struct {
+	Type      int
+	Schema    string
+	Table     string
+	NewSchema string // rename table
+	NewTable  string // rename table
+
+	// create table
+	Columns    []DdlColumnDef
+	PrimaryKey KeyInfo
+	UniqueKeys []KeyInfo
+	LikeSchema string
+	LikeTable  string
+	ColsParsed bool // false for create table ... select
+
+	Specs []DdlAlterSpec
+}
+
+type ddlParser struct {
+	toks []ddlToken
+	pos  int
+}
+
+func ddlIsIdentChar(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func TokenizeDdlSql(sql string) []ddlToken {
+	var toks []ddlToken
+	rs := []rune(sql)
+	n := len(rs)
+	inVersionComment := false
+	for i := 0; i < n; {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '#' || (r == '-' && i+2 < n && rs[i+1] == '-' && unicode.IsSpace(rs[i+2])):
+			for i < n && rs[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < n && rs[i+1] == '*':
+			if i+2 < n && rs[i+2] == '!' {
+				// /*!50100 ... */, content is executed by mysql
+				i += 3
+				for i < n && unicode.IsDigit(rs[i]) {
+					i++
+				}
+				inVersionComment = true
+				continue
+			}
+			i += 2
+			for i+1 < n && !(rs[i] == '*' && rs[i+1] == '/') {
+				i++
+			}
+			i += 2
+		case r == '*' && inVersionComment && i+1 < n && rs[i+1] == '/':
+			inVersionComment = false
+			i += 2
+		case r == '`':
+			var sb strings.Builder
+			i++
+			for i < n {
+				if rs[i] == '`' {
+					if i+1 < n && rs[i+1] == '`' {
+						sb.WriteRune('`')
+						i += 2
+						continue
+					}
+					break
+				}
+				sb.WriteRune(rs[i])
+				i++
+			}
+			i++
+			toks = append(toks, ddlToken{val: sb.String(), kind: ddlTokIdent, quoted: true})
+		case r == '\'' || r == '"':
+			var sb strings.Builder
+			quote := r
+			i++
+			for i < n {
+				if rs[i] == '\\' && i+1 < n {
+					sb.WriteRune(rs[i+1])
+					i += 2
+					continue
+				}
+				if rs[i] == quote {
+					if i+1 < n && rs[i+1] == quote {
+						sb.WriteRune(quote)
+						i += 2
+						continue
+					}
+					break
+				}
+				sb.WriteRune(rs[i])
+				i++
+			}
+			i++
+			toks = append(toks, ddlToken{val: sb.String(), kind: ddlTokString})
+		case ddlIsIdentChar(r):
+			j := i
+			for j < n && ddlIsIdentChar(rs[j]) {
+				j++
+			}
+			toks = append(toks, ddlToken{val: string(rs[i:j]), kind: ddlTokIdent})
+			i = j
+		default:
+			toks = append(toks, ddlToken{val: string(r), kind: ddlTokPunct})
+			i++
+		}
+	}
+	return toks
+}
+
+func (this *ddlParser) eof() bool {
+	return this.pos >= len(this.toks)
+}
+
+func (this *ddlParser) peek(off int) *ddlToken {
+	if this.pos+off >= len(this.toks) {
+		return nil
+	}
+	return &this.toks[this.pos+off]
+}
+
+// isKw checks whether the next tokens are the keywords given, without consuming them
+func (this *ddlParser) isKw(words ...string) bool {
+	for i, w := range words {
+		t := this.peek(i)
+		if t == nil || t.kind != ddlTokIdent || t.quoted || !strings.EqualFold(t.val, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptKw consumes the keywords given if the next tokens match them
+func (this *ddlParser) acceptKw(words ...string) bool {
+	if this.isKw(words...) {
+		this.pos += len(words)
+		return true
+	}
+	return false
+}
+
+func (this *ddlParser) isPunct(p string) bool {
+	t := this.peek(0)
+	return t != nil && t.kind == ddlTokPunct && t.val == p
+}
+
+func (this *ddlParser) acceptPunct(p string) bool {
+	if this.isPunct(p) {
+		this.pos++
+		return true
+	}
+	return false
+}
+
+func (this *ddlParser) nextIdent() string {
+	t := this.peek(0)
+	if t == nil || t.kind == ddlTokPunct {
+		return ""
+	}
+	this.pos++
+	return t.val
+}
+
+// parseStringList consumes ('a', 'b', ...) and returns the strings in it
+func (this *ddlParser) parseStringList() []string {
+	strs := []string{}
+	if !this.acceptPunct("(") {
+		return strs
+	}
+	for !this.eof() {
+		t := this.peek(0)
+		this.pos++
+		if t.kind == ddlTokString {
+			strs = append(strs, t.val)
+		} else if t.kind == ddlTokPunct && t.val == ")" {
+			break
+		}
+	}
+	return strs
+}
+
+// ParseEnumSetOfColumnType returns members of enum/set from COLUMN_TYPE of information_schema.columns, ex: enum('m','f')
+func ParseEnumSetOfColumnType(colType string) []string {
+	p := &ddlParser{toks: TokenizeDdlSql(colType)}
+	if !p.acceptKw("enum") && !p.acceptKw("set") {
+		return nil
+	}
+	return p.parseStringList()
+}
+
+func (this *ddlParser) parseTableName(defaultDb string) (string, string) {
+	name := this.nextIdent()
+	if this.acceptPunct(".") {
+		return name, this.nextIdent()
+	}
+	return defaultDb, name
+}
+
+// skipGroup skips a balanced (...) group, the current token must be "("
+func (this *ddlParser) skipGroup() {
+	depth := 0
+	for !this.eof() {
+		if this.isPunct("(") {
+			depth++
+		} else if this.isPunct(")") {
+			depth--
+			if depth <= 0 {
+				this.pos++
+				return
+			}
+		}
+		this.pos++
+	}
+}
+
+// skipToSep skips tokens until "," or ")" or ";" at the current level, not consuming the separator
+func (this *ddlParser) skipToSep() {
+	for !this.eof() {
+		if this.isPunct(",") || this.isPunct(")") || this.isPunct(";") {
+			return
+		}
+		if this.isPunct("(") {
+			this.skipGroup()
+			continue
+		}
+		this.pos++
+	}
+}
+
+func (this *ddlParser) parseKeyCols() KeyInfo {
+	var cols KeyInfo
+	if !this.acceptPunct("(") {
+		return cols
+	}
+	for !this.eof() && !this.isPunct(")") {
+		name := this.nextIdent()
+		if name != "" {
+			cols = append(cols, name)
+		}
+		// prefix length, asc/desc
+		this.skipToSep()
+		this.acceptPunct(",")
+	}
+	this.acceptPunct(")")
+	return cols
+}
+
+// skipKeyNameAndType skips [index_name] [USING BTREE|HASH] before the key columns
+func (this *ddlParser) skipKeyNameAndType() {
+	for !this.eof() && !this.isPunct("(") && !this.isPunct(",") && !this.isPunct(")") {
+		this.pos++
+	}
+}
+
+func NormalizeDdlDataType(tp string, next string) string {
+	tp = strings.ToLower(tp)
+	switch tp {
+	case "integer":
+		return "int"
+	case "bool", "boolean":
+		return "tinyint"
+	case "dec", "numeric", "fixed":
+		return "decimal"
+	case "real":
+		return "double"
+	case "serial":
+		return "bigint"
+	case "nchar":
+		return "char"
+	case "nvarchar":
+		return "varchar"
+	case "character":
+		if strings.EqualFold(next, "varying") {
+			return "varchar"
+		}
+		return "char"
+	case "national":
+		return NormalizeDdlDataType(next, "")
+	case "long":
+		// long varchar, long varbinary
+		if strings.EqualFold(next, "varbinary") {
+			return "mediumblob"
+		}
+		return "mediumtext"
+	}
+	return tp
+}
+
+// parseColumnDef parses col_name column_definition [FIRST | AFTER col_name]
+func (this *ddlParser) parseColumnDef() DdlColumnDef {
+	col := DdlColumnDef{Name: this.nextIdent()}
+	tp := this.nextIdent()
+	next := ""
+	if t := this.peek(0); t != nil && t.kind == ddlTokIdent {
+		next = t.val
+	}
+	col.DataType = NormalizeDdlDataType(tp, next)
+	if strings.EqualFold(tp, "serial") {
+		// bigint unsigned not null auto_increment unique
+		col.Unsigned = true
+	}
+	for !this.eof() {
+		if this.isPunct(",") || this.isPunct(")") || this.isPunct(";") {
+			break
+		}
+		if this.isPunct("(") {
+			if (col.DataType == "enum" || col.DataType == "set") && col.EnumSet == nil {
+				col.EnumSet = this.parseStringList()
+			} else {
+				this.skipGroup()
+			}
+			continue
+		}
+		if this.acceptKw("primary", "key") {
+			col.IsPrimary = true
+			continue
+		}
+		if this.acceptKw("unique") {
+			col.IsUnique = true
+			this.acceptKw("key")
+			continue
+		}
+		if this.acceptKw("unsigned") || this.acceptKw("zerofill") {
+			col.Unsigned = true
+			continue
+		}
+		if this.acceptKw("first") {
+			col.First = true
+			continue
+		}
+		if this.acceptKw("after") {
+			col.After = this.nextIdent()
+			continue
+		}
+		this.pos++
+	}
+	return col
+}
+
+func ParseDdlSql(defaultDb string, sql string) []DdlStatement {
+	p := &ddlParser{toks: TokenizeDdlSql(sql)}
+	if p.acceptKw("create") {
+		p.acceptKw("or", "replace")
+		if p.isKw("temporary") {
+			// temporary table is not logged in row format
+			return nil
+		}
+		if !p.acceptKw("table") {
+			return nil
+		}
+		return p.parseCreateTable(defaultDb)
+	} else if p.acceptKw("alter") {
+		p.acceptKw("online")
+		p.acceptKw("offline")
+		p.acceptKw("ignore")
+		if !p.acceptKw("table") {
+			return nil
+		}
+		return p.parseAlterTable(defaultDb)
+	} else if p.acceptKw("rename", "table") {
+		return p.parseRenameTable(defaultDb)
+	} else if p.acceptKw("drop") {
+		if p.isKw("temporary") {
+			return nil
+		}
+		if !p.acceptKw("table") {
+			return nil
+		}
+		return p.parseDropTable(defaultDb)
+	}
+	return nil
+}
+
+func (this *ddlParser) parseCreateTable(defaultDb string) []DdlStatement {
+	this.acceptKw("if", "not", "exists")
+	st := DdlStatement{Type: DDL_TYPE_CREATE}
+	st.Schema, st.Table = this.parseTableName(defaultDb)
+	if st.Table == "" {
+		return nil
+	}
+	if this.acceptKw("like") {
+		st.LikeSchema, st.LikeTable = this.parseTableName(defaultDb)
+		return []DdlStatement{st}
+	}
+	if !this.acceptPunct("(") {
+		// create table ... select
+		return []DdlStatement{st}
+	}
+	if this.acceptKw("like") {
+		st.LikeSchema, st.LikeTable = this.parseTableName(defaultDb)
+		return []DdlStatement{st}
+	}
+	for !this.eof() && !this.isPunct(")") {
+		this.parseCreateDefinition(&st)
+		this.skipToSep()
+		this.acceptPunct(",")
+	}
+	if this.acceptPunct(")") {
+		this.skipTableOptions()
+		st.ColsParsed = !this.isKw("select") && !this.isKw("as") && !this.isKw("ignore") && !this.isKw("replace")
+	}
+	return []DdlStatement{st}
+}
+
+func (this *ddlParser) skipTableOptions() {
+	for !this.eof() && !this.isKw("select") && !this.isKw("as") && !this.isKw("ignore") && !this.isKw("replace") {
+		if this.isPunct("(") {
+			this.skipGroup()
+			continue
+		}
+		this.pos++
+	}
+}
+
+func (this *ddlParser) parseCreateDefinition(st *DdlStatement) {
+	if this.acceptKw("constraint") {
+		if !this.isKw("primary") && !this.isKw("unique") && !this.isKw("foreign") && !this.isKw("check") {
+			this.nextIdent()
+		}
+	}
+	if this.acceptKw("primary", "key") {
+		this.skipKeyNameAndType()
+		st.PrimaryKey = this.parseKeyCols()
+		return
+	}
+	if this.acceptKw("unique") {
+		if !this.acceptKw("index") {
+			this.acceptKw("key")
+		}
+		this.skipKeyNameAndType()
+		st.UniqueKeys = append(st.UniqueKeys, this.parseKeyCols())
+		return
+	}
+	if this.isKw("index") || this.isKw("key") || this.isKw("fulltext") || this.isKw("spatial") ||
+		this.isKw("foreign") || this.isKw("check") {
+		return
+	}
+	col := this.parseColumnDef()
+	st.Columns = append(st.Columns, col)
+	if col.IsPrimary {
+		st.PrimaryKey = KeyInfo{col.Name}
+	} else if col.IsUnique {
+		st.UniqueKeys = append(st.UniqueKeys, KeyInfo{col.Name})
+	}
+}
+
+func (this *ddlParser) parseAlterTable(defaultDb string) []DdlStatement {
+	st := DdlStatement{Type: DDL_TYPE_ALTER}
+	st.Schema, st.Table = this.parseTableName(defaultDb)
+	if st.Table == "" {
+		return nil
+	}
+	for !this.eof() {
+		st.Specs = append(st.Specs, this.parseAlterSpec(defaultDb)...)
+		this.skipToSep()
+		if !this.acceptPunct(",") {
+			break
+		}
+	}
+	return []DdlStatement{st}
+}
+
+func (this *ddlParser) parseAlterSpec(defaultDb string) []DdlAlterSpec {
+	if this.acceptKw("add") {
+		if this.acceptKw("constraint") {
+			if !this.isKw("primary") && !this.isKw("unique") && !this.isKw("foreign") && !this.isKw("check") {
+				this.nextIdent()
+			}
+		}
+		if this.acceptKw("primary", "key") {
+			this.skipKeyNameAndType()
+			return []DdlAlterSpec{{Action: DDL_ALTER_ADD_PRIMARY, KeyCols: this.parseKeyCols()}}
+		}
+		if this.acceptKw("unique") {
+			if !this.acceptKw("index") {
+				this.acceptKw("key")
+			}
+			this.skipKeyNameAndType()
+			return []DdlAlterSpec{{Action: DDL_ALTER_ADD_UNIQUE, KeyCols: this.parseKeyCols()}}
+		}
+		if this.isKw("index") || this.isKw("key") || this.isKw("fulltext") || this.isKw("spatial") ||
+			this.isKw("foreign") || this.isKw("check") || this.isKw("partition") {
+			return nil
+		}
+		this.acceptKw("column")
+		if this.acceptPunct("(") {
+			var specs []DdlAlterSpec
+			for !this.eof() && !this.isPunct(")") {
+				specs = append(specs, this.colSpecWithKey(DDL_ALTER_ADD_COLUMN, this.parseColumnDef(), "")...)
+				this.skipToSep()
+				this.acceptPunct(",")
+			}
+			this.acceptPunct(")")
+			return specs
+		}
+		return this.colSpecWithKey(DDL_ALTER_ADD_COLUMN, this.parseColumnDef(), "")
+	}
+	if this.acceptKw("change") {
+		this.acceptKw("column")
+		oldName := this.nextIdent()
+		return this.colSpecWithKey(DDL_ALTER_CHANGE_COLUMN, this.parseColumnDef(), oldName)
+	}
+	if this.acceptKw("modify") {
+		this.acceptKw("column")
+		col := this.parseColumnDef()
+		return this.colSpecWithKey(DDL_ALTER_MODIFY_COLUMN, col, col.Name)
+	}
+	if this.acceptKw("drop") {
+		if this.acceptKw("primary", "key") {
+			return []DdlAlterSpec{{Action: DDL_ALTER_DROP_PRIMARY}}
+		}
+		if this.acceptKw("index") || this.acceptKw("key") {
+			return []DdlAlterSpec{{Action: DDL_ALTER_DROP_INDEX, OldName: this.nextIdent()}}
+		}
+		if this.isKw("foreign") || this.isKw("check") || this.isKw("constraint") || this.isKw("partition") {
+			return nil
+		}
+		this.acceptKw("column")
+		return []DdlAlterSpec{{Action: DDL_ALTER_DROP_COLUMN, OldName: this.nextIdent()}}
+	}
+	if this.acceptKw("rename") {
+		if this.acceptKw("column") {
+			oldName := this.nextIdent()
+			this.acceptKw("to")
+			return []DdlAlterSpec{{Action: DDL_ALTER_RENAME_COLUMN, OldName: oldName, NewName: this.nextIdent()}}
+		}
+		if this.isKw("index") || this.isKw("key") {
+			return nil
+		}
+		if !this.acceptKw("to") {
+			this.acceptKw("as")
+		}
+		db, tb := this.parseTableName(defaultDb)
+		return []DdlAlterSpec{{Action: DDL_ALTER_RENAME_TABLE, NewSchema: db, NewTable: tb}}
+	}
+	return nil
+}
+
+// colSpecWithKey also returns add primary/unique key specs for "col int primary key"
+func (this *ddlParser) colSpecWithKey(action int, col DdlColumnDef, oldName string) []DdlAlterSpec {
+	specs := []DdlAlterSpec{{Action: action, Column: col, OldName: oldName}}
+	if col.IsPrimary {
+		specs = append(specs, DdlAlterSpec{Action: DDL_ALTER_ADD_PRIMARY, KeyCols: KeyInfo{col.Name}})
+	} else if col.IsUnique {
+		specs = append(specs, DdlAlterSpec{Action: DDL_ALTER_ADD_UNIQUE, KeyCols: KeyInfo{col.Name}})
+	}
+	return specs
+}
+
+func (this *ddlParser) parseRenameTable(defaultDb string) []DdlStatement {
+	var sts []DdlStatement
+	for !this.eof() {
+		st := DdlStatement{Type: DDL_TYPE_RENAME}
+		st.Schema, st.Table = this.parseTableName(defaultDb)
+		if !this.acceptKw("to") {
+			break
+		}
+		st.NewSchema, st.NewTable = this.parseTableName(defaultDb)
+		sts = append(sts, st)
+		if !this.acceptPunct(",") {
+			break
+		}
+	}
+	return sts
+}
+
+func (this *ddlParser) parseDropTable(defaultDb string) []DdlStatement {
+	var sts []DdlStatement
+	this.acceptKw("if", "exists")
+	for !this.eof() {
+		st := DdlStatement{Type: DDL_TYPE_DROP}
+		st.Schema, st.Table = this.parseTableName(defaultDb)
+		if st.Table == "" {
+			break
+		}
+		sts = append(sts, st)
+		if !this.acceptPunct(",") {
+			break
+		}
+	}
+	return sts
+}
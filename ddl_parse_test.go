@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeDdlSql(t *testing.T) {
+	cases := []struct {
+		sql  string
+		toks []ddlToken
+	}{
+		{"alter table `t``1` add c int",
+			[]ddlToken{{"alter", ddlTokIdent, false}, {"table", ddlTokIdent, false}, {"t`1", ddlTokIdent, true},
+				{"add", ddlTokIdent, false}, {"c", ddlTokIdent, false}, {"int", ddlTokIdent, false}}},
+		{"/* hint */ alter -- comment\n table t # comment\n",
+			[]ddlToken{{"alter", ddlTokIdent, false}, {"table", ddlTokIdent, false}, {"t", ddlTokIdent, false}}},
+		{"/*!50100 alter */ table",
+			[]ddlToken{{"alter", ddlTokIdent, false}, {"table", ddlTokIdent, false}}},
+		{`'it''s' "a\"b" 'c\\d'`,
+			[]ddlToken{{"it's", ddlTokString, false}, {`a"b`, ddlTokString, false}, {`c\d`, ddlTokString, false}}},
+		{"(a,b);",
+			[]ddlToken{{"(", ddlTokPunct, false}, {"a", ddlTokIdent, false}, {",", ddlTokPunct, false},
+				{"b", ddlTokIdent, false}, {")", ddlTokPunct, false}, {";", ddlTokPunct, false}}},
+		{"a--b", []ddlToken{{"a", ddlTokIdent, false}, {"-", ddlTokPunct, false}, {"-", ddlTokPunct, false}, {"b", ddlTokIdent, false}}},
+		{"`列名` $x1", []ddlToken{{"列名", ddlTokIdent, true}, {"$x1", ddlTokIdent, false}}},
+	}
+	for _, c := range cases {
+		toks := TokenizeDdlSql(c.sql)
+		if !reflect.DeepEqual(toks, c.toks) {
+			t.Errorf("%q: expect %v, got %v", c.sql, c.toks, toks)
+		}
+	}
+}
+
+// one line for each statement, like: alter db.t1 [drop:b add:c:int:after=a]
+func describeDdlStatement(st DdlStatement) string {
+	switch st.Type {
+	case DDL_TYPE_CREATE:
+		if st.LikeTable != "" {
+			return fmt.Sprintf("create %s.%s like %s.%s", st.Schema, st.Table, st.LikeSchema, st.LikeTable)
+		}
+		var cols []string
+		for _, col := range st.Columns {
+			cols = append(cols, describeDdlColumn(col))
+		}
+		return fmt.Sprintf("create %s.%s [%s] pk=%v uk=%v parsed=%v", st.Schema, st.Table, strings.Join(cols, " "), st.PrimaryKey, st.UniqueKeys, st.ColsParsed)
+	case DDL_TYPE_ALTER:
+		var specs []string
+		for _, spec := range st.Specs {
+			specs = append(specs, describeDdlAlterSpec(spec))
+		}
+		return fmt.Sprintf("alter %s.%s [%s]", st.Schema, st.Table, strings.Join(specs, " "))
+	case DDL_TYPE_RENAME:
+		return fmt.Sprintf("rename %s.%s %s.%s", st.Schema, st.Table, st.NewSchema, st.NewTable)
+	case DDL_TYPE_DROP:
+		return fmt.Sprintf("drop %s.%s", st.Schema, st.Table)
+	}
+	return "unknown"
+}
+
+func describeDdlColumn(col DdlColumnDef) string {
+	s := col.Name + ":" + col.DataType
+	if col.Unsigned {
+		s += ":unsigned"
+	}
+	if len(col.EnumSet) > 0 {
+		s += ":" + strings.Join(col.EnumSet, "|")
+	}
+	if col.First {
+		s += ":first"
+	}
+	if col.After != "" {
+		s += ":after=" + col.After
+	}
+	return s
+}
+
+func describeDdlAlterSpec(spec DdlAlterSpec) string {
+	switch spec.Action {
+	case DDL_ALTER_ADD_COLUMN:
+		return "add:" + describeDdlColumn(spec.Column)
+	case DDL_ALTER_DROP_COLUMN:
+		return "drop:" + spec.OldName
+	case DDL_ALTER_CHANGE_COLUMN:
+		return "change:" + spec.OldName + "->" + describeDdlColumn(spec.Column)
+	case DDL_ALTER_MODIFY_COLUMN:
+		return "modify:" + describeDdlColumn(spec.Column)
+	case DDL_ALTER_RENAME_COLUMN:
+		return "rename_col:" + spec.OldName + "->" + spec.NewName
+	case DDL_ALTER_ADD_PRIMARY:
+		return fmt.Sprintf("add_pk:%v", spec.KeyCols)
+	case DDL_ALTER_DROP_PRIMARY:
+		return "drop_pk"
+	case DDL_ALTER_ADD_UNIQUE:
+		return fmt.Sprintf("add_uk:%v", spec.KeyCols)
+	case DDL_ALTER_DROP_INDEX:
+		return "drop_index:" + spec.OldName
+	case DDL_ALTER_RENAME_TABLE:
+		return "rename_table:" + spec.NewSchema + "." + spec.NewTable
+	}
+	return "unknown"
+}
+
+func TestParseDdlSql(t *testing.T) {
+	cases := []struct {
+		sql      string
+		expected []string
+	}{
+		{"create table db1.t1 (id int unsigned not null primary key, `name` varchar(10) default 'a,b', st enum('x','y'), unique key uk_name(name(5)), key idx(st)) engine=innodb",
+			[]string{"create db1.t1 [id:int:unsigned name:varchar st:enum:x|y] pk=[id] uk=[[name]] parsed=true"}},
+		{"CREATE TABLE IF NOT EXISTS t2 (a serial, b integer, c national varchar(3), primary key (a, b))",
+			[]string{"create db.t2 [a:bigint:unsigned b:int c:varchar] pk=[a b] uk=[] parsed=true"}},
+		{"create table t3 like db2.t0", []string{"create db.t3 like db2.t0"}},
+		{"create temporary table t4 (a int)", nil},
+		{"/*!40000 ALTER TABLE t1 DISABLE KEYS */", []string{"alter db.t1 []"}},
+		{"alter table t1 drop b, drop column c, add d int after a, add column e text first",
+			[]string{"alter db.t1 [drop:b drop:c add:d:int:after=a add:e:text:first]"}},
+		{"alter table t1 change e f bigint not null, modify g datetime(3) first, rename column h to i",
+			[]string{"alter db.t1 [change:e->f:bigint modify:g:datetime:first rename_col:h->i]"}},
+		{"alter table t1 add (x int, y int unique), add primary key (x), add unique key uk (y, x), drop primary key, drop index uk",
+			[]string{"alter db.t1 [add:x:int add:y:int add_uk:[y] add_pk:[x] add_uk:[y x] drop_pk drop_index:uk]"}},
+		{"alter table t1 add index idx (a), drop foreign key fk, rename to db2.t2",
+			[]string{"alter db.t1 [rename_table:db2.t2]"}},
+		{"rename table a to b, db2.c to db3.d",
+			[]string{"rename db.a db.b", "rename db2.c db3.d"}},
+		{"drop table if exists a, db2.b", []string{"drop db.a", "drop db2.b"}},
+		{"drop temporary table a", nil},
+		{"drop index idx on t1", nil},
+	}
+	for _, c := range cases {
+		var got []string
+		for _, st := range ParseDdlSql("db", c.sql) {
+			got = append(got, describeDdlStatement(st))
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%q:\nexpect %q\ngot    %q", c.sql, c.expected, got)
+		}
+	}
+}
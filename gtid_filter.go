@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// events not belonging to any transaction, never skipped by gtid
+var G_Non_Trx_Event_Types []replication.EventType = []replication.EventType{
+	replication.ROTATE_EVENT, replication.FORMAT_DESCRIPTION_EVENT, replication.STOP_EVENT,
+	replication.HEARTBEAT_EVENT, replication.PREVIOUS_GTIDS_EVENT,
+	replication.MARIADB_GTID_LIST_EVENT, replication.MARIADB_BINLOG_CHECKPOINT_EVENT,
+}
+
+// mysql: server uuid + gno, mariadb: domain id + server id + sequence number
+type MyGtid struct {
+	Sid      string
+	Gno      int64
+	DomainID uint32
+	ServerID uint32
+	SeqNo    uint64
+}
+
+func (this MyGtid) String() string {
+	if this.Sid != "" {
+		return fmt.Sprintf("%s:%d", this.Sid, this.Gno)
+	}
+	return fmt.Sprintf("%d-%d-%d", this.DomainID, this.ServerID, this.SeqNo)
+}
+
+func FormatGtidSid(sid []byte) string {
+	if len(sid) != 16 {
+		return fmt.Sprintf("%x", sid)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sid[0:4], sid[4:6], sid[6:8], sid[8:10], sid[10:16])
+}
+
+// mysql.MariadbGTID of go-mysql supports only one domain, this is the gtid set of multiple domains,
+// like gtid_slave_pos: domain-server-seq,domain-server-seq. it contains all gtids of the domain with sequence number <= seq
+type MariadbGtidSet map[uint32]mysql.MariadbGTID
+
+func ParseMariadbGtidSet(str string) (MariadbGtidSet, error) {
+	set := MariadbGtidSet{}
+	for _, one := range CommaSeparatedListToArray(str) {
+		if err := set.Update(one); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+func (this MariadbGtidSet) String() string {
+	domains := make([]int, 0, len(this))
+	for domain := range this {
+		domains = append(domains, int(domain))
+	}
+	sort.Ints(domains)
+	arr := make([]string, len(domains))
+	for i, domain := range domains {
+		arr[i] = this[uint32(domain)].String()
+	}
+	return strings.Join(arr, ",")
+}
+
+func (this MariadbGtidSet) Encode() []byte {
+	return []byte(this.String())
+}
+
+func (this MariadbGtidSet) Equal(o mysql.GTIDSet) bool {
+	return this.String() == o.String()
+}
+
+func (this MariadbGtidSet) Contain(o mysql.GTIDSet) bool {
+	sub, ok := o.(MariadbGtidSet)
+	if !ok {
+		return false
+	}
+	for domain, gtid := range sub {
+		if one, ok := this[domain]; !ok || one.SequenceNumber < gtid.SequenceNumber {
+			return false
+		}
+	}
+	return true
+}
+
+func (this MariadbGtidSet) Update(gtidStr string) error {
+	set, err := mysql.ParseMariadbGTIDSet(strings.TrimSpace(gtidStr))
+	if err != nil {
+		return err
+	}
+	gtid := set.(mysql.MariadbGTID)
+	this[gtid.DomainID] = gtid
+	return nil
+}
+
+func ParseGtidSetOfFlavor(flavor string, str string) (mysql.GTIDSet, error) {
+	if flavor == mysql.MariaDBFlavor {
+		return ParseMariadbGtidSet(str)
+	}
+	return mysql.ParseMysqlGTIDSet(str)
+}
+
+func IfGtidInSet(set mysql.GTIDSet, gtid MyGtid) bool {
+	switch s := set.(type) {
+	case *mysql.MysqlGTIDSet:
+		uuidSet, ok := s.Sets[gtid.Sid]
+		if !ok {
+			return false
+		}
+		for _, interval := range uuidSet.Intervals {
+			if gtid.Gno >= interval.Start && gtid.Gno < interval.Stop {
+				return true
+			}
+		}
+	case MariadbGtidSet:
+		one, ok := s[gtid.DomainID]
+		return ok && gtid.SeqNo <= one.SequenceNumber
+	}
+	return false
+}
+
+// the gtid is after all gtids of the same server uuid(mysql) or domain(mariadb) in the set
+func IfGtidBeyondSet(set mysql.GTIDSet, gtid MyGtid) bool {
+	switch s := set.(type) {
+	case *mysql.MysqlGTIDSet:
+		uuidSet, ok := s.Sets[gtid.Sid]
+		if !ok || len(uuidSet.Intervals) == 0 {
+			return false
+		}
+		for _, interval := range uuidSet.Intervals {
+			if gtid.Gno < interval.Stop {
+				return false
+			}
+		}
+		return true
+	case MariadbGtidSet:
+		one, ok := s[gtid.DomainID]
+		return ok && gtid.SeqNo > one.SequenceNumber
+	}
+	return false
+}
+
+// filter transactions by --start-gtid --stop-gtid --include-gtids --exclude-gtids.
+// one filter for one binlog stream, because it keeps the gtid of the current transaction
+type GtidFilter struct {
+	startSet   mysql.GTIDSet
+	stopSet    mysql.GTIDSet
+	includeSet mysql.GTIDSet
+	excludeSet mysql.GTIDSet
+	ifSkipTrx  bool
+}
+
+// nil if no gtid option is set
+func NewGtidFilter(cfg ConfCmd) *GtidFilter {
+	if cfg.StartGtidSet == nil && cfg.StopGtidSet == nil && cfg.IncludeGtidSet == nil && cfg.ExcludeGtidSet == nil {
+		return nil
+	}
+	return &GtidFilter{startSet: cfg.StartGtidSet, stopSet: cfg.StopGtidSet,
+		includeSet: cfg.IncludeGtidSet, excludeSet: cfg.ExcludeGtidSet}
+}
+
+// the gtid of gtid event of mysql or mariadb, false for other events
+func GetGtidOfBinEvent(header *replication.EventHeader, e replication.Event) (MyGtid, bool) {
+	switch ev := e.(type) {
+	case *replication.GTIDEvent:
+		return MyGtid{Sid: FormatGtidSid(ev.SID), Gno: ev.GNO}, true
+	case *replication.MariadbGTIDEvent:
+		// server id of mariadb gtid is the server id of event header
+		return MyGtid{DomainID: ev.GTID.DomainID, ServerID: header.ServerID, SeqNo: ev.GTID.SequenceNumber}, true
+	}
+	return MyGtid{}, false
+}
+
+// trxGtid keeps the gtid of the current transaction, empty for anonymous transaction(gtid_mode=off)
+func UpdateTrxGtid(header *replication.EventHeader, e replication.Event, trxGtid *string) {
+	if gtid, ok := GetGtidOfBinEvent(header, e); ok {
+		*trxGtid = gtid.String()
+	} else if header.EventType == replication.ANONYMOUS_GTID_EVENT {
+		*trxGtid = ""
+	}
+}
+
+func (this *GtidFilter) CheckEvent(header *replication.EventHeader, e replication.Event) int {
+	// process: 0, continue: 1, break: 2
+	if gtid, ok := GetGtidOfBinEvent(header, e); ok {
+		return this.CheckGtid(gtid)
+	}
+	if header.EventType == replication.ANONYMOUS_GTID_EVENT {
+		// gtid_mode=off, transactions without gtid are not included
+		this.ifSkipTrx = this.includeSet != nil
+		return RE_CONTINUE
+	}
+	for _, tp := range G_Non_Trx_Event_Types {
+		if header.EventType == tp {
+			return RE_PROCESS
+		}
+	}
+	if this.ifSkipTrx {
+		return RE_CONTINUE
+	}
+	return RE_PROCESS
+}
+
+func (this *GtidFilter) CheckGtid(gtid MyGtid) int {
+	if this.stopSet != nil && IfGtidBeyondSet(this.stopSet, gtid) {
+		return RE_BREAK
+	}
+	this.ifSkipTrx = false
+	if this.startSet != nil && IfGtidInSet(this.startSet, gtid) {
+		// executed already
+		this.ifSkipTrx = true
+	} else if this.excludeSet != nil && IfGtidInSet(this.excludeSet, gtid) {
+		this.ifSkipTrx = true
+	} else if this.includeSet != nil && !IfGtidInSet(this.includeSet, gtid) {
+		this.ifSkipTrx = true
+	}
+	if this.ifSkipTrx {
+		return RE_CONTINUE
+	}
+	return RE_PROCESS
+}
+
+func ParseGtidOption(flavor string, str string, opt string) mysql.GTIDSet {
+	if str == "" {
+		return nil
+	}
+	set, err := ParseGtidSetOfFlavor(flavor, str)
+	if err != nil {
+		CheckErr(err, "invalid "+opt, ERR_INVALID_OPTION, true)
+	}
+	return set
+}
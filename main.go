@@ -5,8 +5,6 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
-
-	"github.com/siddontang/go-mysql/replication"
 )
 
 func main() {
@@ -17,22 +15,25 @@ func main() {
 
 	GetTblDefFromDbAndMergeAndDump(cfg)
 
-	if cfg.WorkType != "stats" {
-		G_HandlingBinEventIndex = &BinEventHandlingIndx{EventIdx: 1, finished: false}
-	}
-
 	eventChan := make(chan MyBinEvent, cfg.Threads*2)
 	statChan := make(chan BinEventStats, cfg.Threads*2)
 	sqlChan := make(chan ForwardRollbackSqlOfPrint, cfg.Threads*2)
+	if cfg.WorkType != "stats" {
+		G_SqlReorderBuffer = NewSqlReorderBuffer(uint64(cfg.Threads*SQL_REORDER_WINDOW_PER_THREAD), sqlChan)
+	}
 	var wg, wgGenSql sync.WaitGroup
 
 	// stats file
-	statFH, ddlFH, biglongFH := OpenStatsResultFiles(cfg)
-	defer statFH.Close()
-	defer ddlFH.Close()
-	defer biglongFH.Close()
-	wg.Add(1)
-	go ProcessBinEventStats(statFH, ddlFH, biglongFH, cfg, statChan, &wg)
+	if !cfg.IfBackupOnly() {
+		statFH, ddlFH, biglongFH, trxFH, xaFH := OpenStatsResultFiles(cfg)
+		defer statFH.Close()
+		defer ddlFH.Close()
+		defer biglongFH.Close()
+		defer trxFH.Close()
+		defer xaFH.Close()
+		wg.Add(1)
+		go ProcessBinEventStats(statFH, ddlFH, biglongFH, trxFH, xaFH, cfg, statChan, &wg)
+	}
 
 	if cfg.WorkType != "stats" {
 		// write forward or rollback sql to file
@@ -43,7 +44,7 @@ func main() {
 		g_threads_finished.threadsCnt = cfg.Threads
 		for i := uint(0); i < cfg.Threads; i++ {
 			wgGenSql.Add(1)
-			go GenForwardRollbackSqlFromBinEvent(i, cfg, eventChan, sqlChan, &wgGenSql)
+			go GenForwardRollbackSqlFromBinEvent(i, cfg, eventChan, &wgGenSql)
 		}
 
 	}
@@ -52,8 +53,6 @@ func main() {
 		ParserAllBinEventsFromRepl(cfg, eventChan, statChan)
 	} else if cfg.Mode == "file" {
 		myParser := BinFileParser{}
-		myParser.parser = replication.NewBinlogParser()
-		myParser.parser.SetParseTime(true) // go time type for mysql datetime/time column
 		myParser.MyParseAllBinlogFiles(cfg, eventChan, statChan)
 	}
 
@@ -73,7 +72,7 @@ func GetTblDefFromDbAndMergeAndDump(cfg ConfCmd) {
 	if cfg.WorkType == "tbldef" {
 		ifNeedGetTblDefFromDb = true
 	}
-	if cfg.WorkType != "stats" && !cfg.OnlyColFromFile {
+	if cfg.WorkType != "stats" && !cfg.OnlyColFromFile && !cfg.OnlyBinlogMeta {
 		ifNeedGetTblDefFromDb = true
 	}
 
@@ -98,12 +97,16 @@ func GetTblDefFromDbAndMergeAndDump(cfg ConfCmd) {
 
 	}
 
-	if cfg.WorkType != "stats" && len(G_TablesColumnsInfo.tableInfos) == 0 {
+	if cfg.WorkType != "stats" && !cfg.OnlyBinlogMeta && len(G_TablesColumnsInfo.tableInfos) == 0 {
 		fmt.Println("-wtype!=stats, but get no table definition info from mysql or local json file!!!\nError Exits!!")
 		os.Exit(ERR_ERROR)
 	}
 
-	if !cfg.OnlyColFromFile {
+	if cfg.DdlHistory && !cfg.OnlyBinlogMeta && cfg.Mode == "file" && (cfg.WorkType == "2sql" || cfg.WorkType == "rollback") {
+		BuildTblDefHistoryFromBinlogs(cfg, &G_TablesColumnsInfo)
+	}
+
+	if !cfg.OnlyColFromFile && !cfg.OnlyBinlogMeta {
 		(&G_TablesColumnsInfo).DumpTblInfoJsonToFile(dFile)
 		fmt.Printf("table definition has been dumped to %s\n", dFile)
 	}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/toolkits/file"
+)
+
+const (
+	// the same as mysql client
+	MYSQL_PWD_ENV        = "MYSQL_PWD"
+	MYSQL_LOGIN_FILE     = ".mylogin.cnf"
+	MYSQL_LOGIN_FILE_ENV = "MYSQL_TEST_LOGIN_FILE"
+
+	// 4 bytes unused, then the key of aes-128-ecb to encrypt each line of .mylogin.cnf
+	MYSQL_LOGIN_KEY_OFFSET = 4
+	MYSQL_LOGIN_KEY_LEN    = 20
+
+	MYSQL_OPTION_FILE_MAX_INCLUDE = 10 // depth of !include !includedir
+)
+
+// groups read from option files, later ones take priority. the group of --login-path is the last one
+var Mysql_Option_Groups []string = []string{"client", "binlog_inspector"}
+
+// options read from option files, name => option of command line
+var Mysql_Option_File_Keys map[string]string = map[string]string{
+	"host":     "host",
+	"port":     "port",
+	"user":     "user",
+	"password": "password",
+	"socket":   "socket",
+	"ssl-mode": "ssl-mode",
+	"ssl-ca":   "ssl-ca",
+	"ssl-cert": "ssl-cert",
+	"ssl-key":  "ssl-key",
+}
+
+// one option of an option file, like password=xxx. IfNoValue is true for a single "password" which means to prompt for it
+type MysqlOption struct {
+	Value     string
+	IfNoValue bool
+	Source    string
+}
+
+// options of the groups wanted, option names with "_" are converted to "-"
+type MysqlOptions map[string]MysqlOption
+
+// read option file of mysql like my.cnf, with [group], name=value, #comment, ;comment, !include and !includedir
+func (this MysqlOptions) ReadOptionFile(fileName string, groups []string) error {
+	content, err := file.ToBytes(fileName)
+	if err != nil {
+		return errors.Annotatef(err, "fail to read option file %s", fileName)
+	}
+	return this.parseOptions(fileName, content, groups, 0)
+}
+
+// read the login path file of mysql_config_editor, it is encrypted
+func (this MysqlOptions) ReadLoginFile(fileName string, groups []string) error {
+	content, err := file.ToBytes(fileName)
+	if err != nil {
+		return errors.Annotatef(err, "fail to read login path file %s", fileName)
+	}
+	plain, err := DecryptMysqlLoginFile(content)
+	if err != nil {
+		return errors.Annotatef(err, "fail to decrypt login path file %s", fileName)
+	}
+	// no !include in it
+	return this.parseOptions(fileName, plain, groups, MYSQL_OPTION_FILE_MAX_INCLUDE)
+}
+
+func (this MysqlOptions) parseOptions(fileName string, content []byte, groups []string, depth int) error {
+	inGroup := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '!' {
+			if err := this.parseDirective(fileName, line, groups, depth); err != nil {
+				return err
+			}
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return errors.Errorf("invalid group at line %d of %s: %s", lineNum, fileName, line)
+			}
+			inGroup = CheckElementOfSliceStr(groups, strings.TrimSpace(line[1:end]), "", false)
+			continue
+		}
+		if !inGroup {
+			continue
+		}
+		name, value, hasValue := line, "", false
+		if eq := strings.IndexByte(line, '='); eq >= 0 {
+			name, value, hasValue = strings.TrimSpace(line[:eq]), strings.TrimSpace(line[eq+1:]), true
+		}
+		name = strings.Replace(strings.ToLower(name), "_", "-", -1)
+		if _, ok := Mysql_Option_File_Keys[name]; !ok {
+			continue
+		}
+		value, err := UnquoteMysqlOptionValue(value)
+		if err != nil {
+			return errors.Annotatef(err, "invalid value of %s at line %d of %s", name, lineNum, fileName)
+		}
+		this[name] = MysqlOption{Value: value, IfNoValue: !hasValue, Source: fileName}
+	}
+	return errors.Annotatef(scanner.Err(), "fail to read option file %s", fileName)
+}
+
+func (this MysqlOptions) parseDirective(fileName string, line string, groups []string, depth int) error {
+	var directive, arg string
+	if sp := strings.IndexAny(line, " \t"); sp > 0 {
+		directive, arg = line[:sp], strings.TrimSpace(line[sp+1:])
+	} else {
+		directive = line
+	}
+	if directive != "!include" && directive != "!includedir" {
+		return nil
+	}
+	if depth >= MYSQL_OPTION_FILE_MAX_INCLUDE {
+		return errors.Errorf("too many nested %s in %s", directive, fileName)
+	}
+	if arg != "" && !filepath.IsAbs(arg) {
+		arg = filepath.Join(filepath.Dir(fileName), arg)
+	}
+	var files []string
+	if directive == "!include" {
+		files = []string{arg}
+	} else {
+		// only *.cnf in the dir, in name order
+		entries, err := ioutil.ReadDir(arg)
+		if err != nil {
+			return errors.Annotatef(err, "fail to read dir %s of %s", arg, fileName)
+		}
+		for _, fi := range entries {
+			if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".cnf") {
+				files = append(files, filepath.Join(arg, fi.Name()))
+			}
+		}
+		sort.Strings(files)
+	}
+	for _, f := range files {
+		content, err := file.ToBytes(f)
+		if err != nil {
+			return errors.Annotatef(err, "fail to read option file %s included by %s", f, fileName)
+		}
+		if err = this.parseOptions(f, content, groups, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// value of option file, quoted by ' or " with escapes like \n \\, or unquoted with a trailing #comment
+func UnquoteMysqlOptionValue(value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+	if quote := value[0]; quote == '\'' || quote == '"' {
+		end := strings.LastIndexByte(value, quote)
+		if end == 0 {
+			return "", errors.Errorf("unterminated quote in %s", value)
+		}
+		value = value[1:end]
+	} else if cm := strings.Index(value, " #"); cm >= 0 {
+		value = strings.TrimSpace(value[:cm])
+	} else if cm = strings.Index(value, "\t#"); cm >= 0 {
+		value = strings.TrimSpace(value[:cm])
+	}
+	if strings.IndexByte(value, '\\') < 0 {
+		return value, nil
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i == len(value)-1 {
+			buf.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'b':
+			buf.WriteByte('\b')
+		case 't':
+			buf.WriteByte('\t')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 's':
+			buf.WriteByte(' ')
+		case '\\', '\'', '"':
+			buf.WriteByte(value[i])
+		default:
+			buf.WriteByte('\\')
+			buf.WriteByte(value[i])
+		}
+	}
+	return buf.String(), nil
+}
+
+// .mylogin.cnf of mysql_config_editor: 4 bytes unused, 20 bytes key, then each line as 4 bytes length and the line
+// encrypted by aes-128-ecb with pkcs7 padding. the aes key is the 20 bytes key xor-folded to 16 bytes
+func DecryptMysqlLoginFile(content []byte) ([]byte, error) {
+	if len(content) < MYSQL_LOGIN_KEY_OFFSET+MYSQL_LOGIN_KEY_LEN {
+		return nil, errors.New("login path file is too short")
+	}
+	aesKey := make([]byte, aes.BlockSize)
+	for i, b := range content[MYSQL_LOGIN_KEY_OFFSET : MYSQL_LOGIN_KEY_OFFSET+MYSQL_LOGIN_KEY_LEN] {
+		aesKey[i%aes.BlockSize] ^= b
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var plain bytes.Buffer
+	data := content[MYSQL_LOGIN_KEY_OFFSET+MYSQL_LOGIN_KEY_LEN:]
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("truncated line length")
+		}
+		lineLen := int(binary.LittleEndian.Uint32(data[:4]))
+		data = data[4:]
+		if lineLen == 0 || lineLen%aes.BlockSize != 0 || lineLen > len(data) {
+			return nil, errors.Errorf("invalid encrypted line length %d", lineLen)
+		}
+		line := make([]byte, lineLen)
+		for i := 0; i < lineLen; i += aes.BlockSize {
+			block.Decrypt(line[i:i+aes.BlockSize], data[i:i+aes.BlockSize])
+		}
+		data = data[lineLen:]
+		pad := int(line[lineLen-1])
+		if pad == 0 || pad > aes.BlockSize {
+			return nil, errors.New("invalid padding, wrong key")
+		}
+		plain.Write(line[:lineLen-pad])
+	}
+	return plain.Bytes(), nil
+}
+
+// $MYSQL_TEST_LOGIN_FILE or ~/.mylogin.cnf, the same as mysql client
+func GetMysqlLoginFile() string {
+	if f := os.Getenv(MYSQL_LOGIN_FILE_ENV); f != "" {
+		return f
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		u, err := user.Current()
+		if err != nil {
+			return ""
+		}
+		home = u.HomeDir
+	}
+	return filepath.Join(home, MYSQL_LOGIN_FILE)
+}
+
+// read password from terminal without echo. if stdin is not a terminal, read the first line of it
+func PromptPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	stty := exec.Command("stty", "-echo")
+	stty.Stdin = os.Stdin
+	if stty.Run() == nil {
+		defer func() {
+			echo := exec.Command("stty", "echo")
+			echo.Stdin = os.Stdin
+			echo.Run()
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.Annotate(err, "fail to read password")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// options given on command line, and the ones set from --config
+func GetCmdOptionsSet() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// --defaults-file --login-path --ask-pass and $MYSQL_PWD, before checking --user --password --ssl-xxx.
+// options on command line and --config take priority over option files, then $MYSQL_PWD for password
+func (this *ConfCmd) CheckCredentialOptions() {
+	if this.AskPass && this.Passwd != "" {
+		fmt.Println("--ask-pass and --password cannot be set together")
+		os.Exit(ERR_OPTION_MISMATCH)
+	}
+
+	// the same order as mysql client, .mylogin.cnf is read last
+	groups := Mysql_Option_Groups
+	if this.LoginPath != "" {
+		groups = append(append([]string{}, Mysql_Option_Groups...), this.LoginPath)
+	}
+	opts := MysqlOptions{}
+	if this.DefaultsFile != "" {
+		if !file.IsFile(this.DefaultsFile) {
+			fmt.Printf("%s doesnot exists nor a file\n", this.DefaultsFile)
+			os.Exit(ERR_FILE_NOT_EXISTS)
+		}
+		err := opts.ReadOptionFile(this.DefaultsFile, groups)
+		CheckErr(err, "invalid --defaults-file", ERR_FILE_READ, true)
+	}
+	if this.LoginPath != "" {
+		loginFile := GetMysqlLoginFile()
+		if loginFile == "" || !file.IsFile(loginFile) {
+			fmt.Printf("login path file %s of --login-path not exists\n", loginFile)
+			os.Exit(ERR_FILE_NOT_EXISTS)
+		}
+		err := opts.ReadLoginFile(loginFile, groups)
+		CheckErr(err, "invalid login path file of --login-path", ERR_FILE_READ, true)
+	}
+
+	cmdSet := GetCmdOptionsSet()
+	fileSocket := false
+	for name, opt := range opts {
+		cmdName := Mysql_Option_File_Keys[name]
+		if cmdSet[cmdName] {
+			continue
+		}
+		if name == "socket" && (cmdSet["host"] || cmdSet["port"]) {
+			// host and port on command line, not the socket of option file
+			continue
+		}
+		if (name == "host" || name == "port") && cmdSet["socket"] {
+			continue
+		}
+		if name == "password" && this.AskPass {
+			continue
+		}
+		switch name {
+		case "host":
+			this.Host = opt.Value
+		case "port":
+			port, err := strconv.ParseUint(opt.Value, 10, 16)
+			CheckErr(err, fmt.Sprintf("invalid port %s in %s", opt.Value, opt.Source), ERR_NUMBER_PARSE, true)
+			this.Port = uint(port)
+		case "user":
+			this.User = opt.Value
+		case "password":
+			// a single "password" without value means to prompt for it, the same as mysql client
+			this.Passwd = opt.Value
+			this.AskPass = opt.IfNoValue
+		case "socket":
+			this.Socket = opt.Value
+			fileSocket = true
+		case "ssl-mode":
+			this.SslMode = opt.Value
+		case "ssl-ca":
+			this.SslCa = opt.Value
+		case "ssl-cert":
+			this.SslCert = opt.Value
+		case "ssl-key":
+			this.SslKey = opt.Value
+		}
+	}
+
+	if fileSocket && opts["host"].Value != "" && this.Host != "localhost" {
+		// the same as mysql client, socket is for localhost only
+		this.Socket = ""
+	}
+
+	if this.AskPass {
+		var err error
+		this.Passwd, err = PromptPassword("Enter password: ")
+		CheckErr(err, "fail to get password of --ask-pass", ERR_INVALID_OPTION, true)
+	} else if this.Passwd == "" {
+		this.Passwd = os.Getenv(MYSQL_PWD_ENV)
+	}
+}
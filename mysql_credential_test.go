@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// .mylogin.cnf in the format of mysql_config_editor(4 bytes unused, 20 bytes key, then each line with its length, aes-128-ecb),
+// with the key 0x30..0x43, encrypted by openssl enc -aes-128-ecb line by line. the same lines as written by
+// "mysql_config_editor set --user=root --password" and "mysql_config_editor set --login-path=test --user=repl --password
+// --host=db1.example.com --port=3307 --socket='/tmp/my sql.sock'"
+const mysqlLoginFileTestHex = "00000000303132333435363738393a3b3c3d3e3f404142431000000068a7f84c9a1da06a385d44329b69afb910000000" +
+	"3bf6c5f67c5e02a44158505840c276fb20000000b14eb1dd463ad6610e65d032bf41afe39e9d74fa14e243e65d41eb5c" +
+	"3feb7772100000007573ce95eadcd2f16e7fa5d5e30b40fe1000000035d87fe6f9da36cef0f24973c293b98d20000000" +
+	"47fc7c107efbae18ae6b6ed72abb263ead58ffb90adcebcf86e5026c6653c6f62000000045bc9c25b0a0d1aae23d7132" +
+	"054c091e58a7685762cd7656d54002377aa42bb710000000d319385844432335d7273e7d916214fd20000000f5df57aa" +
+	"65f33529b70198ac5883178b46db7c2eaa8dd03643d5d453e3ac2614"
+
+func TestDecryptMysqlLoginFile(t *testing.T) {
+	content, err := hex.DecodeString(mysqlLoginFileTestHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := DecryptMysqlLoginFile(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[client]\nuser = \"root\"\npassword = \"c#l'i\"\n[test]\nuser = \"repl\"\npassword = \"p#ss w\"\n" +
+		"host = \"db1.example.com\"\nport = 3307\nsocket = \"/tmp/my sql.sock\"\n"
+	if string(plain) != expected {
+		t.Errorf("expect %q, got %q", expected, plain)
+	}
+
+	dir, err := ioutil.TempDir("", "mysql_credential_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	loginFile := filepath.Join(dir, MYSQL_LOGIN_FILE)
+	if err = ioutil.WriteFile(loginFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts := MysqlOptions{}
+	if err = opts.ReadLoginFile(loginFile, append(Mysql_Option_Groups, "test")); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{"user": "repl", "password": "p#ss w", "host": "db1.example.com", "port": "3307", "socket": "/tmp/my sql.sock"} {
+		if opts[name].Value != value {
+			t.Errorf("%s: expect %q, got %q", name, value, opts[name].Value)
+		}
+	}
+
+	// wrong key, truncated
+	bad := append([]byte{}, content...)
+	bad[MYSQL_LOGIN_KEY_OFFSET] ^= 0xff
+	for _, c := range [][]byte{bad, content[:MYSQL_LOGIN_KEY_OFFSET+MYSQL_LOGIN_KEY_LEN+2], content[:len(content)-1], content[:10]} {
+		if _, err := DecryptMysqlLoginFile(c); err == nil {
+			t.Errorf("%d bytes: expect error", len(c))
+		}
+	}
+}
+
+func TestUnquoteMysqlOptionValue(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{"root", "root"},
+		{"p#ss", "p#ss"},
+		{"secret # comment", "secret"},
+		{"secret\t# comment", "secret"},
+		{"'p#ss w' # comment", "p#ss w"},
+		{`"it's"`, "it's"},
+		{`"a\"b"`, `a"b`},
+		{`''`, ""},
+		{`a\tb\nc\sd`, "a\tb\nc d"},
+		{`C:\\mysql\\my.sock`, `C:\mysql\my.sock`},
+		{`\x\`, `\x\`},
+	}
+	for _, c := range cases {
+		got, err := UnquoteMysqlOptionValue(c.value)
+		if err != nil {
+			t.Errorf("%q: %v", c.value, err)
+			continue
+		}
+		if got != c.expected {
+			t.Errorf("%q: expect %q, got %q", c.value, c.expected, got)
+		}
+	}
+	for _, value := range []string{`"abc`, `'abc`} {
+		if _, err := UnquoteMysqlOptionValue(value); err == nil {
+			t.Errorf("%q: expect error", value)
+		}
+	}
+}
+
+func writeOptionTestFile(t *testing.T, fileName string, content string) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadOptionFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mysql_credential_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	myCnf := filepath.Join(dir, "my.cnf")
+	writeOptionTestFile(t, myCnf, `# comment
+; comment
+[mysqld]
+port = 3306
+user = mysql
+
+[client]
+host = 127.0.0.1
+port = 3307
+user = root
+password = 'old # pass'
+default_character_set = utf8mb4
+!include conf.d/extra.cnf
+!includedir `+filepath.Join(dir, "my.cnf.d")+`
+
+[binlog_inspector]
+ssl_mode = VERIFY_CA
+password
+`)
+	writeOptionTestFile(t, filepath.Join(dir, "conf.d", "extra.cnf"), "[client]\nhost = db1 # included\n")
+	// in name order, only *.cnf
+	writeOptionTestFile(t, filepath.Join(dir, "my.cnf.d", "b.cnf"), "[client]\nsocket = /tmp/b.sock\nssl-ca = /etc/b.pem\n")
+	writeOptionTestFile(t, filepath.Join(dir, "my.cnf.d", "a.cnf"), "[client]\nsocket = /tmp/a.sock\nuser = u_a\n")
+	writeOptionTestFile(t, filepath.Join(dir, "my.cnf.d", "c.cnf.bak"), "[client]\nuser = u_bak\n")
+	writeOptionTestFile(t, filepath.Join(dir, "my.cnf.d", "d.cnf"), "[mysqld]\nsocket = /tmp/d.sock\n")
+
+	opts := MysqlOptions{}
+	if err = opts.ReadOptionFile(myCnf, Mysql_Option_Groups); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for name, opt := range opts {
+		got[name] = opt.Value
+		if opt.IfNoValue {
+			got[name] = "<prompt>"
+		}
+		got[name] += " @" + strings.TrimPrefix(opt.Source, dir)
+	}
+	sep := string(filepath.Separator)
+	expected := map[string]string{
+		"host":     "db1 @" + sep + filepath.Join("conf.d", "extra.cnf"),
+		"port":     "3307 @" + sep + "my.cnf",
+		"user":     "u_a @" + sep + filepath.Join("my.cnf.d", "a.cnf"),
+		"password": "<prompt> @" + sep + "my.cnf",
+		"socket":   "/tmp/b.sock @" + sep + filepath.Join("my.cnf.d", "b.cnf"),
+		"ssl-ca":   "/etc/b.pem @" + sep + filepath.Join("my.cnf.d", "b.cnf"),
+		"ssl-mode": "VERIFY_CA @" + sep + "my.cnf",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("\nexpect %v\ngot    %v", expected, got)
+	}
+
+	// errors
+	loop := filepath.Join(dir, "loop.cnf")
+	writeOptionTestFile(t, loop, "[client]\n!include loop.cnf\n")
+	badGroup := filepath.Join(dir, "bad_group.cnf")
+	writeOptionTestFile(t, badGroup, "[client\nuser = root\n")
+	badQuote := filepath.Join(dir, "bad_quote.cnf")
+	writeOptionTestFile(t, badQuote, "[client]\npassword = \"abc\n")
+	noInclude := filepath.Join(dir, "no_include.cnf")
+	writeOptionTestFile(t, noInclude, "!include not_exists.cnf\n")
+	noIncludeDir := filepath.Join(dir, "no_includedir.cnf")
+	writeOptionTestFile(t, noIncludeDir, "!includedir not_exists.d\n")
+	for _, fileName := range []string{loop, badGroup, badQuote, noInclude, noIncludeDir, filepath.Join(dir, "not_exists.cnf")} {
+		if err := (MysqlOptions{}).ReadOptionFile(fileName, Mysql_Option_Groups); err == nil {
+			t.Errorf("%s: expect error", fileName)
+		}
+	}
+}
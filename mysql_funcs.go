@@ -37,8 +37,23 @@ type DdlPosInfo struct {
 //type FieldInfo map[string]string //{"name":"col1", "type":"int"}
 
 type FieldInfo struct {
-	FieldName string `json:"column_name"`
-	FieldType string `json:"column_type"`
+	FieldName  string `json:"column_name"`
+	FieldType  string `json:"column_type"`
+	IsUnsigned bool   `json:"unsigned"`
+	// members of enum/set, in order
+	EnumSetValues []string `json:"enum_set_values,omitempty"`
+}
+
+// colType is COLUMN_TYPE of information_schema.columns, ex: int(10) unsigned, enum('m','f')
+func NewFieldInfoFromColumnType(colName string, dataType string, colType string) FieldInfo {
+	fInfo := FieldInfo{FieldName: colName, FieldType: dataType}
+	dataType = strings.ToLower(dataType)
+	if dataType == "enum" || dataType == "set" {
+		fInfo.EnumSetValues = ParseEnumSetOfColumnType(colType)
+	} else {
+		fInfo.IsUnsigned = strings.Contains(strings.ToLower(colType), "unsigned")
+	}
+	return fInfo
 }
 
 type KeyInfo []string //{colname1, colname2}
@@ -50,6 +65,8 @@ type TblInfoJson struct {
 	PrimaryKey KeyInfo     `json:"primary_key"`
 	UniqueKeys []KeyInfo   `json:"unique_keys"`
 	DdlInfo    DdlPosInfo  `json:"ddl_info"`
+
+	Unknown bool `json:"-"` // rebuilt from ddls but not reliable, ex: columns dropped by ddl cannot be placed
 }
 
 type TablesColumnsInfo struct {
@@ -73,13 +90,13 @@ var (
 		order by k.table_schema asc, k.table_name asc, k.CONSTRAINT_NAME asc, k.ORDINAL_POSITION asc
 	`
 	columnNamesTypesSql string = `
-		select COLUMN_NAME, DATA_TYPE from information_schema.columns
+		select COLUMN_NAME, DATA_TYPE, COLUMN_TYPE from information_schema.columns
 		where table_schema=? and table_name=?
 		order by ORDINAL_POSITION asc
 	`
 
 	columnNamesTypesSqlBatch string = `
-		select table_schema, table_name, COLUMN_NAME, DATA_TYPE, ORDINAL_POSITION from information_schema.columns
+		select table_schema, table_name, COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, ORDINAL_POSITION from information_schema.columns
 		where table_schema in (%s) and table_name in (%s)
 		order by table_schema asc, table_name asc, ORDINAL_POSITION asc
 	`
@@ -124,9 +141,16 @@ func (this TablesColumnsInfo) GetTableInfoJsonOfBinPos(schema string, table stri
 
 	}
 	if nearestKey != "" {
+		if tbDefsArr[nearestKey].Unknown {
+			return &TblInfoJson{}, fmt.Errorf("table struct of %s before DDL at %s:%d is unknown. Skip it, binlog position info: %s",
+				tbKey, tbDefsArr[nearestKey].DdlInfo.Binlog, tbDefsArr[nearestKey].DdlInfo.StartPos, myPos.String())
+		}
 		return tbDefsArr[nearestKey], nil
+	} else if tbDef, ok := tbDefsArr[NoneBinlogPosKey]; ok && tbDef != nil {
+		return tbDef, nil
 	} else {
-		return tbDefsArr[GetBinlogPosAsKey(KEY_NONE_BINLOG, KEY_NONE_POS, KEY_NONE_POS)], nil
+		// only table struct before DDL, ex: the table is renamed or dropped after the rows event
+		return &TblInfoJson{}, fmt.Errorf("table struct not found for %s after the last DDL of it, maybe it was renamed or dropped. Skip it, binlog position info: %s", tbKey, myPos.String())
 	}
 
 }
@@ -224,16 +248,16 @@ func (this *TablesColumnsInfo) GetTableFieldsFromDb(db *sql.DB, schema string, t
 
 	defer rows.Close()
 
-	var colName, dataType string
+	var colName, dataType, colType string
 	var tbInfo []FieldInfo
 	for rows.Next() {
-		err := rows.Scan(&colName, &dataType)
+		err := rows.Scan(&colName, &dataType, &colType)
 
 		if err != nil {
 			CheckErr(err, "fail to get query result of columns info of "+schema+"."+table, ERR_MYSQL_QUERY, false)
 			return err
 		}
-		tbInfo = append(tbInfo, FieldInfo{FieldName: colName, FieldType: dataType})
+		tbInfo = append(tbInfo, NewFieldInfoFromColumnType(colName, dataType, colType))
 
 	}
 
@@ -255,7 +279,7 @@ func (this *TablesColumnsInfo) GetTableFieldsFromDb(db *sql.DB, schema string, t
 
 func (this *TablesColumnsInfo) GetAllTableFieldsFromDb(db *sql.DB, dbTbs map[string][]string, batchCnt int) error {
 	querySqls := GetFieldOrKeyQuerySqls(columnNamesTypesSqlBatch, dbTbs, batchCnt)
-	var dbName, tbName, colName, dataType string
+	var dbName, tbName, colName, dataType, colType string
 	var colPos int
 	var ok bool
 	var dbTbFieldsInfo map[string]map[string][]FieldInfo = map[string]map[string][]FieldInfo{}
@@ -268,7 +292,7 @@ func (this *TablesColumnsInfo) GetAllTableFieldsFromDb(db *sql.DB, dbTbs map[str
 		}
 
 		for rows.Next() {
-			err := rows.Scan(&dbName, &tbName, &colName, &dataType, &colPos)
+			err := rows.Scan(&dbName, &tbName, &colName, &dataType, &colType, &colPos)
 
 			if err != nil {
 				CheckErr(err, "fail to read result of query:"+oneQuery, ERR_MYSQL_QUERY, false)
@@ -282,7 +306,7 @@ func (this *TablesColumnsInfo) GetAllTableFieldsFromDb(db *sql.DB, dbTbs map[str
 			if !ok {
 				dbTbFieldsInfo[dbName][tbName] = []FieldInfo{}
 			}
-			dbTbFieldsInfo[dbName][tbName] = append(dbTbFieldsInfo[dbName][tbName], FieldInfo{FieldName: colName, FieldType: dataType})
+			dbTbFieldsInfo[dbName][tbName] = append(dbTbFieldsInfo[dbName][tbName], NewFieldInfoFromColumnType(colName, dataType, colType))
 
 		}
 		rows.Close()
@@ -557,6 +581,9 @@ func GetMysqlUrl(cfg ConfCmd) string {
 			"%s:%s@unix(%s)/?autocommit=true&charset=utf8mb4,utf8&loc=Local&parseTime=true&writeTimeout=30s&readTimeout=30s&timeout=10s",
 			cfg.User, cfg.Passwd, cfg.Socket)
 	}
+	if tlsParam := cfg.GetMysqlUrlTlsParam(); tlsParam != "" {
+		urlStr += "&tls=" + tlsParam
+	}
 
 	return urlStr
 
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
+	"github.com/toolkits/file"
+)
+
+// --ssl-mode, the same as mysql client
+const (
+	SSL_MODE_DISABLED        = "DISABLED"
+	SSL_MODE_PREFERRED       = "PREFERRED"
+	SSL_MODE_REQUIRED        = "REQUIRED"
+	SSL_MODE_VERIFY_CA       = "VERIFY_CA"
+	SSL_MODE_VERIFY_IDENTITY = "VERIFY_IDENTITY"
+
+	// name of the tls config registered to go-sql-driver/mysql
+	MYSQL_DRIVER_TLS_CONFIG = "binlog_inspector"
+)
+
+var Opts_Valid_Ssl_Mode []string = []string{SSL_MODE_DISABLED, SSL_MODE_PREFERRED, SSL_MODE_REQUIRED, SSL_MODE_VERIFY_CA, SSL_MODE_VERIFY_IDENTITY}
+
+// tls config of --ssl-mode --ssl-ca --ssl-cert --ssl-key, nil for DISABLED.
+// the server certificate is verified with VERIFY_CA and VERIFY_IDENTITY only, and host name with VERIFY_IDENTITY only
+func GetTlsConfig(sslMode string, host string, caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	if sslMode == SSL_MODE_DISABLED {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{ServerName: host}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "fail to load client certificate %s and key %s", certFile, keyFile)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	var rootCAs *x509.CertPool
+	if caFile != "" {
+		caBytes, err := file.ToBytes(caFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "fail to read ca file %s", caFile)
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, errors.Errorf("no valid certificate in ca file %s", caFile)
+		}
+	}
+
+	switch sslMode {
+	case SSL_MODE_PREFERRED, SSL_MODE_REQUIRED:
+		tlsCfg.InsecureSkipVerify = true
+	case SSL_MODE_VERIFY_CA:
+		// verify the certificate chain without the host name
+		tlsCfg.InsecureSkipVerify = true
+		tlsCfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return VerifyServerCertificate(rawCerts, rootCAs)
+		}
+	case SSL_MODE_VERIFY_IDENTITY:
+		tlsCfg.RootCAs = rootCAs
+	}
+	return tlsCfg, nil
+}
+
+// the first one of rawCerts is the server certificate, the others are intermediates. rootCAs is nil for the system ones
+func VerifyServerCertificate(rawCerts [][]byte, rootCAs *x509.CertPool) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errors.Annotate(err, "fail to parse server certificate")
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return errors.New("no server certificate")
+	}
+	opts := x509.VerifyOptions{Roots: rootCAs, Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return errors.Annotate(err, "fail to verify server certificate")
+}
+
+// value of tls in dsn of go-sql-driver/mysql, empty for DISABLED
+func (this ConfCmd) GetMysqlUrlTlsParam() string {
+	switch {
+	case this.TlsConfig == nil:
+		return ""
+	case this.SslMode == SSL_MODE_PREFERRED:
+		// plain connection if the server does not support TLS
+		return "preferred"
+	}
+	return MYSQL_DRIVER_TLS_CONFIG
+}
+
+// --ssl-mode --ssl-ca --ssl-cert --ssl-key. without --ssl-mode, VERIFY_CA if --ssl-ca is set, REQUIRED if --ssl-cert is set, otherwise DISABLED
+func (this *ConfCmd) CheckSslOptions() {
+	this.SslMode = strings.ToUpper(this.SslMode)
+	if this.SslMode == "" {
+		if this.SslCa != "" {
+			this.SslMode = SSL_MODE_VERIFY_CA
+		} else if this.SslCert != "" {
+			this.SslMode = SSL_MODE_REQUIRED
+		} else {
+			this.SslMode = SSL_MODE_DISABLED
+		}
+	}
+	CheckElementOfSliceStr(Opts_Valid_Ssl_Mode, this.SslMode, "invalid arg for --ssl-mode", true)
+
+	if (this.SslCert == "") != (this.SslKey == "") {
+		fmt.Println("--ssl-cert and --ssl-key must be set together")
+		os.Exit(ERR_MISSING_OPTION)
+	}
+	if this.SslMode == SSL_MODE_DISABLED && (this.SslCa != "" || this.SslCert != "") {
+		fmt.Println("--ssl-ca --ssl-cert --ssl-key cannot be set with --ssl-mode=DISABLED")
+		os.Exit(ERR_OPTION_MISMATCH)
+	}
+	for _, f := range []string{this.SslCa, this.SslCert, this.SslKey} {
+		if f != "" && !file.IsFile(f) {
+			fmt.Printf("%s doesnot exists nor a file\n", f)
+			os.Exit(ERR_FILE_NOT_EXISTS)
+		}
+	}
+
+	var err error
+	this.TlsConfig, err = GetTlsConfig(this.SslMode, this.Host, this.SslCa, this.SslCert, this.SslKey)
+	CheckErr(err, "invalid --ssl-ca --ssl-cert --ssl-key", ERR_INVALID_OPTION, true)
+	if this.TlsConfig != nil && this.SslMode != SSL_MODE_PREFERRED {
+		err = mysqlDriver.RegisterTLSConfig(MYSQL_DRIVER_TLS_CONFIG, this.TlsConfig)
+		CheckErr(err, "fail to register tls config", ERR_INVALID_OPTION, true)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/siddontang/go-mysql/replication"
+)
+
+var RegexpMatchLineBreaks *regexp.Regexp = regexp.MustCompile(`\s*[\r\n]+\s*`)
+
+// the original sql of rows events, from ROWS_QUERY_EVENT of mysql(binlog_rows_query_log_events=ON)
+// or MARIADB_ANNOTATE_ROWS_EVENT of mariadb(binlog_annotate_row_events=ON).
+// originalSql keeps it until the end of the statement, return the original sql of the rows event,
+// empty for other events or without --original-sql
+func GetOriginalSqlOfEvent(cfg ConfCmd, e replication.Event, originalSql *string) string {
+	if !cfg.OriginalSql {
+		return ""
+	}
+	switch ev := e.(type) {
+	case *replication.RowsQueryEvent:
+		*originalSql = string(ev.Query)
+	case *replication.MariadbAnnotaeRowsEvent:
+		*originalSql = string(ev.Query)
+	case *replication.RowsEvent:
+		sql := *originalSql
+		if ev.Flags&replication.RowsEventStmtEndFlag > 0 {
+			*originalSql = ""
+		}
+		return sql
+	case *replication.QueryEvent, *replication.XIDEvent:
+		*originalSql = ""
+	}
+	return ""
+}
+
+func GetOriginalSqlOneLine(sql string) string {
+	return strings.TrimSpace(RegexpMatchLineBreaks.ReplaceAllString(sql, " "))
+}
+
+// in one line, it is a comment before the sqls
+func GetOriginalSqlComment(sql string) string {
+	return "# original sql: " + GetOriginalSqlOneLine(sql)
+}
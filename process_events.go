@@ -11,10 +11,12 @@ import (
 
 	//"github.com/davecgh/go-spew/spew"
 	SQL "github.com/dropbox/godropbox/database/sqlbuilder"
+	"github.com/siddontang/go-mysql/mysql"
 	sliceKits "github.com/toolkits/slice"
 )
 
 var G_Time_Column_Types []string = []string{"timestamp", "datetime"}
+var G_Integer_Column_Types []string = []string{"tinyint", "smallint", "mediumint", "int", "bigint"}
 
 type ExtraSqlInfoOfPrint struct {
 	schema    string
@@ -25,6 +27,19 @@ type ExtraSqlInfoOfPrint struct {
 	datetime  string
 	trxIndex  uint64
 	trxStatus int
+	gtid      string
+	xid       string
+	sqlType   string // insert|update|delete, or xa for the end of xa branch with --keep-trx
+
+	originalSql string         // original sql of the rows event, printed as a comment
+	relayPos    mysql.Position // end position in the relay log with --relay-log
+}
+
+// --keep-trx state of one result file, a trx or xa branch may write to several files with --file-each-table
+type KeepTrxStateOfFile struct {
+	trxIndex uint64 // trx of the last sql written to the file
+	xid      string // xa branch of the last sql, not ended yet
+	trxEnded bool   // the trx of the last sql is ended by XA PREPARE|COMMIT|ROLLBACK already
 }
 
 type ForwardRollbackSqlOfPrint struct {
@@ -48,15 +63,56 @@ func PrintExtraInfoForForwardRollbackupSql(cfg ConfCmd, sqlChan chan ForwardRoll
 	var bufFH *bufio.Writer
 	var err error
 	var rollbackFiles []map[string]string //{"tmp":xx, "rollback":xx}
-	var lastTrxIndex uint64 = 0
-	var trxStr string = "commit;\nbegin;\n"
-	//var trxStrLen int = len(trxStr)
+	var trxBeginStr string = "begin;\n"
 	var trxCommitStr string = "commit;\n"
 	//var trxCommitStrLen int = len(trxCommitStr)
 	bytesCntFiles := map[string][][]int{} //{"file1":{{8, 0}, {8 , 0}}} {length of bytes, trxIndex}
+	// --keep-trx
+	trxStates := map[string]*KeepTrxStateOfFile{}
+	xaFiles := map[string][]string{} // prepared xa branch: files of its sqls
 
 	for sc := range sqlChan {
 		//fmt.Println(sc.sqlInfo)
+		if sc.sqlInfo.sqlType == "xa" {
+			// end of xa branch, in every file it writes to
+			var fns []string
+			for fn, st := range trxStates {
+				if st.xid == sc.sqlInfo.xid && st.trxIndex == sc.sqlInfo.trxIndex {
+					fns = append(fns, fn)
+				}
+			}
+			if len(fns) > 0 {
+				for _, fn := range fns {
+					fhArrBuf[fn].WriteString(GetXaEndSql(sc.sqlInfo.xid, sc.sqlInfo.trxStatus, true))
+					trxStates[fn].xid = ""
+					trxStates[fn].trxEnded = true
+				}
+				if sc.sqlInfo.trxStatus == TRX_STATUS_PREPARE {
+					xaFiles[sc.sqlInfo.xid] = fns
+				}
+			} else if fns, ok := xaFiles[sc.sqlInfo.xid]; ok && sc.sqlInfo.trxStatus != TRX_STATUS_PREPARE {
+				for _, fn := range fns {
+					if st := trxStates[fn]; !st.trxEnded && st.xid == "" {
+						// XA COMMIT|ROLLBACK is not allowed in an active trx
+						fhArrBuf[fn].WriteString(trxCommitStr)
+						st.trxEnded = true
+					}
+					fhArrBuf[fn].WriteString(GetXaEndSql(sc.sqlInfo.xid, sc.sqlInfo.trxStatus, false))
+				}
+				delete(xaFiles, sc.sqlInfo.xid)
+			}
+			continue
+		}
+		if len(sc.sqls) == 0 {
+			// rows event skipped
+			continue
+		}
+		if cfg.KeepTrx && cfg.WorkType == "rollback" && sc.sqlInfo.xid != "" {
+			// the rollback sqls are reversed as plain trx, but the xa branch may be prepared and rolled back later, even in another binlog
+			fmt.Printf("--wtype=rollback --keep-trx does not support xa transactions, but found xa branch %s at (%s, %d). please run without --keep-trx\n",
+				sc.sqlInfo.xid, sc.sqlInfo.binlog, sc.sqlInfo.startpos)
+			os.Exit(ERR_OPTION_MISMATCH)
+		}
 		if cfg.WorkType == "rollback" {
 			tmpFileName = GetForwardRollbackSqlFileName(sc.sqlInfo.schema, sc.sqlInfo.table, cfg.FilePerTable, cfg.OutputDir, true, sc.sqlInfo.binlog, true)
 			rollbackFileName = GetForwardRollbackSqlFileName(sc.sqlInfo.schema, sc.sqlInfo.table, cfg.FilePerTable, cfg.OutputDir, true, sc.sqlInfo.binlog, false)
@@ -66,11 +122,13 @@ func PrintExtraInfoForForwardRollbackupSql(cfg ConfCmd, sqlChan chan ForwardRoll
 		}
 		if _, ok := fhArr[tmpFileName]; !ok {
 
-			FH, err = os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			// tmp file of rollback sqls is of this run only, they are put before the ones of the last run when reversed
+			FH, _, err = OpenResultFile(tmpFileName, cfg.Resumed && cfg.WorkType != "rollback")
 			CheckErr(err, "Fail to open file "+tmpFileName, ERR_FILE_OPEN, true) //os.exit if err
 			bufFH = bufio.NewWriter(FH)
 			fhArrBuf[tmpFileName] = bufFH
 			fhArr[tmpFileName] = FH
+			trxStates[tmpFileName] = &KeepTrxStateOfFile{}
 			if cfg.WorkType == "rollback" {
 				rollbackFiles = append(rollbackFiles, map[string]string{"tmp": tmpFileName, "rollback": rollbackFileName})
 				bytesCntFiles[tmpFileName] = [][]int{}
@@ -79,10 +137,23 @@ func PrintExtraInfoForForwardRollbackupSql(cfg ConfCmd, sqlChan chan ForwardRoll
 		}
 
 		if cfg.KeepTrx {
-			if sc.sqlInfo.trxIndex != lastTrxIndex {
+			if st := trxStates[tmpFileName]; sc.sqlInfo.trxIndex != st.trxIndex {
 				if cfg.WorkType == "2sql" {
-					fhArrBuf[tmpFileName].WriteString(trxStr)
+					if st.xid != "" {
+						// the end of the xa branch is not parsed
+						fhArrBuf[tmpFileName].WriteString(fmt.Sprintf("XA END %s;\n", st.xid))
+					} else if !st.trxEnded {
+						fhArrBuf[tmpFileName].WriteString(trxCommitStr)
+					}
+					if sc.sqlInfo.xid != "" {
+						fhArrBuf[tmpFileName].WriteString(fmt.Sprintf("XA START %s;\n", sc.sqlInfo.xid))
+					} else {
+						fhArrBuf[tmpFileName].WriteString(trxBeginStr)
+					}
+					st.xid = sc.sqlInfo.xid
+					st.trxEnded = false
 				}
+				st.trxIndex = sc.sqlInfo.trxIndex
 
 				/*
 					if cfg.WorkType == "rollback" {
@@ -94,7 +165,6 @@ func PrintExtraInfoForForwardRollbackupSql(cfg ConfCmd, sqlChan chan ForwardRoll
 			}
 		}
 
-		lastTrxIndex = sc.sqlInfo.trxIndex
 		oneSqls = GetForwardRollbackContentLineWithExtra(sc, cfg.PrintExtraInfo)
 		fhArrBuf[tmpFileName].WriteString(oneSqls)
 		if cfg.WorkType == "rollback" {
@@ -111,7 +181,11 @@ func PrintExtraInfoForForwardRollbackupSql(cfg ConfCmd, sqlChan chan ForwardRoll
 	}
 	for fn, bufFH := range fhArrBuf {
 		if cfg.KeepTrx && cfg.WorkType == "2sql" {
-			bufFH.WriteString(trxCommitStr)
+			if st := trxStates[fn]; st.xid != "" {
+				bufFH.WriteString(fmt.Sprintf("XA END %s;\n", st.xid))
+			} else if !st.trxEnded {
+				bufFH.WriteString(trxCommitStr)
+			}
 			/*
 				if cfg.WorkType == "rollback" {
 					bytesCntFiles[fn] = append(bytesCntFiles[fn], []int{trxCommitStrLen, 1})
@@ -132,7 +206,7 @@ func PrintExtraInfoForForwardRollbackupSql(cfg ConfCmd, sqlChan chan ForwardRoll
 
 		for i := 0; i < threadNum; i++ {
 			reWg.Add(1)
-			go ReverseFileGo(filesChan, bytesCntFiles, cfg.KeepTrx, &reWg)
+			go ReverseFileGo(filesChan, bytesCntFiles, cfg.KeepTrx, cfg.Resumed, &reWg)
 		}
 
 		for _, tmpArr := range rollbackFiles {
@@ -146,9 +220,21 @@ func PrintExtraInfoForForwardRollbackupSql(cfg ConfCmd, sqlChan chan ForwardRoll
 
 func GetForwardRollbackContentLineWithExtra(sq ForwardRollbackSqlOfPrint, ifExtra bool) string {
 	if ifExtra {
-		return fmt.Sprintf("# datetime=%s database=%s table=%s binlog=%s startpos=%d stoppos=%d\n%s;\n",
+		gtidStr := ""
+		if sq.sqlInfo.gtid != "" {
+			gtidStr = " gtid=" + sq.sqlInfo.gtid
+		}
+		relayStr := ""
+		if sq.sqlInfo.relayPos.Name != "" {
+			relayStr = fmt.Sprintf(" relaylog=%s relaypos=%d", sq.sqlInfo.relayPos.Name, sq.sqlInfo.relayPos.Pos)
+		}
+		originalSqlStr := ""
+		if sq.sqlInfo.originalSql != "" {
+			originalSqlStr = GetOriginalSqlComment(sq.sqlInfo.originalSql) + "\n"
+		}
+		return fmt.Sprintf("# datetime=%s database=%s table=%s binlog=%s startpos=%d stoppos=%d%s%s\n%s%s;\n",
 			sq.sqlInfo.datetime, sq.sqlInfo.schema, sq.sqlInfo.table, sq.sqlInfo.binlog, sq.sqlInfo.startpos,
-			sq.sqlInfo.endpos, strings.Join(sq.sqls, ";\n"))
+			sq.sqlInfo.endpos, gtidStr, relayStr, originalSqlStr, strings.Join(sq.sqls, ";\n"))
 	} else {
 
 		str := strings.Join(sq.sqls, ";\n") + ";\n"
@@ -188,7 +274,7 @@ func GetForwardRollbackSqlFileName(schema string, table string, filePerTable boo
 
 }
 
-func GenForwardRollbackSqlFromBinEvent(i uint, cfg ConfCmd, evChan chan MyBinEvent, sqlChan chan ForwardRollbackSqlOfPrint, wg *sync.WaitGroup) {
+func GenForwardRollbackSqlFromBinEvent(i uint, cfg ConfCmd, evChan chan MyBinEvent, wg *sync.WaitGroup) {
 	defer wg.Done()
 	//defer g_threads_finished.IncreaseFinishedThreadCnt()
 	//fmt.Println("enter thread", i)
@@ -209,12 +295,24 @@ func GenForwardRollbackSqlFromBinEvent(i uint, cfg ConfCmd, evChan chan MyBinEve
 	}
 	var currentSqlForPrint ForwardRollbackSqlOfPrint
 	for ev := range evChan {
+		if !ev.IfRowsEvent {
+			// end of xa branch
+			G_SqlReorderBuffer.Put(ev.EventIdx, ForwardRollbackSqlOfPrint{sqlInfo: ExtraSqlInfoOfPrint{binlog: ev.MyPos.Name,
+				endpos: ev.MyPos.Pos, trxIndex: ev.TrxIndex, trxStatus: ev.TrxStatus, gtid: ev.Gtid, xid: ev.Xid, sqlType: ev.SqlType, originalSql: ev.OriginalSql, relayPos: ev.RelayPos}})
+			continue
+		}
 		db = string(ev.BinEvent.Table.Schema)
 		tb = string(ev.BinEvent.Table.Table)
-		tbInfo, err = G_TablesColumnsInfo.GetTableInfoJsonOfBinPos(db, tb, ev.MyPos.Name, ev.StartPos, ev.MyPos.Pos)
-		if err != nil {
-			CheckErr(err, "", ERR_BINLOG_EVENT, false)
-			continue
+		if ev.TbMapMeta.HasColumnNames() {
+			// column names of the table map event are exactly the table struct when the rows event is written
+			tbInfo = ev.TbMapMeta.GetTblInfoJson(ev.BinEvent.Table)
+		} else {
+			tbInfo, err = G_TablesColumnsInfo.GetTableInfoJsonOfBinPos(db, tb, ev.MyPos.Name, ev.StartPos, ev.MyPos.Pos)
+			if err != nil {
+				CheckErr(err, "", ERR_BINLOG_EVENT, false)
+				G_SqlReorderBuffer.Put(ev.EventIdx, ForwardRollbackSqlOfPrint{})
+				continue
+			}
 		}
 		colCnt = len(ev.BinEvent.Rows[0])
 		allColNames = GetAllFieldNamesWithDroppedFields(colCnt, tbInfo.Columns)
@@ -222,7 +320,7 @@ func GenForwardRollbackSqlFromBinEvent(i uint, cfg ConfCmd, evChan chan MyBinEve
 		colsTypeNameFromMysql := make([]string, len(colsTypeName))
 		// convert datetime/timestamp type to string
 		for ci, colType := range colsTypeName {
-			colsTypeNameFromMysql[ci] = tbInfo.Columns[ci].FieldType
+			colsTypeNameFromMysql[ci] = allColNames[ci].FieldType
 			if sliceKits.ContainsString(G_Time_Column_Types, colType) {
 				for ri, _ := range ev.BinEvent.Rows {
 					if ev.BinEvent.Rows[ri][ci] == nil {
@@ -262,9 +360,37 @@ func GenForwardRollbackSqlFromBinEvent(i uint, cfg ConfCmd, evChan chan MyBinEve
 
 					}
 				}
+			} else if (colType == "enum" || colType == "set") && len(allColNames[ci].EnumSetValues) > 0 {
+				for ri, _ := range ev.BinEvent.Rows {
+					ev.BinEvent.Rows[ri][ci], err = ConvertEnumSetValue(ev.BinEvent.Rows[ri][ci], colType, allColNames[ci].EnumSetValues)
+					if err != nil {
+						CheckErr(err, fmt.Sprintf("keep the number of %s.%s.%s", db, tb, allColNames[ci].FieldName), ERR_BINEVENT_BODY, false)
+					}
+				}
+			} else if colType == "json" {
+				for ri, _ := range ev.BinEvent.Rows {
+					ev.BinEvent.Rows[ri][ci] = ConvertJsonValue(ev.BinEvent.Rows[ri][ci])
+				}
+			} else if colType == "geometry" {
+				// only mysql 8.0 writes optional metadata of table map event, geometry type of it even with binlog_row_metadata=MINIMAL
+				longLat := cfg.MysqlType == "mysql" && ev.TbMapMeta != nil
+				for ri, _ := range ev.BinEvent.Rows {
+					ev.BinEvent.Rows[ri][ci], err = ConvertGeometryValue(ev.BinEvent.Rows[ri][ci], longLat)
+					if err != nil {
+						CheckErr(err, fmt.Sprintf("keep the raw bytes of %s.%s.%s", db, tb, allColNames[ci].FieldName), ERR_BINEVENT_BODY, false)
+					}
+				}
+			} else if colType == "decimal" {
+				for ri, _ := range ev.BinEvent.Rows {
+					ev.BinEvent.Rows[ri][ci] = ConvertDecimalValue(ev.BinEvent.Rows[ri][ci])
+				}
+			} else if allColNames[ci].IsUnsigned && sliceKits.ContainsString(G_Integer_Column_Types, colType) {
+				for ri, _ := range ev.BinEvent.Rows {
+					ev.BinEvent.Rows[ri][ci] = ConvertUnsignedIntValue(ev.BinEvent.Rows[ri][ci], colType)
+				}
 			} else if colType == "blob" {
 				// text is stored as blob
-				if strings.Contains(strings.ToLower(tbInfo.Columns[ci].FieldType), "text") {
+				if strings.Contains(strings.ToLower(allColNames[ci].FieldType), "text") {
 					for ri, _ := range ev.BinEvent.Rows {
 						if ev.BinEvent.Rows[ri][ci] == nil {
 							continue
@@ -287,9 +413,17 @@ func GenForwardRollbackSqlFromBinEvent(i uint, cfg ConfCmd, evChan chan MyBinEve
 			uniqueKeyIdx = []int{}
 		}
 
-		if ev.SqlType == "insert" {
+		if ifRollback {
+			err = CheckRowsImageForRollback(ev.BinEvent, ev.SqlType, allColNames)
+		} else {
+			err = nil
+		}
+		if err != nil {
+			CheckErr(err, fmt.Sprintf("skip rollback sql of %s.%s %s", db, tb, ev.MyPos.String()), ERR_BINEVENT_BODY, false)
+			sqlArr = []string{}
+		} else if ev.SqlType == "insert" {
 			if ifRollback {
-				sqlArr = GenDeleteSqlsForOneRowsEventRollbackInsert(ev.BinEvent, colsDef, uniqueKeyIdx, cfg.MinColumns, cfg.SqlTblPrefixDb)
+				sqlArr = GenDeleteSqlsForOneRowsEventRollbackInsert(ev.BinEvent, colsDef, colsTypeName, uniqueKeyIdx, cfg.MinColumns, cfg.SqlTblPrefixDb)
 			} else {
 				sqlArr = GenInsertSqlsForOneRowsEvent(ev.BinEvent, colsDef, cfg.InsertRows, false, cfg.SqlTblPrefixDb)
 			}
@@ -298,7 +432,7 @@ func GenForwardRollbackSqlFromBinEvent(i uint, cfg ConfCmd, evChan chan MyBinEve
 			if ifRollback {
 				sqlArr = GenInsertSqlsForOneRowsEventRollbackDelete(ev.BinEvent, colsDef, cfg.InsertRows, cfg.SqlTblPrefixDb)
 			} else {
-				sqlArr = GenDeleteSqlsForOneRowsEvent(ev.BinEvent, colsDef, uniqueKeyIdx, cfg.MinColumns, false, cfg.SqlTblPrefixDb)
+				sqlArr = GenDeleteSqlsForOneRowsEvent(ev.BinEvent, colsDef, colsTypeName, uniqueKeyIdx, cfg.MinColumns, false, cfg.SqlTblPrefixDb)
 			}
 		} else if ev.SqlType == "update" {
 			if ifRollback {
@@ -308,31 +442,16 @@ func GenForwardRollbackSqlFromBinEvent(i uint, cfg ConfCmd, evChan chan MyBinEve
 			}
 		} else {
 			fmt.Println("unsupported query type %s to generate 2sql|rollback sql, it should one of insert|update|delete. %s", ev.SqlType, ev.MyPos.String())
+			G_SqlReorderBuffer.Put(ev.EventIdx, ForwardRollbackSqlOfPrint{})
 			continue
 		}
 		//fmt.Println(sqlArr)
 		currentSqlForPrint = ForwardRollbackSqlOfPrint{sqls: sqlArr,
 			sqlInfo: ExtraSqlInfoOfPrint{schema: db, table: tb, binlog: ev.MyPos.Name, startpos: ev.StartPos, endpos: ev.MyPos.Pos,
 				datetime: GetDatetimeStr(int64(ev.Timestamp), int64(0), DATETIME_FORMAT_NOSPACE),
-				trxIndex: ev.TrxIndex, trxStatus: ev.TrxStatus}}
-
-		for {
-			//fmt.Println("in thread", i)
-			G_HandlingBinEventIndex.lock.Lock()
-			//fmt.Println("handing index:", G_HandlingBinEventIndex.EventIdx, "binevent index:", ev.EventIdx)
-			if G_HandlingBinEventIndex.EventIdx == ev.EventIdx {
-				sqlChan <- currentSqlForPrint
-				G_HandlingBinEventIndex.EventIdx++
-				G_HandlingBinEventIndex.lock.Unlock()
-				//fmt.Println("handing index == binevent index, break")
-				break
-			}
-
-			G_HandlingBinEventIndex.lock.Unlock()
-			time.Sleep(1 * time.Microsecond)
-
-		}
+				trxIndex: ev.TrxIndex, trxStatus: ev.TrxStatus, gtid: ev.Gtid, xid: ev.Xid, sqlType: ev.SqlType, originalSql: ev.OriginalSql, relayPos: ev.RelayPos}}
 
+		G_SqlReorderBuffer.Put(ev.EventIdx, currentSqlForPrint)
 	}
 	//fmt.Println("thread", i, "exits")
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/toolkits/file"
+	sliceKits "github.com/toolkits/slice"
+)
+
+// coordinates of --start-binlog --start-pos --stop-binlog --stop-pos with --relay-log
+const (
+	RELAY_COORDINATE_MASTER = "master"
+	RELAY_COORDINATE_RELAY  = "relay"
+)
+
+// the position the slave sql thread has executed, from relay-log.info or mysql.slave_relay_log_info
+type RelayLogInfo struct {
+	RelayLogName  string
+	RelayLogPos   uint32
+	MasterLogName string
+	MasterLogPos  uint32
+}
+
+// relay-log.info(the first line is the number of lines since mysql 5.6), or output of
+// select * from mysql.slave_relay_log_info, in table, tab separated or vertical(\G) format
+func ReadRelayLogInfo(infoFile string) (*RelayLogInfo, error) {
+	content, err := file.ToString(infoFile)
+	if err != nil {
+		return nil, errors.Annotatef(err, "fail to read relay log info file %s", infoFile)
+	}
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	fields := map[string]string{}
+	if strings.Contains(content, "Relay_log_name") {
+		// dump of mysql.slave_relay_log_info
+		for i, line := range lines {
+			if arr := strings.SplitN(line, ":", 2); len(arr) == 2 && !strings.ContainsAny(line, "\t|") {
+				// Relay_log_name: ./relay-bin.000002
+				fields[strings.TrimSpace(arr[0])] = strings.TrimSpace(arr[1])
+				continue
+			}
+			names := SplitRelayLogInfoTableLine(line)
+			if !sliceKits.ContainsString(names, "Relay_log_name") {
+				continue
+			}
+			for _, valueLine := range lines[i+1:] {
+				values := SplitRelayLogInfoTableLine(valueLine)
+				if len(values) < 2 || len(values) > len(names) {
+					continue // +----+ of table format
+				}
+				// the trailing empty values are trimmed
+				for j, value := range values {
+					fields[names[j]] = value
+				}
+				break
+			}
+			break
+		}
+	} else {
+		if len(lines) > 0 {
+			if _, err := strconv.Atoi(lines[0]); err == nil {
+				// number of lines
+				lines = lines[1:]
+			}
+		}
+		if len(lines) < 4 {
+			return nil, errors.Errorf("invalid relay log info file %s, at least 4 lines: relay log name, relay log pos, master log name, master log pos", infoFile)
+		}
+		fields = map[string]string{"Relay_log_name": lines[0], "Relay_log_pos": lines[1],
+			"Master_log_name": lines[2], "Master_log_pos": lines[3]}
+	}
+
+	info := &RelayLogInfo{RelayLogName: GetBinlogNameOfFile(fields["Relay_log_name"]),
+		MasterLogName: GetBinlogNameOfFile(fields["Master_log_name"])}
+	if fields["Relay_log_name"] == "" || fields["Master_log_name"] == "" {
+		return nil, errors.Errorf("no Relay_log_name or Master_log_name in relay log info file %s", infoFile)
+	}
+	for _, one := range []struct {
+		name string
+		pos  *uint32
+	}{{"Relay_log_pos", &info.RelayLogPos}, {"Master_log_pos", &info.MasterLogPos}} {
+		pos, err := strconv.ParseUint(fields[one.name], 10, 32)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid %s in relay log info file %s", one.name, infoFile)
+		}
+		*one.pos = uint32(pos)
+	}
+	return info, nil
+}
+
+// | name1 | name2 | of table format, or name1\tname2 of tab separated format, empty values are kept
+func SplitRelayLogInfoTableLine(line string) []string {
+	sep := "\t"
+	if strings.Contains(line, "|") {
+		sep = "|"
+		line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+	}
+	arr := strings.Split(line, sep)
+	for i := range arr {
+		arr[i] = strings.TrimSpace(arr[i])
+	}
+	return arr
+}
+
+// coordinates of events in one relay log. events from the master keep the end positions of the master binlog,
+// and the binlog name is from the rotate events. events of the relay log itself(LOG_EVENT_RELAY_LOG_F) are not from the master
+type RelayLogTracker struct {
+	relayLog  string
+	relayPos  uint32 // end position of the last event in the relay log
+	masterLog string
+}
+
+func NewRelayLogTracker(relayLog string) *RelayLogTracker {
+	return &RelayLogTracker{relayLog: relayLog, relayPos: uint32(len(replication.BinLogFileHeader))}
+}
+
+// feed every event read from the relay log. rotate events and events of the relay log itself
+// only change the coordinates, RE_CONTINUE is returned for them
+func (this *RelayLogTracker) NextEvent(header *replication.EventHeader, e replication.Event) int {
+	this.relayPos += header.EventSize
+	if header.EventType == replication.ROTATE_EVENT {
+		if rotateEv, ok := e.(*replication.RotateEvent); ok && header.Flags&replication.LOG_EVENT_RELAY_LOG_F == 0 {
+			// the artificial one at the beginning of each relay log, or the one at the end of the master binlog
+			this.masterLog = string(rotateEv.NextLogName)
+		}
+		return RE_CONTINUE
+	}
+	if header.Flags&replication.LOG_EVENT_RELAY_LOG_F > 0 {
+		return RE_CONTINUE
+	}
+	return RE_PROCESS
+}
+
+func (this *RelayLogTracker) MasterLog() string {
+	return this.masterLog
+}
+
+func (this *RelayLogTracker) RelayPos() mysql.Position {
+	return mysql.Position{Name: this.relayLog, Pos: this.relayPos}
+}
+
+// --start-binlog --stop-binlog are binlogs of the master, not the relay log files to parse
+func (this ConfCmd) IfRelayLogByMasterPos() bool {
+	return this.RelayLog && this.RelayCoordinate == RELAY_COORDINATE_MASTER
+}
+
+// --relay-log --relay-coordinate --relay-log-info, before checking --start-binlog --start-pos
+func (this *ConfCmd) CheckRelayLogOptions() {
+	if !this.RelayLog {
+		if this.RelayLogInfo != "" {
+			fmt.Println("--relay-log-info works with --relay-log")
+			os.Exit(ERR_OPTION_MISMATCH)
+		}
+		return
+	}
+	if this.Mode != "file" {
+		fmt.Println("--relay-log works with --mode=file only")
+		os.Exit(ERR_OPTION_MISMATCH)
+	}
+	if this.RelayCoordinate != RELAY_COORDINATE_MASTER && this.RelayCoordinate != RELAY_COORDINATE_RELAY {
+		fmt.Printf("unsupported --relay-coordinate=%s, valid values: %s, %s\n", this.RelayCoordinate, RELAY_COORDINATE_MASTER, RELAY_COORDINATE_RELAY)
+		os.Exit(ERR_INVALID_OPTION)
+	}
+	if this.RelayLogInfo == "" {
+		return
+	}
+	info, err := ReadRelayLogInfo(this.RelayLogInfo)
+	CheckErr(err, "invalid --relay-log-info", ERR_FILE_READ, true)
+	if this.StartFile != "" || this.StartPos != 0 {
+		// --start-binlog --start-pos first
+		return
+	}
+	relayFile := FindBinlogFile(this.BinlogDir, info.RelayLogName)
+	if relayFile == "" {
+		fmt.Printf("relay log %s of --relay-log-info not exists in %s\n", info.RelayLogName, this.BinlogDir)
+		os.Exit(ERR_FILE_NOT_EXISTS)
+	}
+	// parse from the position the slave sql thread has executed
+	this.GivenBinlogFile = relayFile
+	if this.RelayCoordinate == RELAY_COORDINATE_RELAY {
+		this.StartFile, this.StartPos = info.RelayLogName, uint(info.RelayLogPos)
+	} else {
+		this.StartFile, this.StartPos = info.MasterLogName, uint(info.MasterLogPos)
+	}
+	fmt.Printf("start from relay log position (%s, %d), master binlog position (%s, %d) of %s\n",
+		info.RelayLogName, info.RelayLogPos, info.MasterLogName, info.MasterLogPos, this.RelayLogInfo)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/toolkits/file"
+)
+
+const (
+	REPL_CHECKPOINT_FILE     = "repl_checkpoint.json"
+	REPL_CHECKPOINT_INTERVAL = 1 // seconds, the checkpoint file is written at most once in it
+
+	REPL_RECONNECT_MIN_WAIT = 1  // seconds to wait before the first reconnect, doubled after each failure
+	REPL_RECONNECT_MAX_WAIT = 60 // seconds
+
+	REPL_HEARTBEAT_PERIOD = 30 // seconds, master sends heartbeat event when no binlog event in it
+	REPL_READ_TIMEOUT     = 90 // seconds, the connection is considered broken if nothing is read in it
+)
+
+// content of the checkpoint file in --output-dir
+type ReplCheckpointJson struct {
+	Binlog   string `json:"binlog"`
+	Pos      uint32 `json:"position"`
+	GtidSet  string `json:"gtid_set"` // empty if replicating by position
+	Datetime string `json:"datetime"` // of the last transaction
+}
+
+// the end of the last transaction read from master, to reconnect and resume from.
+// gtid set is kept only when replicating by gtid
+type ReplCheckpoint struct {
+	fileName  string
+	flavor    string
+	pos       mysql.Position
+	gtidSet   mysql.GTIDSet
+	timestamp uint32
+	changed   bool
+	lastSave  time.Time
+}
+
+func NewReplCheckpoint(cfg ConfCmd) *ReplCheckpoint {
+	cp := &ReplCheckpoint{fileName: filepath.Join(cfg.OutputDir, REPL_CHECKPOINT_FILE), flavor: cfg.MysqlType,
+		pos: mysql.Position{Name: cfg.StartFile, Pos: uint32(cfg.StartPos)}}
+	if cfg.StartGtidSet != nil {
+		cp.gtidSet = cp.CopyGtidSet(cfg.StartGtidSet)
+	}
+	return cp
+}
+
+// the syncer updates the gtid set given to it, so never share one
+func (this *ReplCheckpoint) CopyGtidSet(set mysql.GTIDSet) mysql.GTIDSet {
+	newSet, err := ParseGtidSetOfFlavor(this.flavor, set.String())
+	CheckErr(err, "fail to copy gtid set "+set.String(), ERR_ERROR, true)
+	return newSet
+}
+
+// position to reconnect from
+func (this *ReplCheckpoint) Position() mysql.Position {
+	return this.pos
+}
+
+// gtid set to reconnect from, nil if replicating by position
+func (this *ReplCheckpoint) GtidSet() mysql.GTIDSet {
+	if this.gtidSet == nil {
+		return nil
+	}
+	return this.CopyGtidSet(this.gtidSet)
+}
+
+func (this *ReplCheckpoint) String() string {
+	if this.gtidSet != nil {
+		return fmt.Sprintf("gtid set %s", this.gtidSet.String())
+	}
+	return fmt.Sprintf("position %s", this.pos.String())
+}
+
+// pos is the end position of the last event of the transaction, gtid is empty for anonymous transaction
+func (this *ReplCheckpoint) TrxEnd(pos mysql.Position, gtid string, timestamp uint32) {
+	this.pos = pos
+	this.timestamp = timestamp
+	if this.gtidSet != nil && gtid != "" {
+		err := this.gtidSet.Update(gtid)
+		CheckErr(err, "fail to add gtid "+gtid+" to checkpoint", ERR_ERROR, false)
+	}
+	this.changed = true
+	if time.Since(this.lastSave) >= REPL_CHECKPOINT_INTERVAL*time.Second {
+		this.Save()
+	}
+}
+
+// write the checkpoint file if changed, write to a temporary file and rename it, never leave a broken one
+func (this *ReplCheckpoint) Save() {
+	if !this.changed {
+		return
+	}
+	cp := ReplCheckpointJson{Binlog: this.pos.Name, Pos: this.pos.Pos}
+	if this.gtidSet != nil {
+		cp.GtidSet = this.gtidSet.String()
+	}
+	if this.timestamp > 0 {
+		cp.Datetime = GetDatetimeStr(int64(this.timestamp), int64(0), DATETIME_FORMAT)
+	}
+	jsonBytes, err := json.MarshalIndent(cp, "", "\t")
+	if err != nil {
+		CheckErr(err, "error when dump repl checkpoint into json string", ERR_JSON_MARSHAL, false)
+		return
+	}
+	tmpFile := this.fileName + ".tmp"
+	if _, err = file.WriteBytes(tmpFile, jsonBytes); err == nil {
+		err = os.Rename(tmpFile, this.fileName)
+	}
+	if err != nil {
+		CheckErr(err, "fail to write repl checkpoint file "+this.fileName, ERR_FILE_WRITE, false)
+		return
+	}
+	this.changed = false
+	this.lastSave = time.Now()
+}
+
+func ReadReplCheckpoint(fileName string) (*ReplCheckpointJson, error) {
+	fBytes, err := file.ToBytes(fileName)
+	if err != nil {
+		return nil, errors.Annotatef(err, "fail to read repl checkpoint file %s", fileName)
+	}
+	cp := &ReplCheckpointJson{}
+	if err = json.Unmarshal(fBytes, cp); err != nil {
+		return nil, errors.Annotatef(err, "fail to unmarshal repl checkpoint file %s", fileName)
+	}
+	if cp.GtidSet == "" && (cp.Binlog == "" || cp.Pos == 0) {
+		return nil, errors.Errorf("no binlog position nor gtid set in repl checkpoint file %s", fileName)
+	}
+	return cp, nil
+}
+
+// --resume, before checking --start-binlog --start-pos --start-gtid. the start options are used if no checkpoint file yet
+func (this *ConfCmd) CheckResumeOptions() {
+	if this.MaxReconnect < 0 {
+		fmt.Printf("--max-reconnect must not be negative, but %d is specified\n", this.MaxReconnect)
+		os.Exit(ERR_OPTION_OUTRANGE)
+	}
+	if !this.Resume {
+		return
+	}
+	if this.Mode != "repl" {
+		fmt.Println("--resume works with --mode=repl only")
+		os.Exit(ERR_OPTION_MISMATCH)
+	}
+	outputDir := this.OutputDir
+	if outputDir == "" {
+		outputDir, _ = os.Getwd()
+	}
+	cpFile := filepath.Join(outputDir, REPL_CHECKPOINT_FILE)
+	if !file.IsFile(cpFile) {
+		fmt.Printf("repl checkpoint file %s not exists, start from --start-binlog --start-pos or --start-gtid\n", cpFile)
+		return
+	}
+	cp, err := ReadReplCheckpoint(cpFile)
+	CheckErr(err, "invalid repl checkpoint file of --resume", ERR_FILE_READ, true)
+	this.Resumed = true
+	if cp.GtidSet != "" {
+		this.StartGtid = cp.GtidSet
+		this.StartFile, this.StartPos = "", 0
+		fmt.Printf("resume from gtid set %s of %s\n", cp.GtidSet, cpFile)
+	} else {
+		this.StartGtid = ""
+		this.StartFile, this.StartPos = cp.Binlog, uint(cp.Pos)
+		fmt.Printf("resume from position (%s, %d) of %s\n", cp.Binlog, cp.Pos, cpFile)
+	}
+}
+
+// result files in --output-dir are appended to when resumed from the checkpoint, otherwise truncated.
+// returns true if the file is empty and needs the header line
+func OpenResultFile(fileName string, resumed bool) (*os.File, bool, error) {
+	openFlag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resumed {
+		openFlag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	fh, err := os.OpenFile(fileName, openFlag, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	if !resumed {
+		return fh, true, nil
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, false, err
+	}
+	return fh, fi.Size() == 0, nil
+}
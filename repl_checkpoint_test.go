@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenResultFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repl_checkpoint_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "binlog_stats.log")
+
+	for _, c := range []struct {
+		resumed  bool
+		ifHeader bool
+		expected string
+	}{
+		{false, true, "header\nrun1\n"},
+		{true, false, "header\nrun1\nrun2\n"},
+		{false, true, "header\nrun3\n"},
+	} {
+		fh, ifHeader, err := OpenResultFile(fileName, c.resumed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifHeader != c.ifHeader {
+			t.Errorf("resumed=%v: expect header %v, got %v", c.resumed, c.ifHeader, ifHeader)
+		}
+		if ifHeader {
+			fh.WriteString("header\n")
+		}
+		fh.WriteString(c.expected[len(c.expected)-5:])
+		fh.Close()
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != c.expected {
+			t.Errorf("resumed=%v: expect %q, got %q", c.resumed, c.expected, content)
+		}
+	}
+
+	// resumed but no result file of the last run
+	fh, ifHeader, err := OpenResultFile(filepath.Join(dir, "ddl_info.log"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	if !ifHeader {
+		t.Error("resumed with a new file, expect header")
+	}
+}
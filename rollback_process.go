@@ -5,11 +5,22 @@ import (
 	"os"
 	"strings"
 	"sync"
+
+	"github.com/toolkits/file"
 )
 
-func ReverseFileGo(rollbackFileChan chan map[string]string, bytesCntFiles map[string][][]int, keepTrx bool, wg *sync.WaitGroup) {
+// when resumed from the checkpoint, rollback sqls of the last run are kept after the ones of this run
+func ReverseFileGo(rollbackFileChan chan map[string]string, bytesCntFiles map[string][][]int, keepTrx bool, resumed bool, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for arr := range rollbackFileChan {
+		lastFile := ""
+		if resumed && file.IsFile(arr["rollback"]) {
+			lastFile = arr["rollback"] + ".last"
+			if err := os.Rename(arr["rollback"], lastFile); err != nil {
+				CheckErr(err, "fail to rename file "+arr["rollback"], ERR_FILE_WRITE, false)
+				continue
+			}
+		}
 		//ReverseFileToNewFile(arr["tmp"], arr["rollback"], batchLines)
 		//ReverseFileToNewFileOneByOneLineAndKeepTrx(arr["tmp"], arr["rollback"])
 		ReverseFileToNewFileOneByOneLineAndKeepTrxBatchRead(arr["tmp"], arr["rollback"], bytesCntFiles[arr["tmp"]], keepTrx)
@@ -17,10 +28,38 @@ func ReverseFileGo(rollbackFileChan chan map[string]string, bytesCntFiles map[st
 		if err != nil {
 			CheckErr(err, "fail to remove file "+arr["tmp"], ERR_FILE_REMOVE, false)
 		}
+		if lastFile == "" {
+			continue
+		}
+		if err = AppendFileToFile(lastFile, arr["rollback"]); err != nil {
+			CheckErr(err, "fail to append rollback sqls of the last run in "+lastFile+" to "+arr["rollback"], ERR_FILE_WRITE, false)
+			continue
+		}
+		if err = os.Remove(lastFile); err != nil {
+			CheckErr(err, "fail to remove file "+lastFile, ERR_FILE_REMOVE, false)
+		}
 	}
 
 }
 
+// append content of srcFile to the end of destFile
+func AppendFileToFile(srcFile string, destFile string) error {
+	srcFH, err := os.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer srcFH.Close()
+	destFH, err := os.OpenFile(destFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(destFH, srcFH); err != nil {
+		destFH.Close()
+		return err
+	}
+	return destFH.Close()
+}
+
 func ReverseFileToNewFileOneByOneLineAndKeepTrxBatchRead(srcFile string, destFile string, trxPoses [][]int, keepTrx bool) error {
 	srcFH, err := os.Open(srcFile)
 	if err != nil {
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReverseFileGoResumed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rollback_process_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		resumed  bool
+		last     string // rollback file of the last run, empty if not exists
+		expected string
+	}{
+		{false, "", "delete 3;\ndelete 2;\ndelete 1;\n"},
+		{false, "delete 0;\n", "delete 3;\ndelete 2;\ndelete 1;\n"},
+		{true, "", "delete 3;\ndelete 2;\ndelete 1;\n"},
+		{true, "delete 0;\n", "delete 3;\ndelete 2;\ndelete 1;\ndelete 0;\n"},
+	} {
+		tmpFile := filepath.Join(dir, ".rollback.1.sql")
+		rollbackFile := filepath.Join(dir, "rollback.1.sql")
+		os.Remove(rollbackFile)
+		if c.last != "" {
+			if err = ioutil.WriteFile(rollbackFile, []byte(c.last), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = ioutil.WriteFile(tmpFile, []byte("delete 1;\ndelete 2;\ndelete 3;\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		bytesCntFiles := map[string][][]int{tmpFile: {{10, 1}, {10, 2}, {10, 2}}}
+
+		var wg sync.WaitGroup
+		filesChan := make(chan map[string]string, 1)
+		wg.Add(1)
+		go ReverseFileGo(filesChan, bytesCntFiles, false, c.resumed, &wg)
+		filesChan <- map[string]string{"tmp": tmpFile, "rollback": rollbackFile}
+		close(filesChan)
+		wg.Wait()
+
+		content, err := ioutil.ReadFile(rollbackFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != c.expected {
+			t.Errorf("resumed=%v last=%q: expect %q, got %q", c.resumed, c.last, c.expected, content)
+		}
+		if _, err = os.Stat(rollbackFile + ".last"); !os.IsNotExist(err) {
+			t.Errorf("resumed=%v last=%q: rollback file of the last run is not removed", c.resumed, c.last)
+		}
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/siddontang/go-mysql/replication"
+)
+
+/*
+表结构历史: 从当前的表结构(information_schema或者json文件)开始， 把binlog中的DDL从后往前反向回放， 得到每个DDL之前的表结构，
+以binlog/startpos/stoppos为key保存到TablesColumnsInfo中， GetTableInfoJsonOfBinPos就可以为每个rows event找到正确的表结构。
+对于在binlog中create的表， 也从create table开始正向回放， 正向回放得到的表结构更准确(知道被drop掉的字段的位置与类型)。
+*/
+
+var RegexpMatchTableDdlQuery *regexp.Regexp = regexp.MustCompile(`(?is)^\s*(/\*.*?\*/\s*)*(alter|create|rename|drop)\s`)
+
+type DdlTbMapInfo struct {
+	ColumnType []byte
+	ColumnMeta []uint16
+}
+
+type DdlEventInfo struct {
+	Binlog     string
+	StartPos   uint32
+	StopPos    uint32
+	Sql        string
+	Statements []DdlStatement
+	TbMaps     map[string]DdlTbMapInfo // db.tb: the last table map event of this table before the ddl
+}
+
+type ddlStmtRef struct {
+	ddl  *DdlEventInfo
+	stmt *DdlStatement
+}
+
+func (this TblInfoJson) Copy() *TblInfoJson {
+	cp := this
+	cp.Columns = make([]FieldInfo, len(this.Columns))
+	copy(cp.Columns, this.Columns)
+	cp.PrimaryKey = make(KeyInfo, len(this.PrimaryKey))
+	copy(cp.PrimaryKey, this.PrimaryKey)
+	cp.UniqueKeys = make([]KeyInfo, len(this.UniqueKeys))
+	for i, k := range this.UniqueKeys {
+		cp.UniqueKeys[i] = make(KeyInfo, len(k))
+		copy(cp.UniqueKeys[i], k)
+	}
+	return &cp
+}
+
+func (this *TblInfoJson) GetColumnIndex(name string) int {
+	for i, f := range this.Columns {
+		if strings.EqualFold(f.FieldName, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (this *TblInfoJson) InsertColumn(idx int, col FieldInfo) {
+	if idx < 0 || idx > len(this.Columns) {
+		idx = len(this.Columns)
+	}
+	this.Columns = append(this.Columns, FieldInfo{})
+	copy(this.Columns[idx+1:], this.Columns[idx:])
+	this.Columns[idx] = col
+}
+
+func (this *TblInfoJson) RemoveColumn(name string) (FieldInfo, bool) {
+	idx := this.GetColumnIndex(name)
+	if idx < 0 {
+		return FieldInfo{}, false
+	}
+	col := this.Columns[idx]
+	this.Columns = append(this.Columns[:idx], this.Columns[idx+1:]...)
+	return col, true
+}
+
+// GetColumnIndexOfPosition returns the index of the column of FIRST | AFTER col_name, -1 if no position specified
+func (this *TblInfoJson) GetColumnIndexOfPosition(col DdlColumnDef) int {
+	if col.First {
+		return 0
+	}
+	if col.After != "" {
+		idx := this.GetColumnIndex(col.After)
+		if idx >= 0 {
+			return idx + 1
+		}
+	}
+	return -1
+}
+
+func (this *TblInfoJson) RenameColumnInKeys(oldName, newName string) {
+	for i, c := range this.PrimaryKey {
+		if strings.EqualFold(c, oldName) {
+			this.PrimaryKey[i] = newName
+		}
+	}
+	for _, k := range this.UniqueKeys {
+		for i, c := range k {
+			if strings.EqualFold(c, oldName) {
+				k[i] = newName
+			}
+		}
+	}
+}
+
+func RemoveColumnFromKey(k KeyInfo, name string) KeyInfo {
+	var nk KeyInfo = KeyInfo{}
+	for _, c := range k {
+		if !strings.EqualFold(c, name) {
+			nk = append(nk, c)
+		}
+	}
+	return nk
+}
+
+func (this *TblInfoJson) RemoveColumnFromKeys(name string) {
+	this.PrimaryKey = RemoveColumnFromKey(this.PrimaryKey, name)
+	var uks []KeyInfo = []KeyInfo{}
+	for _, k := range this.UniqueKeys {
+		nk := RemoveColumnFromKey(k, name)
+		if len(nk) > 0 {
+			uks = append(uks, nk)
+		}
+	}
+	this.UniqueKeys = uks
+}
+
+func (this *TblInfoJson) RemoveUniqueKey(cols KeyInfo) {
+	var uks []KeyInfo = []KeyInfo{}
+	for _, k := range this.UniqueKeys {
+		if strings.ToLower(strings.Join(k, ",")) != strings.ToLower(strings.Join(cols, ",")) {
+			uks = append(uks, k)
+		}
+	}
+	this.UniqueKeys = uks
+}
+
+func (this DdlColumnDef) GetFieldInfo() FieldInfo {
+	return FieldInfo{FieldName: this.Name, FieldType: this.DataType, IsUnsigned: this.Unsigned, EnumSetValues: this.EnumSet}
+}
+
+func NewTblInfoJsonFromCreateDdl(st DdlStatement) *TblInfoJson {
+	tbInfo := &TblInfoJson{Database: st.Schema, Table: st.Table, Columns: []FieldInfo{},
+		PrimaryKey: KeyInfo{}, UniqueKeys: []KeyInfo{}}
+	for _, col := range st.Columns {
+		tbInfo.Columns = append(tbInfo.Columns, col.GetFieldInfo())
+	}
+	if len(st.PrimaryKey) > 0 {
+		tbInfo.PrimaryKey = st.PrimaryKey
+	}
+	for _, k := range st.UniqueKeys {
+		if len(k) > 0 {
+			tbInfo.UniqueKeys = append(tbInfo.UniqueKeys, k)
+		}
+	}
+	return tbInfo
+}
+
+// NewEmptyTblInfoJson is used for the table before it is created or renamed. rows event found before it has no
+// known table definition, all its columns are named as dropped_column_xxx
+func NewEmptyTblInfoJson(schema, table string) *TblInfoJson {
+	return &TblInfoJson{Database: schema, Table: table, Columns: []FieldInfo{}, PrimaryKey: KeyInfo{}, UniqueKeys: []KeyInfo{}}
+}
+
+func (this *TblInfoJson) ApplyAlterSpecForward(spec DdlAlterSpec) {
+	switch spec.Action {
+	case DDL_ALTER_ADD_COLUMN:
+		idx := this.GetColumnIndexOfPosition(spec.Column)
+		this.InsertColumn(idx, spec.Column.GetFieldInfo())
+	case DDL_ALTER_DROP_COLUMN:
+		this.RemoveColumn(spec.OldName)
+		this.RemoveColumnFromKeys(spec.OldName)
+	case DDL_ALTER_CHANGE_COLUMN, DDL_ALTER_MODIFY_COLUMN:
+		idx := this.GetColumnIndex(spec.OldName)
+		if idx < 0 {
+			return
+		}
+		newCol := spec.Column.GetFieldInfo()
+		if spec.Column.First || spec.Column.After != "" {
+			this.RemoveColumn(spec.OldName)
+			this.InsertColumn(this.GetColumnIndexOfPosition(spec.Column), newCol)
+		} else {
+			this.Columns[idx] = newCol
+		}
+		this.RenameColumnInKeys(spec.OldName, spec.Column.Name)
+	case DDL_ALTER_RENAME_COLUMN:
+		idx := this.GetColumnIndex(spec.OldName)
+		if idx >= 0 {
+			this.Columns[idx].FieldName = spec.NewName
+		}
+		this.RenameColumnInKeys(spec.OldName, spec.NewName)
+	case DDL_ALTER_ADD_PRIMARY:
+		this.PrimaryKey = spec.KeyCols
+	case DDL_ALTER_DROP_PRIMARY:
+		this.PrimaryKey = KeyInfo{}
+	case DDL_ALTER_ADD_UNIQUE:
+		this.UniqueKeys = append(this.UniqueKeys, spec.KeyCols)
+	case DDL_ALTER_DROP_INDEX:
+		// we donnot keep the name of unique keys, to be safe, treat all unique keys as dropped
+		this.UniqueKeys = []KeyInfo{}
+	}
+}
+
+// ApplyAlterSpecsBackward undoes all specs of one alter table. columns dropped by it are restored at last, all together,
+// after the other specs are undone. returns false if they cannot be placed reliably
+func (this *TblInfoJson) ApplyAlterSpecsBackward(specs []DdlAlterSpec, tbMap *DdlTbMapInfo) bool {
+	var dropped []string
+	for si := len(specs) - 1; si >= 0; si-- {
+		if specs[si].Action == DDL_ALTER_DROP_COLUMN {
+			dropped = append(dropped, specs[si].OldName)
+			continue
+		}
+		this.ApplyAlterSpecBackward(specs[si])
+	}
+	if len(dropped) == 0 {
+		return true
+	}
+	return this.RestoreDroppedColumns(dropped, tbMap)
+}
+
+func (this *TblInfoJson) ApplyAlterSpecBackward(spec DdlAlterSpec) {
+	switch spec.Action {
+	case DDL_ALTER_ADD_COLUMN:
+		this.RemoveColumn(spec.Column.Name)
+		this.RemoveColumnFromKeys(spec.Column.Name)
+	case DDL_ALTER_CHANGE_COLUMN:
+		idx := this.GetColumnIndex(spec.Column.Name)
+		if idx >= 0 {
+			this.Columns[idx].FieldName = spec.OldName
+		}
+		this.RenameColumnInKeys(spec.Column.Name, spec.OldName)
+	case DDL_ALTER_RENAME_COLUMN:
+		idx := this.GetColumnIndex(spec.NewName)
+		if idx >= 0 {
+			this.Columns[idx].FieldName = spec.OldName
+		}
+		this.RenameColumnInKeys(spec.NewName, spec.OldName)
+	case DDL_ALTER_ADD_PRIMARY:
+		this.PrimaryKey = KeyInfo{}
+	case DDL_ALTER_ADD_UNIQUE:
+		this.RemoveUniqueKey(spec.KeyCols)
+	}
+	// drop column is undone by RestoreDroppedColumns.
+	// modify column, drop primary key, drop index: the old definition is unknown, keep it as it is
+}
+
+// RestoreDroppedColumns puts the dropped columns back by lining up the columns with the table map event before the ddl.
+// the table map tells the positions and types of the dropped columns, but not which name is which, so only one dropped
+// column with exactly one matched position can be restored
+func (this *TblInfoJson) RestoreDroppedColumns(names []string, tbMap *DdlTbMapInfo) bool {
+	if len(names) != 1 || tbMap == nil || len(tbMap.ColumnType) != len(this.Columns)+1 {
+		return false
+	}
+	idx := -1
+	for p := 0; p <= len(this.Columns); p++ {
+		matched := true
+		for i := range this.Columns {
+			mi := i
+			if i >= p {
+				mi = i + 1
+			}
+			if !this.IfColumnMatchTbMap(i, tbMap, mi) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if idx >= 0 {
+			// more than one position, ex: dropped one of the adjacent columns of the same type
+			return false
+		}
+		idx = p
+	}
+	if idx < 0 {
+		return false
+	}
+	typeName, _ := GetMysqlDataTypeNameAndSqlColumn("", names[0], tbMap.ColumnType[idx], tbMap.ColumnMeta[idx])
+	if typeName == "blob" {
+		// text or blob, we cannot tell
+		typeName = UNKNOWN_FIELD_TYPE_NAME
+	}
+	this.InsertColumn(idx, FieldInfo{FieldName: names[0], FieldType: typeName})
+	return true
+}
+
+// column of unknown type matches any type
+func (this *TblInfoJson) IfColumnMatchTbMap(colIdx int, tbMap *DdlTbMapInfo, mapIdx int) bool {
+	col := this.Columns[colIdx]
+	if col.FieldType == UNKNOWN_FIELD_TYPE_NAME {
+		return true
+	}
+	typeName, _ := GetMysqlDataTypeNameAndSqlColumn(col.FieldType, col.FieldName, tbMap.ColumnType[mapIdx], tbMap.ColumnMeta[mapIdx])
+	return typeName == GetBinlogTypeNameOfDataType(col.FieldType)
+}
+
+// GetBinlogTypeNameOfDataType converts DATA_TYPE of information_schema.columns to the type name of GetMysqlDataTypeNameAndSqlColumn
+func GetBinlogTypeNameOfDataType(dataType string) string {
+	switch strings.ToLower(dataType) {
+	case "tinytext", "text", "mediumtext", "longtext", "tinyblob", "blob", "mediumblob", "longblob":
+		return "blob"
+	case "varbinary":
+		return "varchar"
+	case "binary":
+		return "char"
+	case "point", "linestring", "polygon", "multipoint", "multilinestring", "multipolygon", "geometrycollection", "geomcollection":
+		return "geometry"
+	}
+	return strings.ToLower(dataType)
+}
+
+func (this BinFileParser) ScanDdlsOfBinlogFiles(cfg ConfCmd) []DdlEventInfo {
+	var ddls []DdlEventInfo
+	binlog, _ := GetFirstBinlogPosToParse(cfg)
+	// DDLs after the stop position also change the table definition, so scan to the last binlog
+	for {
+		err := this.ScanDdlsOfOneBinlogFile(binlog, &ddls)
+		if err != nil {
+			CheckErr(err, "fail to scan DDLs of "+binlog, ERR_BINLOG_EVENT, false)
+			break
+		}
+		if binlog, err = GetNextBinlogFile(cfg, binlog); err != nil || binlog == "" {
+			break
+		}
+	}
+	return ddls
+}
+
+func (this BinFileParser) ScanDdlsOfOneBinlogFile(name string, ddls *[]DdlEventInfo) error {
+	f, err := OpenBinlogFileAndCheckHeader(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	binlog := GetBinlogNameOfFile(name)
+	tbMaps := map[string]DdlTbMapInfo{}
+	for {
+		h, data, re, err := this.ReadBinEvent(f, binlog)
+		if re == RE_FILE_END {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// only parse the events we need, it is much faster
+		switch h.EventType {
+		case replication.FORMAT_DESCRIPTION_EVENT:
+			if _, err = this.parser.ParseEvent(h, data); err != nil {
+				return err
+			}
+		case replication.TABLE_MAP_EVENT:
+			e, err := this.parser.ParseEvent(h, data)
+			if err != nil {
+				// only used to guess the position of dropped columns
+				continue
+			}
+			tbMap := e.(*replication.TableMapEvent)
+			tbMaps[GetAbsTableName(string(tbMap.Schema), string(tbMap.Table))] = DdlTbMapInfo{
+				ColumnType: append([]byte{}, tbMap.ColumnType...), ColumnMeta: tbMap.ColumnMeta}
+		case replication.QUERY_EVENT:
+			e, err := this.parser.ParseEvent(h, data)
+			if err != nil {
+				return err
+			}
+			queryEvent := e.(*replication.QueryEvent)
+			sql := string(queryEvent.Query)
+			if !RegexpMatchTableDdlQuery.MatchString(sql) {
+				continue
+			}
+			sts := ParseDdlSql(string(queryEvent.Schema), sql)
+			if len(sts) == 0 {
+				continue
+			}
+			ddl := DdlEventInfo{Binlog: binlog, StartPos: h.LogPos - h.EventSize, StopPos: h.LogPos,
+				Sql: sql, Statements: sts, TbMaps: map[string]DdlTbMapInfo{}}
+			for _, st := range sts {
+				tbKey := GetAbsTableName(st.Schema, st.Table)
+				if tm, ok := tbMaps[tbKey]; ok {
+					ddl.TbMaps[tbKey] = tm
+					// table map events before this ddl are useless for the ddls after it
+					delete(tbMaps, tbKey)
+				}
+			}
+			*ddls = append(*ddls, ddl)
+		}
+	}
+}
+
+// BuildTblDefHistoryFromDdls replays the ddls backwards from the current table definitions(_/0/0), saves the table
+// definition before each ddl with key binlog/startpos/stoppos of the ddl. returns count of table definitions added
+func (this *TablesColumnsInfo) BuildTblDefHistoryFromDdls(ddls []DdlEventInfo) int {
+	var refs []ddlStmtRef
+	for i := range ddls {
+		for j := range ddls[i].Statements {
+			if ddls[i].Statements[j].Schema == "" || ddls[i].Statements[j].Table == "" {
+				continue
+			}
+			refs = append(refs, ddlStmtRef{ddl: &ddls[i], stmt: &ddls[i].Statements[j]})
+		}
+	}
+
+	// forward: table definitions before each ddl, for tables created in the binlogs
+	fwdBefore := make([]*TblInfoJson, len(refs))
+	fstate := map[string]*TblInfoJson{}
+	for i, ref := range refs {
+		st := ref.stmt
+		tbKey := GetAbsTableName(st.Schema, st.Table)
+		if cur, ok := fstate[tbKey]; ok {
+			fwdBefore[i] = cur
+		}
+		switch st.Type {
+		case DDL_TYPE_CREATE:
+			if st.LikeTable != "" {
+				if src, ok := fstate[GetAbsTableName(st.LikeSchema, st.LikeTable)]; ok {
+					tbInfo := src.Copy()
+					tbInfo.Database, tbInfo.Table = st.Schema, st.Table
+					fstate[tbKey] = tbInfo
+				}
+			} else if st.ColsParsed {
+				fstate[tbKey] = NewTblInfoJsonFromCreateDdl(*st)
+			}
+		case DDL_TYPE_ALTER:
+			cur, ok := fstate[tbKey]
+			if !ok {
+				continue
+			}
+			tbInfo := cur.Copy()
+			for _, spec := range st.Specs {
+				if spec.Action == DDL_ALTER_RENAME_TABLE {
+					delete(fstate, tbKey)
+					tbInfo.Database, tbInfo.Table = spec.NewSchema, spec.NewTable
+					tbKey = GetAbsTableName(spec.NewSchema, spec.NewTable)
+				} else {
+					tbInfo.ApplyAlterSpecForward(spec)
+				}
+			}
+			fstate[tbKey] = tbInfo
+		case DDL_TYPE_RENAME:
+			if cur, ok := fstate[tbKey]; ok {
+				tbInfo := cur.Copy()
+				tbInfo.Database, tbInfo.Table = st.NewSchema, st.NewTable
+				fstate[GetAbsTableName(st.NewSchema, st.NewTable)] = tbInfo
+				delete(fstate, tbKey)
+			}
+		case DDL_TYPE_DROP:
+			delete(fstate, tbKey)
+		}
+	}
+
+	// backward: from the current table definitions
+	state := map[string]*TblInfoJson{}
+	for tbKey, tbDefs := range this.tableInfos {
+		if cur, ok := tbDefs[NoneBinlogPosKey]; ok && cur != nil {
+			state[tbKey] = cur
+		}
+	}
+	addedCnt := 0
+	saveDef := func(ref ddlStmtRef, tbInfo *TblInfoJson) *TblInfoJson {
+		tbInfo.DdlInfo = DdlPosInfo{Binlog: ref.ddl.Binlog, StartPos: ref.ddl.StartPos, StopPos: ref.ddl.StopPos, DdlSql: ref.ddl.Sql}
+		if this.CheckAndCreateTblKey(tbInfo.Database, tbInfo.Table, ref.ddl.Binlog, ref.ddl.StartPos, ref.ddl.StopPos) {
+			// table definition from json file takes priority
+			return this.tableInfos[GetAbsTableName(tbInfo.Database, tbInfo.Table)][GetBinlogPosAsKey(ref.ddl.Binlog, ref.ddl.StartPos, ref.ddl.StopPos)]
+		}
+		this.tableInfos[GetAbsTableName(tbInfo.Database, tbInfo.Table)][GetBinlogPosAsKey(ref.ddl.Binlog, ref.ddl.StartPos, ref.ddl.StopPos)] = tbInfo
+		addedCnt++
+		return tbInfo
+	}
+
+	for i := len(refs) - 1; i >= 0; i-- {
+		ref := refs[i]
+		st := ref.stmt
+		tbKey := GetAbsTableName(st.Schema, st.Table)
+		switch st.Type {
+		case DDL_TYPE_CREATE:
+			// the table does not exist before it is created
+			if _, ok := state[tbKey]; ok {
+				state[tbKey] = saveDef(ref, NewEmptyTblInfoJson(st.Schema, st.Table))
+			}
+		case DDL_TYPE_ALTER:
+			afterKey := tbKey
+			for _, spec := range st.Specs {
+				if spec.Action == DDL_ALTER_RENAME_TABLE {
+					afterKey = GetAbsTableName(spec.NewSchema, spec.NewTable)
+				}
+			}
+			var before *TblInfoJson
+			if fwdBefore[i] != nil {
+				before = fwdBefore[i].Copy()
+			} else if after, ok := state[afterKey]; ok {
+				before = after.Copy()
+				var tbMapPtr *DdlTbMapInfo
+				if tbMap, ok := ref.ddl.TbMaps[tbKey]; ok {
+					tbMapPtr = &tbMap
+				}
+				if !before.ApplyAlterSpecsBackward(st.Specs, tbMapPtr) && !before.Unknown {
+					// so are the table definitions before it, till the table is created
+					before.Unknown = true
+					fmt.Printf("columns dropped by DDL at %s:%d of %s cannot be placed, rows events of it before the DDL are skipped, "+
+						"unless its table definition of this DDL is in --table-columns\n", ref.ddl.Binlog, ref.ddl.StartPos, tbKey)
+				}
+			} else {
+				continue
+			}
+			before.Database, before.Table = st.Schema, st.Table
+			if afterKey != tbKey {
+				if _, ok := state[afterKey]; ok {
+					state[afterKey] = saveDef(ref, NewEmptyTblInfoJson(state[afterKey].Database, state[afterKey].Table))
+				}
+			}
+			state[tbKey] = saveDef(ref, before)
+		case DDL_TYPE_RENAME:
+			newKey := GetAbsTableName(st.NewSchema, st.NewTable)
+			var before *TblInfoJson
+			if fwdBefore[i] != nil {
+				before = fwdBefore[i].Copy()
+			} else if after, ok := state[newKey]; ok {
+				before = after.Copy()
+			} else {
+				continue
+			}
+			before.Database, before.Table = st.Schema, st.Table
+			if _, ok := state[newKey]; ok {
+				state[newKey] = saveDef(ref, NewEmptyTblInfoJson(st.NewSchema, st.NewTable))
+			}
+			state[tbKey] = saveDef(ref, before)
+		case DDL_TYPE_DROP:
+			if fwdBefore[i] != nil {
+				state[tbKey] = saveDef(ref, fwdBefore[i].Copy())
+			} else {
+				delete(state, tbKey)
+			}
+		}
+	}
+	return addedCnt
+}
+
+func BuildTblDefHistoryFromBinlogs(cfg ConfCmd, tbInfos *TablesColumnsInfo) {
+	myParser := BinFileParser{}
+	myParser.parser = NewBinEventDecoder()
+	ddls := myParser.ScanDdlsOfBinlogFiles(cfg)
+	cnt := tbInfos.BuildTblDefHistoryFromDdls(ddls)
+	fmt.Printf("found %d DDLs in binlogs, %d table definitions before DDL are added\n", len(ddls), cnt)
+}
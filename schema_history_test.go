@@ -0,0 +1,165 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+const schemaHistoryTestBinlog = "mysql-bin.000001"
+
+// "a:int,b:varchar" to columns
+func schemaHistoryTestColumns(cols string) []FieldInfo {
+	fields := []FieldInfo{}
+	for _, col := range strings.Split(cols, ",") {
+		if col == "" {
+			continue
+		}
+		nameType := strings.SplitN(col, ":", 2)
+		fields = append(fields, FieldInfo{FieldName: nameType[0], FieldType: nameType[1]})
+	}
+	return fields
+}
+
+func schemaHistoryTestDescribe(tbInfo *TblInfoJson) string {
+	if tbInfo.Unknown {
+		return "unknown"
+	}
+	var cols []string
+	for _, f := range tbInfo.Columns {
+		cols = append(cols, f.FieldName+":"+f.FieldType)
+	}
+	return strings.Join(cols, ",")
+}
+
+type schemaHistoryTestDdl struct {
+	sql   string
+	tbMap []byte // column types of the table map event of db.t before the ddl, nil if no table map event
+}
+
+func TestBuildTblDefHistoryFromDdls(t *testing.T) {
+	long, varchar, bigint, blob := byte(mysql.MYSQL_TYPE_LONG), byte(mysql.MYSQL_TYPE_VARCHAR), byte(mysql.MYSQL_TYPE_LONGLONG), byte(mysql.MYSQL_TYPE_BLOB)
+	cases := []struct {
+		name    string
+		current string // current definition of db.t, empty if not exists
+		ddls    []schemaHistoryTestDdl
+		before  []string // definition of db.t before each ddl
+	}{
+		{"one dropped column placed by table map", "a:int,c:bigint",
+			[]schemaHistoryTestDdl{{"alter table t drop b", []byte{long, varchar, bigint}}},
+			[]string{"a:int,b:varchar,c:bigint"}},
+		{"dropped text column", "a:int,c:bigint",
+			[]schemaHistoryTestDdl{{"alter table t drop b", []byte{long, blob, bigint}}},
+			[]string{"a:int,b:" + UNKNOWN_FIELD_TYPE_NAME + ",c:bigint"}},
+		{"dropped the last column", "a:int,b:varchar",
+			[]schemaHistoryTestDdl{{"alter table t drop column c", []byte{long, varchar, bigint}}},
+			[]string{"a:int,b:varchar,c:bigint"}},
+		{"two dropped columns cannot be named", "a:int,d:bigint",
+			[]schemaHistoryTestDdl{{"alter table t drop b, drop c", []byte{long, varchar, varchar, bigint}}},
+			[]string{"unknown"}},
+		{"dropped one of the adjacent columns of the same type", "a:int,c:int",
+			[]schemaHistoryTestDdl{{"alter table t drop b", []byte{long, long, long}}},
+			[]string{"unknown"}},
+		{"no table map before the ddl", "a:int,c:bigint",
+			[]schemaHistoryTestDdl{{"alter table t drop b", nil}},
+			[]string{"unknown"}},
+		{"table map mismatch", "a:int,c:bigint",
+			[]schemaHistoryTestDdl{{"alter table t drop b", []byte{long, varchar, varchar, bigint}}},
+			[]string{"unknown"}},
+		{"multi specs are undone before placing the dropped column", "a:int,x:int,cc:bigint",
+			[]schemaHistoryTestDdl{{"alter table t add x int after a, change c cc bigint, drop b", []byte{long, varchar, bigint}}},
+			[]string{"a:int,b:varchar,c:bigint"}},
+		{"dropped and added back with the same name", "a:int,b:bigint",
+			[]schemaHistoryTestDdl{{"alter table t drop b, add b bigint", []byte{long, varchar}}},
+			[]string{"a:int,b:varchar"}},
+		{"rename column and add column", "a:int,bb:varchar,c:int",
+			[]schemaHistoryTestDdl{{"alter table t rename column b to bb, add column c int", nil}},
+			[]string{"a:int,b:varchar"}},
+		{"unknown is kept for the definitions before it", "a:int,d:bigint,e:int",
+			[]schemaHistoryTestDdl{
+				{"alter table t add e int", nil},
+				{"alter table t drop b, drop c", []byte{long, varchar, varchar, bigint, long}},
+				{"alter table t drop x", []byte{long, varchar, bigint, long}},
+			},
+			[]string{"unknown", "unknown", "a:int,x:varchar,d:bigint,e:int"}},
+		{"forward replay from create table knows the dropped columns", "a:int,d:bigint",
+			[]schemaHistoryTestDdl{
+				{"create table t (a int, b varchar(10), c varchar(10), d bigint)", nil},
+				{"alter table t drop b, drop c", nil},
+			},
+			[]string{"", "a:int,b:varchar,c:varchar,d:bigint"}},
+	}
+
+	for _, c := range cases {
+		tbInfos := &TablesColumnsInfo{tableInfos: map[string]map[string]*TblInfoJson{}}
+		tbKey := GetAbsTableName("db", "t")
+		if c.current != "" {
+			tbInfos.tableInfos[tbKey] = map[string]*TblInfoJson{NoneBinlogPosKey: {Database: "db", Table: "t",
+				Columns: schemaHistoryTestColumns(c.current), PrimaryKey: KeyInfo{}, UniqueKeys: []KeyInfo{},
+				DdlInfo: DdlPosInfo{Binlog: KEY_NONE_BINLOG, StartPos: KEY_NONE_POS, StopPos: KEY_NONE_POS}}}
+		}
+		var ddls []DdlEventInfo
+		for i, d := range c.ddls {
+			ddl := DdlEventInfo{Binlog: schemaHistoryTestBinlog, StartPos: uint32(1000 * (i + 1)), StopPos: uint32(1000*(i+1) + 100),
+				Sql: d.sql, Statements: ParseDdlSql("db", d.sql), TbMaps: map[string]DdlTbMapInfo{}}
+			if d.tbMap != nil {
+				ddl.TbMaps[tbKey] = DdlTbMapInfo{ColumnType: d.tbMap, ColumnMeta: make([]uint16, len(d.tbMap))}
+			}
+			ddls = append(ddls, ddl)
+		}
+		tbInfos.BuildTblDefHistoryFromDdls(ddls)
+
+		for i, expected := range c.before {
+			tbDef := tbInfos.tableInfos[tbKey][GetBinlogPosAsKey(schemaHistoryTestBinlog, ddls[i].StartPos, ddls[i].StopPos)]
+			if tbDef == nil {
+				t.Errorf("%s: no table definition before ddl %d", c.name, i)
+				continue
+			}
+			if got := schemaHistoryTestDescribe(tbDef); got != expected {
+				t.Errorf("%s: before ddl %d(%s), expect %q, got %q", c.name, i, ddls[i].Sql, expected, got)
+			}
+
+			// rows event right before the ddl
+			_, err := tbInfos.GetTableInfoJsonOfBinPos("db", "t", schemaHistoryTestBinlog, ddls[i].StartPos-50, ddls[i].StartPos)
+			if (expected == "unknown") != (err != nil) {
+				t.Errorf("%s: table definition of rows event before ddl %d, expect unknown %v, got error %v", c.name, i, expected == "unknown", err)
+			}
+		}
+	}
+}
+
+// the definition is kept under the old name before the table is renamed, and the new name does not exist
+func TestBuildTblDefHistoryOfRenamedTable(t *testing.T) {
+	tbInfos := &TablesColumnsInfo{tableInfos: map[string]map[string]*TblInfoJson{
+		GetAbsTableName("db", "t2"): {NoneBinlogPosKey: {Database: "db", Table: "t2", Columns: schemaHistoryTestColumns("a:int,b:int"),
+			DdlInfo: DdlPosInfo{Binlog: KEY_NONE_BINLOG, StartPos: KEY_NONE_POS, StopPos: KEY_NONE_POS}}},
+	}}
+	sqls := []string{"alter table t1 add b int", "alter table t1 rename to t2"}
+	var ddls []DdlEventInfo
+	for i, sql := range sqls {
+		ddls = append(ddls, DdlEventInfo{Binlog: schemaHistoryTestBinlog, StartPos: uint32(1000 * (i + 1)), StopPos: uint32(1000*(i+1) + 100),
+			Sql: sql, Statements: ParseDdlSql("db", sql), TbMaps: map[string]DdlTbMapInfo{}})
+	}
+	tbInfos.BuildTblDefHistoryFromDdls(ddls)
+
+	for _, c := range []struct {
+		table    string
+		pos      uint32
+		expected string
+	}{
+		{"t1", 500, "a:int"},
+		{"t1", 1500, "a:int,b:int"},
+		{"t2", 1500, ""},
+		{"t2", 2500, "a:int,b:int"},
+	} {
+		tbDef, err := tbInfos.GetTableInfoJsonOfBinPos("db", c.table, schemaHistoryTestBinlog, c.pos-50, c.pos)
+		if err != nil {
+			t.Errorf("%s at %d: %v", c.table, c.pos, err)
+			continue
+		}
+		if got := schemaHistoryTestDescribe(tbDef); got != c.expected {
+			t.Errorf("%s at %d: expect %q, got %q", c.table, c.pos, c.expected, got)
+		}
+	}
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"strconv"
 	"strings"
 
 	SQL "github.com/dropbox/godropbox/database/sqlbuilder"
+	"github.com/dropbox/godropbox/database/sqltypes"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
 	sliceKits "github.com/toolkits/slice"
 )
 
-var G_Bytes_Column_Types []string = []string{"blob", "json", "geometry", UNKNOWN_FIELD_TYPE_NAME}
+var G_Bytes_Column_Types []string = []string{"blob", UNKNOWN_FIELD_TYPE_NAME}
+var G_Float_Column_Types []string = []string{"float", "double"}
 
 // get column data type name and sqlbuilder column definition
 /*
@@ -67,16 +72,7 @@ func GetMysqlDataTypeNameAndSqlColumn(tpDef string, colName string, tp byte, met
 	// for unkown type, defaults to BytesColumn
 
 	//get real string type
-	if tp == mysql.MYSQL_TYPE_STRING {
-		if meta >= 256 {
-			b0 := uint8(meta >> 8)
-			if b0&0x30 != 0x30 {
-				tp = byte(b0 | 0x30)
-			} else {
-				tp = b0
-			}
-		}
-	}
+	tp = GetRealTypeOfColumn(tp, meta)
 	//fmt.Println("column type:", colName, tp)
 	switch tp {
 
@@ -98,6 +94,7 @@ func GetMysqlDataTypeNameAndSqlColumn(tpDef string, colName string, tp byte, met
 		return "bigint", SQL.IntColumn(colName, SQL.NotNullable)
 
 	case mysql.MYSQL_TYPE_NEWDECIMAL:
+		// decoded as string and converted to sqltypes.Fractional by ConvertDecimalValue
 		return "decimal", SQL.DoubleColumn(colName, SQL.NotNullable)
 
 	case mysql.MYSQL_TYPE_FLOAT:
@@ -140,8 +137,10 @@ func GetMysqlDataTypeNameAndSqlColumn(tpDef string, colName string, tp byte, met
 	case mysql.MYSQL_TYPE_STRING:
 		return "char", SQL.StrColumn(colName, SQL.UTF8, SQL.UTF8CaseInsensitive, SQL.NotNullable)
 	case mysql.MYSQL_TYPE_JSON:
-		return "json", SQL.BytesColumn(colName, SQL.NotNullable)
+		// converted to json text by ConvertJsonValue
+		return "json", SQL.StrColumn(colName, SQL.UTF8, SQL.UTF8CaseInsensitive, SQL.NotNullable)
 	case mysql.MYSQL_TYPE_GEOMETRY:
+		// converted to GeometryValue by ConvertGeometryValue
 		return "geometry", SQL.BytesColumn(colName, SQL.NotNullable)
 	default:
 		return UNKNOWN_FIELD_TYPE_NAME, SQL.BytesColumn(colName, SQL.NotNullable)
@@ -191,41 +190,296 @@ func GetSqlFieldsEXpressions(colCnt int, colNames []FieldInfo, tbMap *replicatio
 	colTypeNames := make([]string, colCnt)
 	for i := 0; i < colCnt; i++ {
 		typeName, colDef := GetMysqlDataTypeNameAndSqlColumn(colNames[i].FieldType, colNames[i].FieldName, tbMap.ColumnType[i], tbMap.ColumnMeta[i])
+		if (typeName == "enum" || typeName == "set") && len(colNames[i].EnumSetValues) > 0 {
+			// converted to labels by ConvertEnumSetValue
+			colDef = SQL.StrColumn(colNames[i].FieldName, SQL.UTF8, SQL.UTF8CaseInsensitive, SQL.NotNullable)
+		}
 		colDefExps[i] = colDef
 		colTypeNames[i] = typeName
 	}
 	return colDefExps, colTypeNames
 }
 
-func GenEqualConditions(row []interface{}, colDefs []SQL.NonAliasColumn, uniKey []int, ifMinImage bool) []SQL.BoolExpression {
-	if ifMinImage && len(uniKey) > 0 {
+// integers are always decoded as signed, ex: int unsigned 4294967295 is decoded as -1
+func ConvertUnsignedIntValue(v interface{}, typeName string) interface{} {
+	switch iv := v.(type) {
+	case int8:
+		return uint64(uint8(iv))
+	case int16:
+		return uint64(uint16(iv))
+	case int32:
+		if typeName == "mediumint" {
+			return uint64(uint32(iv) & 0xFFFFFF)
+		}
+		return uint64(uint32(iv))
+	case int64:
+		return uint64(iv)
+	}
+	// nil
+	return v
+}
+
+// enum is stored as the index of members(starts with 1, 0 is the empty error value), set is stored as bitmask of members
+func ConvertEnumSetValue(v interface{}, typeName string, members []string) (interface{}, error) {
+	iv, ok := v.(int64)
+	if !ok {
+		// nil
+		return v, nil
+	}
+	if typeName == "enum" {
+		if iv == 0 {
+			return "", nil
+		}
+		if iv < 0 || iv > int64(len(members)) {
+			return v, fmt.Errorf("enum index %d out of range of %d members", iv, len(members))
+		}
+		return members[iv-1], nil
+	}
+	if len(members) < 64 && uint64(iv)>>uint(len(members)) != 0 {
+		return v, fmt.Errorf("set bitmask %b out of range of %d members", iv, len(members))
+	}
+	var labels []string
+	for i, member := range members {
+		if uint64(iv)&(1<<uint(i)) != 0 {
+			labels = append(labels, member)
+		}
+	}
+	return strings.Join(labels, ","), nil
+}
+
+// decimal is decoded as string, ex: 0012.50, convert it to unquoted literal with the scale of the column
+func ConvertDecimalValue(v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		// nil
+		return v
+	}
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign = "-"
+		s = s[1:]
+	}
+	s = strings.TrimSuffix(s, ".") // scale is 0
+	s = strings.TrimLeft(s, "0")
+	if s == "" || s[0] == '.' {
+		s = "0" + s
+	}
+	if strings.Trim(s, "0.") == "" {
+		// -0.00
+		sign = ""
+	}
+	return sqltypes.Fractional(sign + s)
+}
+
+// json is decoded as json text of []byte, empty value(insert null into not null json column in non-strict mode) is json null.
+// the diffs of partial json update are kept as they are
+func ConvertJsonValue(v interface{}) interface{} {
+	bv, ok := v.([]byte)
+	if !ok {
+		// nil or []replication.JsonDiff
+		return v
+	}
+	if len(bv) == 0 {
+		return "null"
+	}
+	return string(bv)
+}
+
+// CAST(expr AS JSON), sqlbuilder has no cast expression
+type castAsJsonExpression struct {
+	SQL.Expression
+}
+
+func (this castAsJsonExpression) SerializeSql(out *bytes.Buffer) error {
+	out.WriteString("CAST(")
+	if err := this.Expression.SerializeSql(out); err != nil {
+		return err
+	}
+	out.WriteString(" AS JSON)")
+	return nil
+}
+
+func CastAsJson(expr SQL.Expression) SQL.Expression {
+	return castAsJsonExpression{Expression: expr}
+}
+
+// partial json update(binlog_row_value_options=PARTIAL_JSON), apply the diffs one by one,
+// ex: JSON_REMOVE(JSON_REPLACE(`doc`, '$.a', CAST('1' AS JSON)), '$.b')
+func JsonDiffsToExpression(col SQL.NonAliasColumn, diffs []replication.JsonDiff) SQL.Expression {
+	var exp SQL.Expression = col
+	for _, diff := range diffs {
+		if diff.Op == replication.JsonDiffOperationRemove {
+			exp = SQL.SqlFunc(diff.Op.String(), exp, SQL.Literal(diff.Path))
+		} else {
+			exp = SQL.SqlFunc(diff.Op.String(), exp, SQL.Literal(diff.Path), CastAsJson(SQL.Literal(string(diff.Value))))
+		}
+	}
+	return exp
+}
+
+// geometry is stored as srid(4 bytes, little endian) + wkb, mysql does not accept it as wkb
+type GeometryValue struct {
+	Srid    uint32
+	Wkb     []byte
+	LongLat bool // mysql 8.0, ST_GeomFromWKB accepts the axis-order option
+}
+
+// longLat: the binlog is of mysql 8.0
+func ConvertGeometryValue(v interface{}, longLat bool) (interface{}, error) {
+	bv, ok := v.([]byte)
+	if !ok {
+		// nil
+		return v, nil
+	}
+	if len(bv) < 4 {
+		return v, fmt.Errorf("geometry value %X is shorter than srid", bv)
+	}
+	return GeometryValue{Srid: binary.LittleEndian.Uint32(bv[0:4]), Wkb: bv[4:], LongLat: longLat}, nil
+}
+
+// ST_GeomFromWKB(X'...', srid). geometry is stored in longitude-latitude order, while mysql 8.0 reads wkb of
+// geographic srs(ex: 4326) in latitude-longitude order by default. mysql 5.7 and mariadb accept only 2 arguments
+func (this GeometryValue) ToExpression() SQL.Expression {
+	if this.Srid == 0 || !this.LongLat {
+		return SQL.SqlFunc("ST_GeomFromWKB", SQL.Literal(this.Wkb), SQL.Literal(this.Srid))
+	}
+	return SQL.SqlFunc("ST_GeomFromWKB", SQL.Literal(this.Wkb), SQL.Literal(this.Srid), SQL.Literal("axis-order=long-lat"))
+}
+
+// float is decoded as float32, which is printed as float64 by SQL.Literal, ex: 1.1 is printed as 1.100000023841858
+func ValueToLiteral(v interface{}) SQL.Expression {
+	switch tv := v.(type) {
+	case float32:
+		return SQL.Literal(sqltypes.Fractional(strconv.AppendFloat(nil, float64(tv), 'g', -1, 32)))
+	case GeometryValue:
+		return tv.ToExpression()
+	}
+	return SQL.Literal(v)
+}
+
+func IfValueEqual(a interface{}, b interface{}) bool {
+	switch av := a.(type) {
+	case []byte:
+		bv, ok := b.([]byte)
+		return ok && bytes.Equal(av, bv)
+	case sqltypes.Fractional:
+		bv, ok := b.(sqltypes.Fractional)
+		return ok && bytes.Equal(av, bv)
+	case []replication.JsonDiff:
+		// partial json update always changes the column
+		return false
+	case GeometryValue:
+		bv, ok := b.(GeometryValue)
+		return ok && av.Srid == bv.Srid && bytes.Equal(av.Wkb, bv.Wkb)
+	}
+	return a == b
+}
+
+// binlog_row_image=MINIMAL|NOBLOB, columns not in the image are nil too, so check the column bitmap of rows event.
+// nil bitmap means all columns
+func IfColumnInImage(bitmap []byte, idx int) bool {
+	if bitmap == nil {
+		return true
+	}
+	if idx>>3 >= len(bitmap) {
+		return false
+	}
+	return bitmap[idx>>3]&(1<<(uint(idx)&7)) > 0
+}
+
+func IfColumnsInImage(bitmap []byte, idxes []int) bool {
+	for _, idx := range idxes {
+		if !IfColumnInImage(bitmap, idx) {
+			return false
+		}
+	}
+	return true
+}
+
+func GetColumnsInImage(colDefs []SQL.NonAliasColumn, bitmap []byte) ([]SQL.NonAliasColumn, []int) {
+	var cols []SQL.NonAliasColumn
+	var idxes []int
+	for i, col := range colDefs {
+		if IfColumnInImage(bitmap, i) {
+			cols = append(cols, col)
+			idxes = append(idxes, i)
+		}
+	}
+	return cols, idxes
+}
+
+// rollback needs the before image: all columns for delete, the updated columns for update
+func CheckRowsImageForRollback(rEv *replication.RowsEvent, sqlType string, colNames []FieldInfo) error {
+	var missing []string
+	for i := 0; i < int(rEv.ColumnCount); i++ {
+		var ifNeeded bool
+		if sqlType == "delete" {
+			ifNeeded = true
+		} else if sqlType == "update" {
+			ifNeeded = IfColumnInImage(rEv.ColumnBitmap2, i)
+		}
+		if ifNeeded && !IfColumnInImage(rEv.ColumnBitmap1, i) {
+			missing = append(missing, GetFieldName(i, colNames))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("before image misses column(s) %s, binlog_row_image is not FULL", strings.Join(missing, ","))
+	}
+	return nil
+}
+
+func GenEqualConditions(row []interface{}, bitmap []byte, colDefs []SQL.NonAliasColumn, colTypeNames []string, uniKey []int, ifMinImage bool) []SQL.BoolExpression {
+	if ifMinImage && len(uniKey) > 0 && IfColumnsInImage(bitmap, uniKey) {
 		expArrs := make([]SQL.BoolExpression, len(uniKey))
 		for k, idx := range uniKey {
-			expArrs[k] = SQL.EqL(colDefs[idx], row[idx])
+			expArrs[k] = GenEqualCondition(colDefs[idx], colTypeNames[idx], row[idx])
 		}
 		return expArrs
 	}
-	expArrs := make([]SQL.BoolExpression, len(row))
+	expArrs := make([]SQL.BoolExpression, 0, len(row))
 	for i, v := range row {
-		expArrs[i] = SQL.EqL(colDefs[i], v)
+		if !IfColumnInImage(bitmap, i) {
+			continue
+		}
+		if len(uniKey) > 0 && sliceKits.ContainsString(G_Float_Column_Types, colTypeNames[i]) && !sliceKits.ContainsInt(uniKey, i) {
+			// float/double may not be equal exactly, the unique key is enough
+			continue
+		}
+		if _, ok := v.([]replication.JsonDiff); ok {
+			// after image of partial json update, the full value is unknown
+			continue
+		}
+		// float is printed as float64 here, mysql compares float column as double, so it matches exactly
+		expArrs = append(expArrs, GenEqualCondition(colDefs[i], colTypeNames[i], v))
 	}
 	return expArrs
 }
 
-func ConvertRowToExpressRow(row []interface{}) []SQL.Expression {
+func GenEqualCondition(colDef SQL.NonAliasColumn, colTypeName string, v interface{}) SQL.BoolExpression {
+	if colTypeName == "json" && v != nil {
+		// json column = 'json text' compares as string, not json
+		return SQL.Eq(colDef, CastAsJson(SQL.Literal(v)))
+	}
+	if gv, ok := v.(GeometryValue); ok {
+		return SQL.Eq(colDef, gv.ToExpression())
+	}
+	return SQL.EqL(colDef, v)
+}
+
+func ConvertRowToExpressRow(row []interface{}, colIdxes []int) []SQL.Expression {
 
-	valueInserted := make([]SQL.Expression, len(row))
-	for i, val := range row {
-		vExp := SQL.Literal(val)
+	valueInserted := make([]SQL.Expression, len(colIdxes))
+	for i, idx := range colIdxes {
+		vExp := ValueToLiteral(row[idx])
 		valueInserted[i] = vExp
 	}
 	return valueInserted
 }
 
-func GenInsertSqlForRows(rows [][]interface{}, insertSql SQL.InsertStatement, schema string, ifprefixDb bool) (string, error) {
+func GenInsertSqlForRows(rows [][]interface{}, colIdxes []int, insertSql SQL.InsertStatement, schema string, ifprefixDb bool) (string, error) {
 
 	for _, row := range rows {
-		valuesInserted := ConvertRowToExpressRow(row)
+		valuesInserted := ConvertRowToExpressRow(row, colIdxes)
 		insertSql.Add(valuesInserted...)
 	}
 	if !ifprefixDb {
@@ -246,15 +500,17 @@ func GenInsertSqlsForOneRowsEvent(rEv *replication.RowsEvent, colDefs []SQL.NonA
 	} else {
 		sqlType = "insert"
 	}
+	// only columns in the image, binlog_row_image=MINIMAL|NOBLOB
+	insertCols, colIdxes := GetColumnsInImage(colDefs, rEv.ColumnBitmap1)
 	var insertSql SQL.InsertStatement
 	var oneSql string
 	var err error
 	var i int
 	var endIndex int
 	for i = 0; i < rowCnt; i += rowsPerSql {
-		insertSql = SQL.NewTable(table, colDefs...).Insert(colDefs...)
+		insertSql = SQL.NewTable(table, colDefs...).Insert(insertCols...)
 		endIndex = GetMinValue(rowCnt, i+rowsPerSql)
-		oneSql, err = GenInsertSqlForRows(rEv.Rows[i:endIndex], insertSql, schema, ifprefixDb)
+		oneSql, err = GenInsertSqlForRows(rEv.Rows[i:endIndex], colIdxes, insertSql, schema, ifprefixDb)
 		if err != nil {
 			PrintGenSqlError(err, rEv.Rows[i:endIndex], sqlType, schema, table)
 			continue
@@ -265,8 +521,8 @@ func GenInsertSqlsForOneRowsEvent(rEv *replication.RowsEvent, colDefs []SQL.NonA
 	}
 
 	if endIndex < rowCnt {
-		insertSql = SQL.NewTable(table, colDefs...).Insert(colDefs...)
-		oneSql, err = GenInsertSqlForRows(rEv.Rows[endIndex:rowCnt], insertSql, schema, ifprefixDb)
+		insertSql = SQL.NewTable(table, colDefs...).Insert(insertCols...)
+		oneSql, err = GenInsertSqlForRows(rEv.Rows[endIndex:rowCnt], colIdxes, insertSql, schema, ifprefixDb)
 		if err != nil {
 			PrintGenSqlError(err, rEv.Rows[endIndex:rowCnt], sqlType, schema, table)
 		} else {
@@ -278,11 +534,11 @@ func GenInsertSqlsForOneRowsEvent(rEv *replication.RowsEvent, colDefs []SQL.NonA
 
 }
 
-func GenDeleteSqlsForOneRowsEventRollbackInsert(rEv *replication.RowsEvent, colDefs []SQL.NonAliasColumn, uniKey []int, ifMinImage bool, ifprefixDb bool) []string {
-	return GenDeleteSqlsForOneRowsEvent(rEv, colDefs, uniKey, ifMinImage, true, ifprefixDb)
+func GenDeleteSqlsForOneRowsEventRollbackInsert(rEv *replication.RowsEvent, colDefs []SQL.NonAliasColumn, colTypeNames []string, uniKey []int, ifMinImage bool, ifprefixDb bool) []string {
+	return GenDeleteSqlsForOneRowsEvent(rEv, colDefs, colTypeNames, uniKey, ifMinImage, true, ifprefixDb)
 }
 
-func GenDeleteSqlsForOneRowsEvent(rEv *replication.RowsEvent, colDefs []SQL.NonAliasColumn, uniKey []int, ifMinImage bool, ifRollback bool, ifprefixDb bool) []string {
+func GenDeleteSqlsForOneRowsEvent(rEv *replication.RowsEvent, colDefs []SQL.NonAliasColumn, colTypeNames []string, uniKey []int, ifMinImage bool, ifRollback bool, ifprefixDb bool) []string {
 	rowCnt := len(rEv.Rows)
 	sqlArr := make([]string, rowCnt)
 	//var sqlArr []string
@@ -300,7 +556,7 @@ func GenDeleteSqlsForOneRowsEvent(rEv *replication.RowsEvent, colDefs []SQL.NonA
 		sqlType = "delete"
 	}
 	for i, row := range rEv.Rows {
-		whereCond := GenEqualConditions(row, colDefs, uniKey, ifMinImage)
+		whereCond := GenEqualConditions(row, rEv.ColumnBitmap1, colDefs, colTypeNames, uniKey, ifMinImage)
 
 		sql, err := SQL.NewTable(table, colDefs...).Delete().Where(SQL.And(whereCond...)).String(schemaInSql)
 		if err != nil {
@@ -317,14 +573,20 @@ func GenInsertSqlsForOneRowsEventRollbackDelete(rEv *replication.RowsEvent, colD
 	return GenInsertSqlsForOneRowsEvent(rEv, colDefs, rowsPerSql, true, ifprefixDb)
 }
 
-func GenUpdateSetPart(colsTypeNameFromMysql []string, colTypeNames []string, updateSql SQL.UpdateStatement, colDefs []SQL.NonAliasColumn, rowAfter []interface{}, rowBefore []interface{}, ifMinImage bool) SQL.UpdateStatement {
+func GenUpdateSetPart(colsTypeNameFromMysql []string, colTypeNames []string, updateSql SQL.UpdateStatement, colDefs []SQL.NonAliasColumn, rowAfter []interface{}, rowBefore []interface{},
+	bitmapAfter []byte, bitmapBefore []byte, ifMinImage bool) SQL.UpdateStatement {
 
 	ifUpdateCol := false
 	for i, v := range rowAfter {
 		ifUpdateCol = false
 		//fmt.Printf("type: %s\nbefore: %v\nafter: %v\n", colTypeNames[i], rowBefore[i], v)
+		if !IfColumnInImage(bitmapAfter, i) {
+			continue
+		}
 
-		if ifMinImage {
+		if ifMinImage && !IfColumnInImage(bitmapBefore, i) {
+			ifUpdateCol = true
+		} else if ifMinImage {
 			// text is stored as blob in binlog
 			if sliceKits.ContainsString(G_Bytes_Column_Types, colTypeNames[i]) && !strings.Contains(strings.ToLower(colsTypeNameFromMysql[i]), "text") {
 				aArr, aOk := v.([]byte)
@@ -344,7 +606,7 @@ func GenUpdateSetPart(colsTypeNameFromMysql []string, colTypeNames []string, upd
 				}
 
 			} else {
-				if v == rowBefore[i] {
+				if IfValueEqual(v, rowBefore[i]) {
 					//fmt.Println("compare equal")
 					ifUpdateCol = false
 				} else {
@@ -357,7 +619,11 @@ func GenUpdateSetPart(colsTypeNameFromMysql []string, colTypeNames []string, upd
 		}
 
 		if ifUpdateCol {
-			updateSql.Set(colDefs[i], SQL.Literal(v))
+			if diffs, ok := v.([]replication.JsonDiff); ok {
+				updateSql.Set(colDefs[i], JsonDiffsToExpression(colDefs[i], diffs))
+			} else {
+				updateSql.Set(colDefs[i], ValueToLiteral(v))
+			}
 		}
 	}
 	return updateSql
@@ -388,11 +654,11 @@ func GenUpdateSqlsForOneRowsEvent(colsTypeNameFromMysql []string, colsTypeName [
 	for i := 0; i < rowCnt; i += 2 {
 		upSql := SQL.NewTable(table, colDefs...).Update()
 		if ifRollback {
-			upSql = GenUpdateSetPart(colsTypeNameFromMysql, colsTypeName, upSql, colDefs, rEv.Rows[i], rEv.Rows[i+1], ifMinImage)
-			wherePart = GenEqualConditions(rEv.Rows[i+1], colDefs, uniKey, ifMinImage)
+			upSql = GenUpdateSetPart(colsTypeNameFromMysql, colsTypeName, upSql, colDefs, rEv.Rows[i], rEv.Rows[i+1], rEv.ColumnBitmap1, rEv.ColumnBitmap2, ifMinImage)
+			wherePart = GenEqualConditions(rEv.Rows[i+1], rEv.ColumnBitmap2, colDefs, colsTypeName, uniKey, ifMinImage)
 		} else {
-			upSql = GenUpdateSetPart(colsTypeNameFromMysql, colsTypeName, upSql, colDefs, rEv.Rows[i+1], rEv.Rows[i], ifMinImage)
-			wherePart = GenEqualConditions(rEv.Rows[i], colDefs, uniKey, ifMinImage)
+			upSql = GenUpdateSetPart(colsTypeNameFromMysql, colsTypeName, upSql, colDefs, rEv.Rows[i+1], rEv.Rows[i], rEv.ColumnBitmap2, rEv.ColumnBitmap1, ifMinImage)
+			wherePart = GenEqualConditions(rEv.Rows[i], rEv.ColumnBitmap1, colDefs, colsTypeName, uniKey, ifMinImage)
 		}
 
 		upSql.Where(SQL.And(wherePart...))
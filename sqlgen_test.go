@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestGeometryValueToExpression(t *testing.T) {
+	// POINT(1 2)
+	wkb := []byte{0x01, 0x01, 0x00, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0, 0, 0, 0, 0, 0, 0, 0x40}
+	cases := []struct {
+		srid     uint32
+		longLat  bool
+		expected string
+	}{
+		{0, false, "ST_GeomFromWKB(X'0101000000000000000000f03f0000000000000040',0)"},
+		{0, true, "ST_GeomFromWKB(X'0101000000000000000000f03f0000000000000040',0)"},
+		// mysql 5.7, mariadb
+		{4326, false, "ST_GeomFromWKB(X'0101000000000000000000f03f0000000000000040',4326)"},
+		// mysql 8.0
+		{4326, true, "ST_GeomFromWKB(X'0101000000000000000000f03f0000000000000040',4326,'axis-order=long-lat')"},
+	}
+	for _, c := range cases {
+		bv := make([]byte, 4, 4+len(wkb))
+		binary.LittleEndian.PutUint32(bv, c.srid)
+		v, err := ConvertGeometryValue(append(bv, wkb...), c.longLat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err = ValueToLiteral(v).SerializeSql(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != c.expected {
+			t.Errorf("srid %d longLat %v: expect %s, got %s", c.srid, c.longLat, c.expected, buf.String())
+		}
+	}
+
+	if v, err := ConvertGeometryValue(nil, true); err != nil || v != nil {
+		t.Errorf("null geometry: expect nil, got %v %v", v, err)
+	}
+	if _, err := ConvertGeometryValue([]byte{1, 2}, true); err == nil {
+		t.Error("geometry shorter than srid: expect error")
+	}
+}
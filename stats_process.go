@@ -20,7 +20,7 @@ var RegexpMatchDdlQuery *regexp.Regexp = regexp.MustCompile(`^\s*(alter|create|r
 var Stats_Result_Header_Column_names []string = []string{"binlog", "starttime", "stoptime",
 	"startpos", "stoppos", "inserts", "updates", "deletes", "database", "table"}
 var Stats_DDL_Header_Column_names []string = []string{"datetime", "binlog", "startpos", "stoppos", "sql"}
-var Stats_BigLongTrx_Header_Column_names []string = []string{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows", "duration", "tables"}
+var Stats_BigLongTrx_Header_Column_names []string = []string{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows", "duration", "gtid", "xid", "tables"}
 
 type BinEventStats struct {
 	Timestamp uint32
@@ -32,6 +32,12 @@ type BinEventStats struct {
 	QueryType string // query, insert, update, delete
 	RowCnt    uint32
 	QuerySql  string // for type=query
+	Gtid      string // gtid of the transaction, empty if gtid is not enabled
+	TrxIndex  uint64
+	TrxStatus int
+	Xid       string // xid of xa transaction
+
+	OriginalSql string // original sql of rows event with --original-sql
 }
 
 type BinEventStatsPrint struct {
@@ -65,37 +71,47 @@ type BigLongTrxInfo struct {
 	Binlog     string
 	StartPos   uint32
 	StopPos    uint32
-	RowCnt     uint32                       // total row count for all statement
-	Duration   uint32                       // how long the trx lasts
+	RowCnt     uint32 // total row count for all statement
+	Duration   uint32 // how long the trx lasts
+	Gtid       string // empty if gtid is not enabled
+	TrxIndex   uint64
+	Xid        string
 	Statements map[string]map[string]uint32 // rowcnt for each type statment: insert, update, delete. {db1.tb1:{insert:0, update:2, delete:10}}
 
+	OriginalSqls []string // original sqls of rows events with --original-sql
+
 }
 
-func OpenStatsResultFiles(cfg ConfCmd) (*os.File, *os.File, *os.File) {
+// files are appended to and the header lines are not written again when resumed from the checkpoint
+func OpenStatsResultFiles(cfg ConfCmd) (*os.File, *os.File, *os.File, *os.File, *os.File) {
 	// stat file
 	statFile := filepath.Join(cfg.OutputDir, "binlog_stats.log")
-	statFH, err := os.OpenFile(statFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	statFH, ifHeader, err := OpenResultFile(statFile, cfg.Resumed)
 	if err != nil {
 		CheckErr(err, "fail to open file "+statFile, ERR_FILE_OPEN, false)
 		runtime.Goexit()
 	}
 	//defer statFH.Close()
-	statFH.WriteString(GetStatsPrintHeaderLine(Stats_Result_Header_Column_names))
+	if ifHeader {
+		statFH.WriteString(GetStatsPrintHeaderLine(Stats_Result_Header_Column_names))
+	}
 
 	// ddl file
 	ddlFile := filepath.Join(cfg.OutputDir, "ddl_info.log")
-	ddlFH, err := os.OpenFile(ddlFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	ddlFH, ifHeader, err := OpenResultFile(ddlFile, cfg.Resumed)
 	if err != nil {
 		CheckErr(err, "fail to open file "+ddlFile, ERR_FILE_OPEN, false)
 		statFH.Close()
 		runtime.Goexit()
 	}
 	//defer ddlFH.Close()
-	ddlFH.WriteString(GetDdlPrintHeaderLine(Stats_DDL_Header_Column_names))
+	if ifHeader {
+		ddlFH.WriteString(GetDdlPrintHeaderLine(Stats_DDL_Header_Column_names))
+	}
 
 	// big/long trx info
 	biglongFile := filepath.Join(cfg.OutputDir, "big_long_trx.log")
-	biglongFH, err := os.OpenFile(biglongFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	biglongFH, ifHeader, err := OpenResultFile(biglongFile, cfg.Resumed)
 	if err != nil {
 		CheckErr(err, "fail to open file "+biglongFile, ERR_FILE_OPEN, false)
 		statFH.Close()
@@ -103,13 +119,44 @@ func OpenStatsResultFiles(cfg ConfCmd) (*os.File, *os.File, *os.File) {
 		runtime.Goexit()
 	}
 	//defer biglongFH.Close()
-	biglongFH.WriteString(GetBigLongTrxPrintHeaderLine(Stats_BigLongTrx_Header_Column_names))
+	if ifHeader {
+		biglongFH.WriteString(GetBigLongTrxPrintHeaderLine(Stats_BigLongTrx_Header_Column_names, cfg.OriginalSql))
+	}
+
+	// summary of every trx, the same columns as big/long trx
+	trxFile := filepath.Join(cfg.OutputDir, "trx_summary.log")
+	trxFH, ifHeader, err := OpenResultFile(trxFile, cfg.Resumed)
+	if err != nil {
+		CheckErr(err, "fail to open file "+trxFile, ERR_FILE_OPEN, false)
+		statFH.Close()
+		ddlFH.Close()
+		biglongFH.Close()
+		runtime.Goexit()
+	}
+	if ifHeader {
+		trxFH.WriteString(GetBigLongTrxPrintHeaderLine(Stats_BigLongTrx_Header_Column_names, cfg.OriginalSql))
+	}
+
+	// xa trx info
+	xaFile := filepath.Join(cfg.OutputDir, "xa_trx.log")
+	xaFH, ifHeader, err := OpenResultFile(xaFile, cfg.Resumed)
+	if err != nil {
+		CheckErr(err, "fail to open file "+xaFile, ERR_FILE_OPEN, false)
+		statFH.Close()
+		ddlFH.Close()
+		biglongFH.Close()
+		trxFH.Close()
+		runtime.Goexit()
+	}
+	if ifHeader {
+		xaFH.WriteString(GetXaTrxPrintHeaderLine(Stats_XaTrx_Header_Column_names))
+	}
 
-	return statFH, ddlFH, biglongFH
+	return statFH, ddlFH, biglongFH, trxFH, xaFH
 	//return bufio.NewWriter(statFH), bufio.NewWriter(ddlFH), bufio.NewWriter(biglongFH)
 }
 
-func ProcessBinEventStats(statFH *os.File, ddlFH *os.File, biglongFH *os.File, cfg ConfCmd, statChan chan BinEventStats, wg *sync.WaitGroup) {
+func ProcessBinEventStats(statFH *os.File, ddlFH *os.File, biglongFH *os.File, trxFH *os.File, xaFH *os.File, cfg ConfCmd, statChan chan BinEventStats, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	var lastPrintTime uint32 = 0
@@ -117,6 +164,7 @@ func ProcessBinEventStats(statFH *os.File, ddlFH *os.File, biglongFH *os.File, c
 
 	var statsPrintArr map[string]*BinEventStatsPrint = map[string]*BinEventStatsPrint{} // key=db.tb
 	var oneBigLong BigLongTrxInfo
+	var xaTracker XaTrxTracker
 	var ddlInfoStr string
 	printInterval := uint32(cfg.PrintInterval)
 	bigTrxRowsLimit := uint32(cfg.BigTrxRowLimit)
@@ -143,26 +191,36 @@ func ProcessBinEventStats(statFH *os.File, ddlFH *os.File, biglongFH *os.File, c
 		if lastBinlog == "" {
 			lastBinlog = st.Binlog
 		}
+		// trx cannot spreads in different binlogs
+		if oneBigLong.Statements == nil || oneBigLong.TrxIndex != st.TrxIndex {
+			// rows events before the first BEGIN are in a trx too, if parsing starts in the middle of the trx
+			oneBigLong = BigLongTrxInfo{Binlog: st.Binlog, StartPos: st.StartPos, StartTime: 0, RowCnt: 0, Gtid: st.Gtid,
+				TrxIndex: st.TrxIndex, Xid: st.Xid, Statements: map[string]map[string]uint32{}}
+		}
 		if st.QueryType == "query" {
 			//fmt.Print(st.QuerySql)
 			querySql := strings.ToLower(st.QuerySql)
 			//fmt.Printf("query sql:%s\n", querySql)
 
-			// trx cannot spreads in different binlogs
-			if querySql == "begin" {
-				oneBigLong = BigLongTrxInfo{Binlog: st.Binlog, StartPos: st.StartPos, StartTime: 0, RowCnt: 0, Statements: map[string]map[string]uint32{}}
-			} else if querySql == "commit" || querySql == "rollback" {
+			if IfTrxEndStatus(st.TrxStatus) {
 				if oneBigLong.StartTime > 0 { // the rows event may be skipped by --databases --tables
 					//big and long trx
 					oneBigLong.StopPos = st.StopPos
 					oneBigLong.StopTime = st.Timestamp
 					oneBigLong.Duration = oneBigLong.StopTime - oneBigLong.StartTime
+					trxInfoStr := GetBigLongTrxContentLine(oneBigLong, cfg.OriginalSql)
+					trxFH.WriteString(trxInfoStr)
 					if oneBigLong.RowCnt >= bigTrxRowsLimit || oneBigLong.Duration >= longTrxSecs {
-						biglongFH.WriteString(GetBigLongTrxContentLine(oneBigLong))
+						biglongFH.WriteString(trxInfoStr)
 					}
 				}
-
-			} else if RegexpMatchDdlQuery.MatchString(querySql) {
+				if st.Xid != "" {
+					ProcessXaTrxEnd(xaFH, &xaTracker, oneBigLong, st)
+				}
+				// no more event of this trx
+				oneBigLong = BigLongTrxInfo{}
+			}
+			if RegexpMatchDdlQuery.MatchString(querySql) {
 				// ddl
 				ddlInfoStr = GetDdlInfoContentLine(st.Binlog, st.StartPos, st.StopPos, st.Timestamp, st.QuerySql)
 				ddlFH.WriteString(ddlInfoStr)
@@ -176,6 +234,12 @@ func ProcessBinEventStats(statFH *os.File, ddlFH *os.File, biglongFH *os.File, c
 				oneBigLong.Statements[dbtbKey] = map[string]uint32{"insert": 0, "update": 0, "delete": 0}
 			}
 			oneBigLong.Statements[dbtbKey][st.QueryType] += st.RowCnt
+			if st.OriginalSql != "" {
+				// rows events of one statement have the same original sql
+				if cnt := len(oneBigLong.OriginalSqls); cnt == 0 || oneBigLong.OriginalSqls[cnt-1] != st.OriginalSql {
+					oneBigLong.OriginalSqls = append(oneBigLong.OriginalSqls, st.OriginalSql)
+				}
+			}
 			if oneBigLong.StartTime == 0 {
 				oneBigLong.StartTime = st.Timestamp
 			}
@@ -211,6 +275,13 @@ func ProcessBinEventStats(statFH *os.File, ddlFH *os.File, biglongFH *os.File, c
 		lastBinlog = st.Binlog
 
 	}
+	pendingXa := xaTracker.Pending()
+	for _, xa := range pendingXa {
+		xaFH.WriteString(GetXaTrxContentLine(xa))
+	}
+	if len(pendingXa) > 0 {
+		fmt.Printf("%d xa transactions are prepared but not committed or rolled back, see xa_trx.log\n", len(pendingXa))
+	}
 
 }
 
@@ -238,18 +309,43 @@ func GetDdlInfoContentLine(binlog string, spos uint32, epos uint32, timeStamp ui
 	return fmt.Sprintf("%-19s %-17s %-10d %-10d %s\n", tStr, binlog, spos, epos, sql)
 }
 
-func GetBigLongTrxPrintHeaderLine(headers []string) string {
-	//{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows","duration", "tables"}
-	return fmt.Sprintf("%-17s %-19s %-19s %-10s %-10s %-8s %-10s %s\n", ConvertStrArrToIntferfaceArrForPrint(headers)...)
+// with --original-sql, the original sqls of the trx are printed after tables
+func GetBigLongTrxPrintHeaderLine(headers []string, ifOriginalSql bool) string {
+	//{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows","duration", "gtid", "xid", "tables"}
+	line := fmt.Sprintf("%-17s %-19s %-19s %-10s %-10s %-8s %-10s %-48s %-40s %s", ConvertStrArrToIntferfaceArrForPrint(headers)...)
+	if ifOriginalSql {
+		line += " originalsqls"
+	}
+	return line + "\n"
 }
 
-func GetBigLongTrxContentLine(blTrx BigLongTrxInfo) string {
-	//{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows", "duration", "tables"}
-	return fmt.Sprintf("%-17s %-19s %-19s %-10d %-10d %-8d %-10d %s\n", blTrx.Binlog,
+func GetBigLongTrxContentLine(blTrx BigLongTrxInfo, ifOriginalSql bool) string {
+	//{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows", "duration", "gtid", "xid", "tables"}
+	gtid := blTrx.Gtid
+	if gtid == "" {
+		gtid = "-"
+	}
+	xid := blTrx.Xid
+	if xid == "" {
+		xid = "-"
+	}
+	line := fmt.Sprintf("%-17s %-19s %-19s %-10d %-10d %-8d %-10d %-48s %-40s %s", blTrx.Binlog,
 		GetDatetimeStr(int64(blTrx.StartTime), int64(0), DATETIME_FORMAT_NOSPACE),
 		GetDatetimeStr(int64(blTrx.StopTime), int64(0), DATETIME_FORMAT_NOSPACE),
 		blTrx.StartPos, blTrx.StopPos,
-		blTrx.RowCnt, blTrx.Duration, GetBigLongTrxStatementsStr(blTrx.Statements))
+		blTrx.RowCnt, blTrx.Duration, gtid, xid, GetBigLongTrxStatementsStr(blTrx.Statements))
+	if ifOriginalSql {
+		line += " " + GetBigLongTrxOriginalSqlsStr(blTrx.OriginalSqls)
+	}
+	return line + "\n"
+}
+
+func GetBigLongTrxOriginalSqlsStr(sqls []string) string {
+	strArr := make([]string, len(sqls))
+	for i, sql := range sqls {
+		strArr[i] = GetOriginalSqlOneLine(sql)
+	}
+	return fmt.Sprintf("[%s]", strings.Join(strArr, "; "))
 }
 
 func GetBigLongTrxStatementsStr(st map[string]map[string]uint32) string {
@@ -284,7 +380,8 @@ func GetDbTbAndQueryAndRowCntFromBinevent(ev *replication.BinlogEvent) (string,
 		rowCnt = uint32(len(wrEvent.Rows))
 
 	case replication.UPDATE_ROWS_EVENTv1,
-		replication.UPDATE_ROWS_EVENTv2:
+		replication.UPDATE_ROWS_EVENTv2,
+		replication.PARTIAL_UPDATE_ROWS_EVENT:
 
 		wrEvent := ev.Event.(*replication.RowsEvent)
 		db = string(wrEvent.Table.Schema)
@@ -321,6 +418,10 @@ func GetDbTbAndQueryAndRowCntFromBinevent(ev *replication.BinlogEvent) (string,
 		sql = "commit"
 		sqlType = "query"
 
+	case replication.XA_PREPARE_LOG_EVENT:
+		sql = "xa prepare"
+		sqlType = "query"
+
 	}
 	//fmt.Println(db, tb, sqlType, rowCnt, sql)
 	return db, tb, sqlType, sql, rowCnt
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// optional metadata of table map event, written by mysql 8.0 with binlog_row_metadata=FULL(some with MINIMAL)
+// see mysql libbinlogevents/include/rows_event.h
+const (
+	TBMAP_OPT_META_SIGNEDNESS                   = 1
+	TBMAP_OPT_META_DEFAULT_CHARSET              = 2
+	TBMAP_OPT_META_COLUMN_CHARSET               = 3
+	TBMAP_OPT_META_COLUMN_NAME                  = 4
+	TBMAP_OPT_META_SET_STR_VALUE                = 5
+	TBMAP_OPT_META_ENUM_STR_VALUE               = 6
+	TBMAP_OPT_META_GEOMETRY_TYPE                = 7
+	TBMAP_OPT_META_SIMPLE_PRIMARY_KEY           = 8
+	TBMAP_OPT_META_PRIMARY_KEY_WITH_PREFIX      = 9
+	TBMAP_OPT_META_ENUM_AND_SET_DEFAULT_CHARSET = 10
+	TBMAP_OPT_META_ENUM_AND_SET_COLUMN_CHARSET  = 11
+	TBMAP_OPT_META_COLUMN_VISIBILITY            = 12
+
+	BINARY_COLLATION_ID = 63
+)
+
+var G_Geometry_Type_Names []string = []string{"geometry", "point", "linestring", "polygon",
+	"multipoint", "multilinestring", "multipolygon", "geometrycollection"}
+
+// all slices are indexed by column index of the table map event
+type TableMapOptMeta struct {
+	ColumnNames   []string
+	Unsigned      []bool
+	Charsets      []uint64 // collation id, 0 if unknown or not a character/enum/set column
+	EnumStrValues [][]string
+	SetStrValues  [][]string
+	GeometryTypes []uint64
+	PrimaryKey    []int
+}
+
+// get the real type of MYSQL_TYPE_STRING column, enum/set/char are all written as MYSQL_TYPE_STRING
+func GetRealTypeOfColumn(tp byte, meta uint16) byte {
+	if tp == mysql.MYSQL_TYPE_STRING {
+		if meta >= 256 {
+			b0 := uint8(meta >> 8)
+			if b0&0x30 != 0x30 {
+				return byte(b0 | 0x30)
+			} else {
+				return b0
+			}
+		}
+	}
+	return tp
+}
+
+func IfNumericColumnType(tp byte) bool {
+	switch tp {
+	case mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG,
+		mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_DOUBLE,
+		mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_DECIMAL:
+		return true
+	}
+	return false
+}
+
+func IfCharacterColumnType(tp byte) bool {
+	switch tp {
+	case mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_BLOB:
+		return true
+	}
+	return false
+}
+
+func IfEnumSetColumnType(tp byte) bool {
+	return tp == mysql.MYSQL_TYPE_ENUM || tp == mysql.MYSQL_TYPE_SET
+}
+
+// GetTableMapOptMetaPos returns the position where the optional metadata starts in the table map event body(checksum excluded)
+func GetTableMapOptMetaPos(data []byte, tableIDSize int) (int, error) {
+	pos := tableIDSize + 2 // table id, flags
+	for i := 0; i < 2; i++ {
+		// schema and table name, ends with 0x00
+		if pos >= len(data) {
+			return 0, errors.Errorf("table map event is too short, size %d", len(data))
+		}
+		pos += 1 + int(data[pos]) + 1
+	}
+	if pos >= len(data) {
+		return 0, errors.Errorf("table map event is too short, size %d", len(data))
+	}
+	colCnt, _, n := mysql.LengthEncodedInt(data[pos:])
+	pos += n + int(colCnt)
+	if pos >= len(data) {
+		return 0, errors.Errorf("table map event is too short, size %d", len(data))
+	}
+	metaLen, _, n := mysql.LengthEncodedInt(data[pos:])
+	pos += n + int(metaLen) + int(colCnt+7)/8
+	if pos > len(data) {
+		return 0, errors.Errorf("table map event is too short, size %d", len(data))
+	}
+	return pos, nil
+}
+
+func readLenEncInt(data []byte, pos *int) (uint64, error) {
+	if *pos >= len(data) {
+		return 0, errors.Errorf("optional metadata of table map event is too short")
+	}
+	num, _, n := mysql.LengthEncodedInt(data[*pos:])
+	if *pos+n > len(data) {
+		return 0, errors.Errorf("optional metadata of table map event is too short")
+	}
+	*pos += n
+	return num, nil
+}
+
+func readLenEncStr(data []byte, pos *int) (string, error) {
+	l, err := readLenEncInt(data, pos)
+	if err != nil {
+		return "", err
+	}
+	if *pos+int(l) > len(data) {
+		return "", errors.Errorf("optional metadata of table map event is too short")
+	}
+	s := string(data[*pos : *pos+int(l)])
+	*pos += int(l)
+	return s, nil
+}
+
+// column indexes of the columns of the type that matchFunc returns true
+func getColumnIndexesOfType(tbMap *replication.TableMapEvent, matchFunc func(byte) bool) []int {
+	var idxes []int
+	for i, tp := range tbMap.ColumnType {
+		if matchFunc(GetRealTypeOfColumn(tp, tbMap.ColumnMeta[i])) {
+			idxes = append(idxes, i)
+		}
+	}
+	return idxes
+}
+
+func DecodeTableMapOptMeta(data []byte, tbMap *replication.TableMapEvent) (*TableMapOptMeta, error) {
+	colCnt := int(tbMap.ColumnCount)
+	meta := &TableMapOptMeta{
+		Unsigned:      make([]bool, colCnt),
+		Charsets:      make([]uint64, colCnt),
+		EnumStrValues: make([][]string, colCnt),
+		SetStrValues:  make([][]string, colCnt),
+		GeometryTypes: make([]uint64, colCnt),
+	}
+	numCols := getColumnIndexesOfType(tbMap, IfNumericColumnType)
+	charCols := getColumnIndexesOfType(tbMap, IfCharacterColumnType)
+	enumSetCols := getColumnIndexesOfType(tbMap, IfEnumSetColumnType)
+	enumCols := getColumnIndexesOfType(tbMap, func(tp byte) bool { return tp == mysql.MYSQL_TYPE_ENUM })
+	setCols := getColumnIndexesOfType(tbMap, func(tp byte) bool { return tp == mysql.MYSQL_TYPE_SET })
+	geoCols := getColumnIndexesOfType(tbMap, func(tp byte) bool { return tp == mysql.MYSQL_TYPE_GEOMETRY })
+
+	var err error
+	pos := 0
+	for pos < len(data) {
+		fieldType := data[pos]
+		pos++
+		var fieldLen uint64
+		if fieldLen, err = readLenEncInt(data, &pos); err != nil {
+			return nil, err
+		}
+		if pos+int(fieldLen) > len(data) {
+			return nil, errors.Errorf("optional metadata field %d of table map event is too short", fieldType)
+		}
+		v := data[pos : pos+int(fieldLen)]
+		pos += int(fieldLen)
+
+		switch fieldType {
+		case TBMAP_OPT_META_SIGNEDNESS:
+			for i, ci := range numCols {
+				if i/8 < len(v) && v[i/8]&(0x80>>uint(i%8)) != 0 {
+					meta.Unsigned[ci] = true
+				}
+			}
+		case TBMAP_OPT_META_DEFAULT_CHARSET, TBMAP_OPT_META_ENUM_AND_SET_DEFAULT_CHARSET:
+			cols := charCols
+			if fieldType == TBMAP_OPT_META_ENUM_AND_SET_DEFAULT_CHARSET {
+				cols = enumSetCols
+			}
+			err = meta.decodeDefaultCharset(v, cols)
+		case TBMAP_OPT_META_COLUMN_CHARSET, TBMAP_OPT_META_ENUM_AND_SET_COLUMN_CHARSET:
+			cols := charCols
+			if fieldType == TBMAP_OPT_META_ENUM_AND_SET_COLUMN_CHARSET {
+				cols = enumSetCols
+			}
+			p := 0
+			for _, ci := range cols {
+				if meta.Charsets[ci], err = readLenEncInt(v, &p); err != nil {
+					break
+				}
+			}
+		case TBMAP_OPT_META_COLUMN_NAME:
+			p := 0
+			meta.ColumnNames = make([]string, colCnt)
+			for ci := 0; ci < colCnt; ci++ {
+				if meta.ColumnNames[ci], err = readLenEncStr(v, &p); err != nil {
+					break
+				}
+			}
+		case TBMAP_OPT_META_SET_STR_VALUE:
+			err = decodeTypeStrValues(v, setCols, meta.SetStrValues)
+		case TBMAP_OPT_META_ENUM_STR_VALUE:
+			err = decodeTypeStrValues(v, enumCols, meta.EnumStrValues)
+		case TBMAP_OPT_META_GEOMETRY_TYPE:
+			p := 0
+			for _, ci := range geoCols {
+				if meta.GeometryTypes[ci], err = readLenEncInt(v, &p); err != nil {
+					break
+				}
+			}
+		case TBMAP_OPT_META_SIMPLE_PRIMARY_KEY, TBMAP_OPT_META_PRIMARY_KEY_WITH_PREFIX:
+			p := 0
+			for p < len(v) {
+				var ci uint64
+				if ci, err = readLenEncInt(v, &p); err != nil {
+					break
+				}
+				meta.PrimaryKey = append(meta.PrimaryKey, int(ci))
+				if fieldType == TBMAP_OPT_META_PRIMARY_KEY_WITH_PREFIX {
+					// prefix length
+					if _, err = readLenEncInt(v, &p); err != nil {
+						break
+					}
+				}
+			}
+		default:
+			// unknown or useless for us, ex: column visibility
+		}
+		if err != nil {
+			return nil, errors.Annotatef(err, "fail to decode optional metadata field %d of table map event", fieldType)
+		}
+	}
+	return meta, nil
+}
+
+func (this *TableMapOptMeta) decodeDefaultCharset(v []byte, cols []int) error {
+	p := 0
+	defCharset, err := readLenEncInt(v, &p)
+	if err != nil {
+		return err
+	}
+	for _, ci := range cols {
+		this.Charsets[ci] = defCharset
+	}
+	// pairs of (index of the column in cols, collation id) for columns not using default charset
+	for p < len(v) {
+		idx, err := readLenEncInt(v, &p)
+		if err != nil {
+			return err
+		}
+		charset, err := readLenEncInt(v, &p)
+		if err != nil {
+			return err
+		}
+		if int(idx) < len(cols) {
+			this.Charsets[cols[idx]] = charset
+		}
+	}
+	return nil
+}
+
+func decodeTypeStrValues(v []byte, cols []int, strValues [][]string) error {
+	p := 0
+	for _, ci := range cols {
+		cnt, err := readLenEncInt(v, &p)
+		if err != nil {
+			return err
+		}
+		strValues[ci] = make([]string, cnt)
+		for i := range strValues[ci] {
+			if strValues[ci][i], err = readLenEncStr(v, &p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// column names are the must to generate sql without table definition from mysql
+func (this *TableMapOptMeta) HasColumnNames() bool {
+	return this != nil && len(this.ColumnNames) > 0
+}
+
+// GetDataTypeName returns the name like DATA_TYPE of information_schema.columns
+func (this *TableMapOptMeta) GetDataTypeName(ci int, tbMap *replication.TableMapEvent) string {
+	tp := GetRealTypeOfColumn(tbMap.ColumnType[ci], tbMap.ColumnMeta[ci])
+	ifBinary := this.Charsets[ci] == BINARY_COLLATION_ID
+	switch tp {
+	case mysql.MYSQL_TYPE_BLOB:
+		prefixes := []string{"tiny", "", "medium", "long"}
+		prefix := ""
+		if tbMap.ColumnMeta[ci] >= 1 && tbMap.ColumnMeta[ci] <= 4 {
+			prefix = prefixes[tbMap.ColumnMeta[ci]-1]
+		}
+		if ifBinary || this.Charsets[ci] == 0 {
+			return prefix + "blob"
+		}
+		return prefix + "text"
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING:
+		if ifBinary {
+			return "varbinary"
+		}
+		return "varchar"
+	case mysql.MYSQL_TYPE_STRING:
+		if ifBinary {
+			return "binary"
+		}
+		return "char"
+	case mysql.MYSQL_TYPE_GEOMETRY:
+		if this.GeometryTypes[ci] < uint64(len(G_Geometry_Type_Names)) {
+			return G_Geometry_Type_Names[this.GeometryTypes[ci]]
+		}
+		return "geometry"
+	}
+	typeName, _ := GetMysqlDataTypeNameAndSqlColumn("", this.ColumnNames[ci], tbMap.ColumnType[ci], tbMap.ColumnMeta[ci])
+	return typeName
+}
+
+// GetTblInfoJson builds table definition from the optional metadata, only primary key, no unique key
+func (this *TableMapOptMeta) GetTblInfoJson(tbMap *replication.TableMapEvent) *TblInfoJson {
+	tbInfo := &TblInfoJson{Database: string(tbMap.Schema), Table: string(tbMap.Table),
+		Columns: make([]FieldInfo, len(this.ColumnNames)), PrimaryKey: KeyInfo{}, UniqueKeys: []KeyInfo{}}
+	for ci, name := range this.ColumnNames {
+		tbInfo.Columns[ci] = FieldInfo{FieldName: name, FieldType: this.GetDataTypeName(ci, tbMap), IsUnsigned: this.Unsigned[ci]}
+		if len(this.EnumStrValues[ci]) > 0 {
+			tbInfo.Columns[ci].EnumSetValues = this.EnumStrValues[ci]
+		} else if len(this.SetStrValues[ci]) > 0 {
+			tbInfo.Columns[ci].EnumSetValues = this.SetStrValues[ci]
+		}
+	}
+	for _, ci := range this.PrimaryKey {
+		if ci >= len(this.ColumnNames) {
+			CheckErr(fmt.Errorf("primary key column index %d out of range of %d columns", ci, len(this.ColumnNames)),
+				"invalid optional metadata of table map event for "+GetAbsTableName(tbInfo.Database, tbInfo.Table), ERR_BINEVENT_BODY, false)
+			tbInfo.PrimaryKey = KeyInfo{}
+			return tbInfo
+		}
+		tbInfo.PrimaryKey = append(tbInfo.PrimaryKey, this.ColumnNames[ci])
+	}
+	return tbInfo
+}
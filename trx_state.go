@@ -0,0 +1,122 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/siddontang/go-mysql/replication"
+)
+
+var (
+	RegexpMatchXaBeginQuery *regexp.Regexp = regexp.MustCompile(`^xa\s+(start|begin)\s`)
+	RegexpMatchXaEndQuery   *regexp.Regexp = regexp.MustCompile(`^xa\s+end\s`)
+	RegexpMatchXaCommit     *regexp.Regexp = regexp.MustCompile(`^xa\s+commit\s`)
+	RegexpMatchXaRollback   *regexp.Regexp = regexp.MustCompile(`^xa\s+rollback\s`)
+)
+
+// transaction boundaries of one binlog stream, shared by mode file and repl.
+// a transaction begins with gtid event, query BEGIN or XA START, and ends with
+// XID event, query COMMIT/ROLLBACK(non-transactional engine), XA PREPARE event or XA COMMIT/XA ROLLBACK.
+// ddl is an implicit transaction of its own: gtid event(if any) + query
+type TrxStateMachine struct {
+	TrxIndex   uint64
+	InTrx      bool
+	Xid        string // xid of the current or just ended xa transaction, empty if not xa
+	justBegun  bool   // begun by gtid event, no other event yet
+	standalone bool   // begun by gtid event, and not by BEGIN or XA START yet, so the next query is a ddl
+}
+
+func (this *TrxStateMachine) begin() {
+	this.TrxIndex++
+	this.InTrx = true
+	this.justBegun = false
+	this.standalone = false
+	this.Xid = ""
+}
+
+func (this *TrxStateMachine) end(trxStatus int) int {
+	this.InTrx = false
+	this.justBegun = false
+	this.standalone = false
+	return trxStatus
+}
+
+// feed every event that passes the position, datetime and gtid conditions, return TRX_STATUS_XXX of the event
+func (this *TrxStateMachine) NextEvent(header *replication.EventHeader, e replication.Event) int {
+	switch header.EventType {
+	case replication.GTID_EVENT, replication.ANONYMOUS_GTID_EVENT:
+		// followed by query BEGIN, XA START, or a ddl
+		this.begin()
+		this.justBegun = true
+		this.standalone = true
+		return TRX_STATUS_BEGIN
+	case replication.MARIADB_GTID_EVENT:
+		// mariadb writes no BEGIN query
+		this.begin()
+		this.justBegun = true
+		if gtidEv, ok := e.(*replication.MariadbGTIDEvent); ok {
+			this.standalone = gtidEv.IsStandalone()
+		}
+		return TRX_STATUS_BEGIN
+	case replication.XID_EVENT:
+		return this.end(TRX_STATUS_COMMIT)
+	case replication.XA_PREPARE_LOG_EVENT:
+		// the first part of xa transaction, XA COMMIT|ROLLBACK is another transaction
+		if xaEv, ok := e.(*XaPrepareEvent); ok {
+			this.Xid = xaEv.Xid()
+		}
+		return this.end(TRX_STATUS_PREPARE)
+	case replication.QUERY_EVENT:
+		if queryEv, ok := e.(*replication.QueryEvent); ok {
+			return this.nextQuery(string(queryEv.Query))
+		}
+	}
+	if this.InTrx && header.EventType != replication.ROTATE_EVENT && header.EventType != replication.FORMAT_DESCRIPTION_EVENT {
+		this.justBegun = false
+	}
+	return TRX_STATUS_PROGRESS
+}
+
+func (this *TrxStateMachine) nextQuery(originalQuery string) int {
+	query := strings.ToLower(strings.TrimSpace(originalQuery))
+	switch {
+	case query == "begin" || RegexpMatchXaBeginQuery.MatchString(query):
+		if this.InTrx && this.justBegun {
+			// begun by gtid event already
+			this.justBegun = false
+			this.standalone = false
+		} else {
+			this.begin()
+		}
+		this.Xid = GetXidFromXaQuery(originalQuery)
+		return TRX_STATUS_BEGIN
+	case query == "commit" || RegexpMatchXaCommit.MatchString(query):
+		if xid := GetXidFromXaQuery(originalQuery); xid != "" {
+			this.Xid = xid
+		}
+		return this.end(TRX_STATUS_COMMIT)
+	case query == "rollback" || RegexpMatchXaRollback.MatchString(query):
+		if xid := GetXidFromXaQuery(originalQuery); xid != "" {
+			this.Xid = xid
+		}
+		return this.end(TRX_STATUS_ROLLBACK)
+	case RegexpMatchXaEndQuery.MatchString(query):
+		this.justBegun = false
+		return TRX_STATUS_PROGRESS
+	}
+	if this.InTrx && !this.standalone {
+		// statement of statement/mixed format, savepoint, and so on
+		this.justBegun = false
+		return TRX_STATUS_PROGRESS
+	}
+	if !this.InTrx {
+		// ddl without gtid
+		this.begin()
+	}
+	return this.end(TRX_STATUS_IMPLICIT)
+}
+
+func IfTrxEndStatus(trxStatus int) bool {
+	return trxStatus == TRX_STATUS_COMMIT || trxStatus == TRX_STATUS_ROLLBACK ||
+		trxStatus == TRX_STATUS_IMPLICIT || trxStatus == TRX_STATUS_PREPARE
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+var (
+	RegexpMatchXaQueryXid  *regexp.Regexp = regexp.MustCompile(`(?is)^\s*xa\s+(?:start|begin|end|prepare|commit|rollback)\s+(.+?)\s*$`)
+	RegexpMatchXaXidSuffix *regexp.Regexp = regexp.MustCompile(`(?i)\s+(one\s+phase|join|resume|suspend(\s+for\s+migrate)?)$`)
+	RegexpMatchXaOnePhase  *regexp.Regexp = regexp.MustCompile(`(?i)\s+one\s+phase\s*$`)
+)
+
+var Stats_XaTrx_Header_Column_names []string = []string{"xid", "state", "binlog", "preparetime", "startpos", "stoppos", "rows",
+	"endbinlog", "endtime", "endpos", "gtid"}
+
+const (
+	XA_STATE_PREPARED   = "prepared_not_committed"
+	XA_STATE_COMMITTED  = "committed"
+	XA_STATE_ONE_PHASE  = "committed_one_phase"
+	XA_STATE_ROLLEDBACK = "rolledback"
+)
+
+// XA_PREPARE_LOG_EVENT, not parsed by go-mysql. the xid is formatted the same as XA START X'..',X'..',n in binlog
+type XaPrepareEvent struct {
+	OnePhase bool
+	FormatID uint32
+	Gtrid    []byte
+	Bqual    []byte
+}
+
+func (this *XaPrepareEvent) Decode(data []byte) error {
+	if len(data) < 13 {
+		return errors.Errorf("invalid xa prepare event, length %d is too small", len(data))
+	}
+	this.OnePhase = data[0] != 0
+	this.FormatID = binary.LittleEndian.Uint32(data[1:])
+	gtridLen := int(binary.LittleEndian.Uint32(data[5:]))
+	bqualLen := int(binary.LittleEndian.Uint32(data[9:]))
+	if len(data) < 13+gtridLen+bqualLen {
+		return errors.Errorf("invalid xa prepare event, gtrid length %d, bqual length %d, but data length %d", gtridLen, bqualLen, len(data))
+	}
+	this.Gtrid = data[13 : 13+gtridLen]
+	this.Bqual = data[13+gtridLen : 13+gtridLen+bqualLen]
+	return nil
+}
+
+func (this *XaPrepareEvent) Dump(w io.Writer) {
+	fmt.Fprintf(w, "XID: %s\n", this.Xid())
+	fmt.Fprintf(w, "One phase: %v\n", this.OnePhase)
+	fmt.Fprintln(w)
+}
+
+func (this *XaPrepareEvent) Xid() string {
+	return fmt.Sprintf("X'%x',X'%x',%d", this.Gtrid, this.Bqual, this.FormatID)
+}
+
+// xid of XA START|END|PREPARE|COMMIT|ROLLBACK query, empty if not a xa query
+func GetXidFromXaQuery(query string) string {
+	arr := RegexpMatchXaQueryXid.FindStringSubmatch(query)
+	if arr == nil {
+		return ""
+	}
+	return RegexpMatchXaXidSuffix.ReplaceAllString(arr[1], "")
+}
+
+type XaTrxInfo struct {
+	Xid         string
+	State       string
+	Binlog      string
+	PrepareTime uint32
+	StartPos    uint32
+	StopPos     uint32
+	RowCnt      uint32
+	EndBinlog   string
+	EndTime     uint32
+	EndPos      uint32
+	Gtid        string
+}
+
+// xa branches prepared but not committed or rolled back yet, in order of prepare
+type XaTrxTracker struct {
+	pending []*XaTrxInfo
+}
+
+func (this *XaTrxTracker) Prepare(xa *XaTrxInfo) {
+	xa.State = XA_STATE_PREPARED
+	this.pending = append(this.pending, xa)
+}
+
+// the prepared branch, or a branch with unknown prepare position if it is prepared before the binlog parsed
+func (this *XaTrxTracker) Finish(xid string) *XaTrxInfo {
+	for i, xa := range this.pending {
+		if xa.Xid == xid {
+			this.pending = append(this.pending[:i], this.pending[i+1:]...)
+			return xa
+		}
+	}
+	return &XaTrxInfo{Xid: xid}
+}
+
+func (this *XaTrxTracker) Pending() []*XaTrxInfo {
+	return this.pending
+}
+
+func GetXaTrxPrintHeaderLine(headers []string) string {
+	//{"xid", "state", "binlog", "preparetime", "startpos", "stoppos", "rows", "endbinlog", "endtime", "endpos", "gtid"}
+	return fmt.Sprintf("%-40s %-22s %-17s %-19s %-10s %-10s %-8s %-17s %-19s %-10s %s\n", ConvertStrArrToIntferfaceArrForPrint(headers)...)
+}
+
+func GetXaTrxContentLine(xa *XaTrxInfo) string {
+	//{"xid", "state", "binlog", "preparetime", "startpos", "stoppos", "rows", "endbinlog", "endtime", "endpos", "gtid"}
+	strArr := []string{"-", "-", "-", "-", "-", "-", "-"}
+	if xa.Binlog != "" {
+		strArr[0] = xa.Binlog
+		strArr[1] = GetDatetimeStr(int64(xa.PrepareTime), int64(0), DATETIME_FORMAT_NOSPACE)
+		strArr[2] = fmt.Sprintf("%d", xa.StartPos)
+		strArr[3] = fmt.Sprintf("%d", xa.StopPos)
+	}
+	if xa.EndBinlog != "" {
+		strArr[4] = xa.EndBinlog
+		strArr[5] = GetDatetimeStr(int64(xa.EndTime), int64(0), DATETIME_FORMAT_NOSPACE)
+		strArr[6] = fmt.Sprintf("%d", xa.EndPos)
+	}
+	gtid := xa.Gtid
+	if gtid == "" {
+		gtid = "-"
+	}
+	return fmt.Sprintf("%-40s %-22s %-17s %-19s %-10s %-10s %-8d %-17s %-19s %-10s %s\n", xa.Xid, xa.State,
+		strArr[0], strArr[1], strArr[2], strArr[3], xa.RowCnt, strArr[4], strArr[5], strArr[6], gtid)
+}
+
+// with --keep-trx, the end of xa branch(XA PREPARE, XA COMMIT|ROLLBACK) is sent to generate sql too,
+// to write XA statements around the sqls of the branch
+func IfSendXaEndEvent(cfg ConfCmd, trxState *TrxStateMachine, trxStatus int) bool {
+	return cfg.WorkType == "2sql" && cfg.KeepTrx && trxState.Xid != "" && IfTrxEndStatus(trxStatus)
+}
+
+func (this *MyBinEvent) SetXaEnd(timestamp uint32, trxState *TrxStateMachine, trxStatus int, gtid string) {
+	this.IfRowsEvent = false
+	this.SqlType = "xa"
+	this.Timestamp = timestamp
+	this.TrxIndex = trxState.TrxIndex
+	this.TrxStatus = trxStatus
+	this.Gtid = gtid
+	this.Xid = trxState.Xid
+}
+
+// sql written at the end of a xa branch with --keep-trx, empty if it is not the end of xa branch.
+// sameTrx: the branch is ended in the trx it is started, so it is still active and XA END goes first
+func GetXaEndSql(xid string, trxStatus int, sameTrx bool) string {
+	xaEnd := ""
+	if sameTrx {
+		xaEnd = fmt.Sprintf("XA END %s;\n", xid)
+	}
+	switch trxStatus {
+	case TRX_STATUS_PREPARE:
+		return fmt.Sprintf("XA END %s;\nXA PREPARE %s;\n", xid, xid)
+	case TRX_STATUS_COMMIT:
+		if sameTrx {
+			return xaEnd + fmt.Sprintf("XA COMMIT %s ONE PHASE;\n", xid)
+		}
+		return fmt.Sprintf("XA COMMIT %s;\n", xid)
+	case TRX_STATUS_ROLLBACK:
+		return xaEnd + fmt.Sprintf("XA ROLLBACK %s;\n", xid)
+	}
+	return ""
+}
+
+// oneTrx is the trx ended by st
+func ProcessXaTrxEnd(xaFH *os.File, xaTracker *XaTrxTracker, oneTrx BigLongTrxInfo, st BinEventStats) {
+	if st.TrxStatus == TRX_STATUS_PREPARE {
+		xaTracker.Prepare(&XaTrxInfo{Xid: st.Xid, Binlog: st.Binlog, PrepareTime: st.Timestamp, StartPos: oneTrx.StartPos,
+			StopPos: st.StopPos, RowCnt: oneTrx.RowCnt, Gtid: oneTrx.Gtid})
+		return
+	}
+	var xa *XaTrxInfo
+	if IfXaOnePhaseQuery(st.QuerySql) {
+		xa = &XaTrxInfo{Xid: st.Xid, State: XA_STATE_ONE_PHASE, Binlog: st.Binlog, PrepareTime: st.Timestamp,
+			StartPos: oneTrx.StartPos, StopPos: st.StopPos, RowCnt: oneTrx.RowCnt, Gtid: oneTrx.Gtid}
+	} else {
+		xa = xaTracker.Finish(st.Xid)
+		if st.TrxStatus == TRX_STATUS_COMMIT {
+			xa.State = XA_STATE_COMMITTED
+		} else {
+			xa.State = XA_STATE_ROLLEDBACK
+		}
+	}
+	xa.EndBinlog = st.Binlog
+	xa.EndTime = st.Timestamp
+	xa.EndPos = st.StopPos
+	if xa.Gtid == "" {
+		xa.Gtid = st.Gtid
+	}
+	xaFH.WriteString(GetXaTrxContentLine(xa))
+}
+
+func IfXaOnePhaseQuery(query string) bool {
+	return RegexpMatchXaOnePhase.MatchString(strings.TrimSpace(query))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestGetXaEndSql(t *testing.T) {
+	cases := []struct {
+		trxStatus int
+		sameTrx   bool
+		expected  string
+	}{
+		{TRX_STATUS_PREPARE, true, "XA END 'x1';\nXA PREPARE 'x1';\n"},
+		{TRX_STATUS_COMMIT, true, "XA END 'x1';\nXA COMMIT 'x1' ONE PHASE;\n"},
+		{TRX_STATUS_ROLLBACK, true, "XA END 'x1';\nXA ROLLBACK 'x1';\n"},
+		{TRX_STATUS_COMMIT, false, "XA COMMIT 'x1';\n"},
+		{TRX_STATUS_ROLLBACK, false, "XA ROLLBACK 'x1';\n"},
+		{TRX_STATUS_BEGIN, true, ""},
+	}
+	for _, c := range cases {
+		if got := GetXaEndSql("'x1'", c.trxStatus, c.sameTrx); got != c.expected {
+			t.Errorf("status %d sameTrx %v: expect %q, got %q", c.trxStatus, c.sameTrx, c.expected, got)
+		}
+	}
+}
+
+func xaTestRow(table string, sql string, trxIndex uint64, xid string) ForwardRollbackSqlOfPrint {
+	var sqls []string
+	if sql != "" {
+		sqls = []string{sql}
+	}
+	return ForwardRollbackSqlOfPrint{sqls: sqls, sqlInfo: ExtraSqlInfoOfPrint{schema: "db", table: table,
+		binlog: "mysql-bin.000001", trxIndex: trxIndex, xid: xid, sqlType: "insert"}}
+}
+
+func xaTestEnd(trxIndex uint64, xid string, trxStatus int) ForwardRollbackSqlOfPrint {
+	return ForwardRollbackSqlOfPrint{sqlInfo: ExtraSqlInfoOfPrint{binlog: "mysql-bin.000001", trxIndex: trxIndex, xid: xid,
+		trxStatus: trxStatus, sqlType: "xa"}}
+}
+
+// --wtype=2sql --keep-trx, returns the result files
+func xaTestPrint(t *testing.T, filePerTable bool, scs []ForwardRollbackSqlOfPrint) map[string]string {
+	dir, err := ioutil.TempDir("", "xa_trx_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := ConfCmd{WorkType: "2sql", KeepTrx: true, FilePerTable: filePerTable, OutputDir: dir}
+
+	sqlChan := make(chan ForwardRollbackSqlOfPrint, len(scs))
+	for _, sc := range scs {
+		sqlChan <- sc
+	}
+	close(sqlChan)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	PrintExtraInfoForForwardRollbackupSql(cfg, sqlChan, &wg)
+
+	files := map[string]string{}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		content, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[fi.Name()] = string(content)
+	}
+	return files
+}
+
+func TestPrintXaBranchesWithKeepTrx(t *testing.T) {
+	files := xaTestPrint(t, false, []ForwardRollbackSqlOfPrint{
+		xaTestRow("t", "insert 1", 1, "'x1'"), xaTestEnd(1, "'x1'", TRX_STATUS_ROLLBACK),
+		xaTestRow("t", "insert 2", 2, "'x2'"), xaTestRow("t", "", 2, "'x2'"), xaTestEnd(2, "'x2'", TRX_STATUS_COMMIT),
+		xaTestRow("t", "insert 3", 3, "'x3'"), xaTestEnd(3, "'x3'", TRX_STATUS_PREPARE),
+		xaTestRow("t", "insert 4", 4, ""),
+		xaTestEnd(5, "'x3'", TRX_STATUS_ROLLBACK),
+		xaTestRow("t", "insert 6", 6, "'x6'"),
+	})
+	// commit of the trx before the first one, as always with --keep-trx
+	expected := map[string]string{"forward.1.sql": "commit;\nXA START 'x1';\ninsert 1;\nXA END 'x1';\nXA ROLLBACK 'x1';\n" +
+		"XA START 'x2';\ninsert 2;\nXA END 'x2';\nXA COMMIT 'x2' ONE PHASE;\n" +
+		"XA START 'x3';\ninsert 3;\nXA END 'x3';\nXA PREPARE 'x3';\n" +
+		"begin;\ninsert 4;\ncommit;\nXA ROLLBACK 'x3';\n" +
+		"XA START 'x6';\ninsert 6;\nXA END 'x6';\n"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expect:\n%v\ngot:\n%v", expected, files)
+	}
+}
+
+// --file-each-table, a xa branch writes to the files of all the tables it changes
+func TestPrintXaBranchesWithKeepTrxFileEachTable(t *testing.T) {
+	files := xaTestPrint(t, true, []ForwardRollbackSqlOfPrint{
+		xaTestRow("t1", "insert t1 1", 1, "'x1'"), xaTestRow("t2", "insert t2 1", 1, "'x1'"), xaTestEnd(1, "'x1'", TRX_STATUS_PREPARE),
+		xaTestRow("t1", "insert t1 2", 2, ""),
+		xaTestEnd(3, "'x1'", TRX_STATUS_COMMIT),
+		xaTestRow("t2", "insert t2 4", 4, "'x4'"), xaTestRow("t1", "insert t1 4", 4, "'x4'"), xaTestEnd(4, "'x4'", TRX_STATUS_ROLLBACK),
+		xaTestRow("t1", "insert t1 5", 5, "'x5'"), xaTestRow("t2", "insert t2 5", 5, "'x5'"),
+	})
+	expected := map[string]string{
+		"db.t1.forward.1.sql": "commit;\nXA START 'x1';\ninsert t1 1;\nXA END 'x1';\nXA PREPARE 'x1';\n" +
+			"begin;\ninsert t1 2;\ncommit;\nXA COMMIT 'x1';\n" +
+			"XA START 'x4';\ninsert t1 4;\nXA END 'x4';\nXA ROLLBACK 'x4';\n" +
+			"XA START 'x5';\ninsert t1 5;\nXA END 'x5';\n",
+		"db.t2.forward.1.sql": "commit;\nXA START 'x1';\ninsert t2 1;\nXA END 'x1';\nXA PREPARE 'x1';\n" +
+			"XA COMMIT 'x1';\n" +
+			"XA START 'x4';\ninsert t2 4;\nXA END 'x4';\nXA ROLLBACK 'x4';\n" +
+			"XA START 'x5';\ninsert t2 5;\nXA END 'x5';\n",
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expect:\n%v\ngot:\n%v", expected, files)
+	}
+}